@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Size of the swatch PNG written by analyze -swatch
+const (
+	swatchWidth       = 960
+	swatchPaletteSize = 120
+)
+
+// frameAnalysis is what the sync loop would make of one frame
+type frameAnalysis struct {
+	Size      image.Rectangle // original frame
+	Analyzed  image.Rectangle // downscaled and cropped frame
+	Crop      *CropInsets     // detected black bars, nil without LETTERBOX
+	Histogram RGB             // mostFrequentColor
+	Extractor string
+	Color     RGB // COLOR_EXTRACTOR result, the color sent in single mode
+	// Brightness follows BRIGHTNESS.MODE
+	Brightness int
+	Top        []ColorStat
+	Zones      []Zone // zone layout, relative to the cropped frame
+	ZoneColors []RGB
+}
+
+// runAnalyze implements the analyze command
+func runAnalyze(configPath string, args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	swatch := fs.Bool("swatch", false, "write <image>.analysis.png with the palette and zone layout next to each image")
+	zones := fs.Bool("zones", false, "analyze the ZONES layout even if MODE is single")
+	top := fs.Int("top", 10, "number of palette colors to print")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [-config file] analyze [flags] <image...>\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Runs PNG or JPEG images through the color analysis of the sync loop with the settings of the config.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no images given")
+	}
+	if *top < 1 {
+		return fmt.Errorf("-top must be at least 1, got %d", *top)
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		def := defaultConfig()
+		cfg = &def
+	}
+	appConfig = cfg
+	logger = zap.NewNop().Sugar()
+
+	var failed []string
+	for i, path := range fs.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		img, err := loadFrame(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = append(failed, path)
+			continue
+		}
+		a, err := analyzeFrame(img, cfg, *top, *zones || cfg.Env.MODE == ModeZones)
+		if err != nil {
+			return err
+		}
+		printFrameAnalysis(os.Stdout, path, a)
+		if *swatch {
+			out := strings.TrimSuffix(path, filepath.Ext(path)) + ".analysis.png"
+			if err := writeFile(out, func(w io.Writer) error { return png.Encode(w, renderSwatch(img, a)) }); err != nil {
+				return err
+			}
+			fmt.Printf("  Wrote %s\n", out)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to read %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// analyzeFrame runs img through REGION, downscale, LETTERBOX and the color
+// extraction like the sync loop does
+func analyzeFrame(img image.Image, cfg *Config, topN int, withZones bool) (frameAnalysis, error) {
+	env := &cfg.Env
+	a := frameAnalysis{Size: img.Bounds()}
+	sampled := img
+	if env.REGION.enabled() {
+		region, err := newRegionMask(env.REGION)
+		if err != nil {
+			return a, err
+		}
+		sampled = region.Apply(img)
+	}
+	small := downscale(sampled)
+	if env.LETTERBOX.ENABLED {
+		// One frame is all there is, so the crop applies right away
+		crop := newCropTracker(LetterboxConfig{THRESHOLD: env.LETTERBOX.THRESHOLD, STABLE_FRAMES: 1})
+		rect, _ := crop.Update(small)
+		insets := crop.Insets()
+		a.Crop = &insets
+		small = cropImage(small, rect)
+	}
+	a.Analyzed = small.Bounds()
+
+	extractor, err := newColorExtractor(env.COLOR_EXTRACTOR, env.PALETTE_SIZE)
+	if err != nil {
+		return a, err
+	}
+	a.Histogram = mostFrequentColor(small)
+	a.Extractor = extractor.Name()
+	a.Color = extractor.Extract(small)
+	a.Brightness = sceneBrightness(small, env.BRIGHTNESS)
+
+	// Shares count the pixels REGION did not mask, like topColors. With
+	// everything masked there are no colors to list.
+	total := unmaskedPixels(small)
+	for _, c := range topColors(small, topN) {
+		a.Top = append(a.Top, ColorStat{R: c.Color.R, G: c.Color.G, B: c.Color.B, Name: colorName(c.Color), Percent: colorPercent(c.Count, total)})
+	}
+
+	if withZones {
+		zones, err := buildZoneLayout(env.ZONES)
+		if err != nil {
+			return a, fmt.Errorf("ZONES: %w", err)
+		}
+		a.Zones = zones
+		a.ZoneColors = zoneColors(small, zones)
+	}
+	return a, nil
+}
+
+func printFrameAnalysis(w io.Writer, path string, a frameAnalysis) {
+	fmt.Fprintf(w, "%s (%dx%d, analyzed at %dx%d)\n", path, a.Size.Dx(), a.Size.Dy(), a.Analyzed.Dx(), a.Analyzed.Dy())
+	if a.Crop != nil {
+		fmt.Fprintf(w, "  Black bars:   %s\n", a.Crop)
+	}
+	fmt.Fprintf(w, "  Histogram:    %s\n", describeColor(a.Histogram))
+	if a.Extractor != "histogram" {
+		fmt.Fprintf(w, "  %-13s %s\n", a.Extractor+":", describeColor(a.Color))
+	}
+	fmt.Fprintf(w, "  Brightness:   %d\n", a.Brightness)
+	fmt.Fprintf(w, "  Top colors:\n")
+	for i, c := range a.Top {
+		fmt.Fprintf(w, "    %2d. %s %5.1f%%\n", i+1, describeColor(RGB{c.R, c.G, c.B}), c.Percent)
+	}
+	if len(a.Zones) > 0 {
+		fmt.Fprintf(w, "  Zones (%d, in LED order):\n", len(a.Zones))
+		for i, c := range a.ZoneColors {
+			fmt.Fprintf(w, "    %3d. %s\n", i, describeColor(c))
+		}
+	}
+}
+
+func describeColor(c RGB) string {
+	return fmt.Sprintf("#%02x%02x%02x  R:%3d G:%3d B:%3d  %s", c.R, c.G, c.B, c.R, c.G, c.B, colorName(c))
+}
+
+// renderSwatch draws the frame with the zone layout on top and the analysis
+// below it: the chosen color and the palette with widths by share
+func renderSwatch(img image.Image, a frameAnalysis) *image.RGBA {
+	b := img.Bounds()
+	height := swatchWidth * b.Dy() / max(b.Dx(), 1)
+	out := image.NewRGBA(image.Rect(0, 0, swatchWidth, height+swatchPaletteSize))
+	frame := image.Rect(0, 0, swatchWidth, height)
+	draw.ApproxBiLinear.Scale(out, frame, img, b, draw.Src, nil)
+
+	if len(a.Zones) > 0 {
+		// Zones are relative to the cropped, downscaled frame
+		content := frame
+		if a.Crop != nil {
+			content = image.Rect(
+				int(a.Crop.Left/100*float64(swatchWidth)), int(a.Crop.Top/100*float64(height)),
+				swatchWidth-int(a.Crop.Right/100*float64(swatchWidth)), height-int(a.Crop.Bottom/100*float64(height)))
+		}
+		for i, z := range a.Zones {
+			r := z.Rect(content)
+			fillRect(out, r.Inset(min(r.Dx(), r.Dy())/4), a.ZoneColors[i])
+			outlineRect(out, r, color.RGBA{255, 255, 255, 255})
+		}
+	}
+
+	palette := image.Rect(0, height, swatchWidth, height+swatchPaletteSize)
+	chosen := image.Rect(0, height, swatchWidth/4, palette.Max.Y)
+	fillRect(out, chosen, a.Color)
+	drawLabel(out, chosen, a.Extractor)
+	// A black gap keeps the chosen color apart from an equal first entry
+	x := chosen.Max.X + 4
+	var total float64
+	for _, c := range a.Top {
+		total += c.Percent
+	}
+	for i, c := range a.Top {
+		w := int(c.Percent / total * float64(palette.Max.X-chosen.Max.X-4))
+		if i == len(a.Top)-1 {
+			w = palette.Max.X - x
+		}
+		r := image.Rect(x, height, x+w, palette.Max.Y)
+		fillRect(out, r, RGB{c.R, c.G, c.B})
+		drawLabel(out, r, fmt.Sprintf("%.0f%%", c.Percent))
+		x += w
+	}
+	return out
+}
+
+func fillRect(img *image.RGBA, r image.Rectangle, c RGB) {
+	draw.Draw(img, r, image.NewUniform(color.RGBA{c.R, c.G, c.B, 255}), image.Point{}, draw.Src)
+}
+
+func outlineRect(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	for x := r.Min.X; x < r.Max.X; x++ {
+		img.SetRGBA(x, r.Min.Y, c)
+		img.SetRGBA(x, r.Max.Y-1, c)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		img.SetRGBA(r.Min.X, y, c)
+		img.SetRGBA(r.Max.X-1, y, c)
+	}
+}
+
+// drawLabel writes text at the bottom left of r in black or white, whichever
+// reads better on the color there, if it fits
+func drawLabel(img *image.RGBA, r image.Rectangle, text string) {
+	face := basicfont.Face7x13
+	if font.MeasureString(face, text).Ceil()+8 > r.Dx() {
+		return
+	}
+	bg := img.RGBAAt(r.Min.X, r.Max.Y-1)
+	ink := image.White
+	if luma709(RGB{bg.R, bg.G, bg.B}) > 0.55 {
+		ink = image.Black
+	}
+	d := font.Drawer{Dst: img, Src: ink, Face: face, Dot: fixed.P(r.Min.X+4, r.Max.Y-6)}
+	d.DrawString(text)
+}
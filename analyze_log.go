@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Entries further apart than this belong to separate sync runs. The time in
+// between does not count for the statistics and is shortened to this on
+// timelines and replay.
+const logGap = 5 * time.Second
+
+// Hue ranges for the time-per-hue statistics, by upper bound in degrees.
+// Colors with little saturation count as gray.
+var hueRanges = []struct {
+	name string
+	max  float64
+}{
+	{"red", 15}, {"orange", 45}, {"yellow", 70}, {"green", 160}, {"cyan", 200},
+	{"blue", 260}, {"purple", 300}, {"pink", 345}, {"red", 360},
+}
+
+const grayMaxSaturation = 0.15
+
+// logSample is the color of one log entry and how long it was shown
+type logSample struct {
+	Time     time.Time
+	Color    RGB
+	Duration time.Duration
+}
+
+// runAnalyzeLog implements the analyze-log command
+func runAnalyzeLog(configPath string, args []string) error {
+	fs := flag.NewFlagSet("analyze-log", flag.ContinueOnError)
+	csvPath := fs.String("csv", "", "write every entry's top colors to this CSV file")
+	timelinePath := fs.String("timeline", "", "render the colors over time to this .html or .png file")
+	width := fs.Int("width", 1200, "width of a PNG timeline in pixels")
+	replay := fs.Bool("replay", false, "send the logged colors to the configured light")
+	speed := fs.Float64("speed", 1, "replay speed, 2 plays twice as fast")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [-config file] analyze-log [flags] [log files]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Reads COLOR_LOG.PATH and its rotated files unless log files are given.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *speed <= 0 {
+		return fmt.Errorf("-speed must be positive, got %v", *speed)
+	}
+	timelineExt := strings.ToLower(filepath.Ext(*timelinePath))
+	if *timelinePath != "" && timelineExt != ".html" && timelineExt != ".png" {
+		return fmt.Errorf("-timeline must end in .html or .png, got %q", *timelinePath)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		if *replay || !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		def := defaultConfig()
+		cfg = &def
+	}
+	appConfig = cfg
+	logger = zap.NewNop().Sugar()
+	if *replay {
+		setupLogger()
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = colorLogFiles(cfg.Env.COLOR_LOG)
+	}
+	entries, err := readColorLogs(paths)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no entries in %s", strings.Join(paths, ", "))
+	}
+	samples := colorLogSamples(entries)
+	printLogStats(os.Stdout, computeLogStats(samples))
+
+	if *csvPath != "" {
+		if err := writeFile(*csvPath, func(w io.Writer) error { return writeLogCSV(w, entries) }); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", *csvPath)
+	}
+	if *timelinePath != "" {
+		err := writeFile(*timelinePath, func(w io.Writer) error {
+			if timelineExt == ".png" {
+				return png.Encode(w, renderTimelinePNG(samples, *width, 60))
+			}
+			return writeTimelineHTML(w, samples)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", *timelinePath)
+	}
+	if *replay {
+		return replayToLight(cfg, samples, *speed)
+	}
+	return nil
+}
+
+// colorLogFiles lists the color log and its rotated files, oldest first
+func colorLogFiles(cfg ColorLogConfig) []string {
+	var paths []string
+	for i := cfg.MAX_FILES; i >= 1; i-- {
+		if _, err := os.Stat(rotatedLogPath(cfg.PATH, i)); err == nil {
+			paths = append(paths, rotatedLogPath(cfg.PATH, i))
+		}
+	}
+	return append(paths, cfg.PATH)
+}
+
+// readColorLogs reads NDJSON logs, or the old JSON array format, and sorts
+// the entries by time. Lines that cannot be decoded are skipped.
+func readColorLogs(paths []string) ([]LogEntry, error) {
+	var entries []LogEntry
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+			var array []LogEntry
+			if err := json.Unmarshal(trimmed, &array); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			entries = append(entries, array...)
+			continue
+		}
+		skipped := 0
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var e LogEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				skipped++
+				continue
+			}
+			entries = append(entries, e)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if skipped > 0 {
+			fmt.Fprintf(os.Stderr, "Skipped %d invalid lines in %s\n", skipped, path)
+		}
+	}
+	sortLogEntries(entries)
+	return entries, nil
+}
+
+// sortLogEntries sorts entries by time. Timestamps carry their UTC offset,
+// which changes with DST, so they are compared as times, not as strings.
+// Entries without a valid timestamp go first.
+func sortLogEntries(entries []LogEntry) {
+	type timedEntry struct {
+		at    time.Time
+		entry LogEntry
+	}
+	timed := make([]timedEntry, len(entries))
+	for i, e := range entries {
+		at, _ := time.Parse(time.RFC3339, e.Timestamp)
+		timed[i] = timedEntry{at, e}
+	}
+	slices.SortStableFunc(timed, func(a, b timedEntry) int { return a.at.Compare(b.at) })
+	for i := range timed {
+		entries[i] = timed[i].entry
+	}
+}
+
+// entryColor is the most frequent color of an entry that is not black or
+// white, like the histogram extractor picks it
+func entryColor(e LogEntry) (RGB, bool) {
+	if len(e.TopColors) == 0 {
+		return RGB{}, false
+	}
+	for _, s := range e.TopColors {
+		if c := (RGB{s.R, s.G, s.B}); !isBlackOrWhite(c) {
+			return c, true
+		}
+	}
+	s := e.TopColors[0]
+	return RGB{s.R, s.G, s.B}, true
+}
+
+// colorLogSamples turns entries into samples that last until the next entry,
+// at most logGap. The last sample of a run lasts as long as the one before.
+func colorLogSamples(entries []LogEntry) []logSample {
+	var samples []logSample
+	for _, e := range entries {
+		t, err := time.Parse(time.RFC3339, e.Timestamp)
+		c, ok := entryColor(e)
+		if err != nil || !ok {
+			continue
+		}
+		samples = append(samples, logSample{Time: t, Color: c})
+	}
+	for i := range samples {
+		switch {
+		case i+1 < len(samples) && samples[i+1].Time.Sub(samples[i].Time) <= logGap:
+			samples[i].Duration = samples[i+1].Time.Sub(samples[i].Time)
+		case i > 0 && samples[i].Time.Sub(samples[i-1].Time) <= logGap:
+			samples[i].Duration = samples[i-1].Duration
+		}
+	}
+	return samples
+}
+
+// hueName groups a color into one of the hueRanges, or gray
+func hueName(c RGB) string {
+	h, s, _ := rgbToHSL(c)
+	if s < grayMaxSaturation || isBlackOrWhite(c) {
+		return "gray"
+	}
+	for _, r := range hueRanges {
+		if h < r.max {
+			return r.name
+		}
+	}
+	return "red"
+}
+
+type logShare struct {
+	Name     string
+	Duration time.Duration
+	Percent  float64
+}
+
+type logStats struct {
+	Entries int
+	Start   time.Time
+	End     time.Time
+	Active  time.Duration
+	// Changes counts entries whose color name differs from the one before
+	Changes int
+	Names   []logShare
+	Hues    []logShare
+}
+
+func (s logStats) ChangesPerMinute() float64 {
+	if s.Active <= 0 {
+		return 0
+	}
+	return float64(s.Changes) / s.Active.Minutes()
+}
+
+func computeLogStats(samples []logSample) logStats {
+	stats := logStats{Entries: len(samples)}
+	if len(samples) == 0 {
+		return stats
+	}
+	stats.Start, stats.End = samples[0].Time, samples[len(samples)-1].Time
+	names := make(map[string]time.Duration)
+	hues := make(map[string]time.Duration)
+	for i, s := range samples {
+		name := colorName(s.Color)
+		names[name] += s.Duration
+		hues[hueName(s.Color)] += s.Duration
+		stats.Active += s.Duration
+		if i > 0 && name != colorName(samples[i-1].Color) {
+			stats.Changes++
+		}
+	}
+	stats.Names = logShares(names, stats.Active)
+	stats.Hues = logShares(hues, stats.Active)
+	return stats
+}
+
+// logShares sorts durations by size and adds their share of total
+func logShares(durations map[string]time.Duration, total time.Duration) []logShare {
+	var shares []logShare
+	for name, d := range durations {
+		share := logShare{Name: name, Duration: d}
+		if total > 0 {
+			share.Percent = float64(d) / float64(total) * 100
+		}
+		shares = append(shares, share)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].Duration != shares[j].Duration {
+			return shares[i].Duration > shares[j].Duration
+		}
+		return shares[i].Name < shares[j].Name
+	})
+	return shares
+}
+
+func printLogStats(w io.Writer, s logStats) {
+	fmt.Fprintf(w, "Entries:           %d\n", s.Entries)
+	if s.Entries == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Period:            %s - %s\n", s.Start.Format(time.DateTime), s.End.Format(time.DateTime))
+	fmt.Fprintf(w, "Synced time:       %s\n", s.Active.Round(time.Second))
+	fmt.Fprintf(w, "Color changes:     %d (%.1f per minute)\n", s.Changes, s.ChangesPerMinute())
+	fmt.Fprintf(w, "\nTime per color name:\n")
+	for _, n := range s.Names {
+		fmt.Fprintf(w, "  %-16s %5.1f%%  %s\n", n.Name, n.Percent, n.Duration.Round(time.Second))
+	}
+	fmt.Fprintf(w, "\nTime per hue:\n")
+	for _, h := range s.Hues {
+		fmt.Fprintf(w, "  %-16s %5.1f%%  %s\n", h.Name, h.Percent, h.Duration.Round(time.Second))
+	}
+}
+
+// writeLogCSV writes one row per entry and top color
+func writeLogCSV(w io.Writer, entries []LogEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"timestamp", "screen_size", "rank", "r", "g", "b", "hex", "name", "percent"})
+	for _, e := range entries {
+		for i, c := range e.TopColors {
+			cw.Write([]string{
+				e.Timestamp, e.ScreenSize, strconv.Itoa(i + 1),
+				strconv.Itoa(int(c.R)), strconv.Itoa(int(c.G)), strconv.Itoa(int(c.B)),
+				fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B), c.Name,
+				strconv.FormatFloat(c.Percent, 'f', 2, 64),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// renderTimelinePNG draws the colors as a strip, left to right over the
+// synced time
+func renderTimelinePNG(samples []logSample, width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	var total time.Duration
+	for _, s := range samples {
+		total += s.Duration
+	}
+	if total == 0 {
+		return img
+	}
+	var offset time.Duration
+	for _, s := range samples {
+		x0 := int(int64(width) * int64(offset) / int64(total))
+		offset += s.Duration
+		x1 := int(int64(width) * int64(offset) / int64(total))
+		c := color.RGBA{s.Color.R, s.Color.G, s.Color.B, 255}
+		for x := x0; x < x1; x++ {
+			for y := 0; y < height; y++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+	return img
+}
+
+// timelineSegment is a run of samples with the same color
+type timelineSegment struct {
+	Start   string
+	Hex     string
+	Name    string
+	Percent float64
+}
+
+var timelineTemplate = template.Must(template.New("timeline").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>LED Screen Sync color timeline</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.strip { display: flex; height: 80px; border: 1px solid #888; }
+.strip div { height: 100%; }
+.axis { display: flex; justify-content: space-between; color: #555; }
+</style>
+</head>
+<body>
+<h1>Color timeline</h1>
+<div class="strip">{{range .Segments}}<div style="background: {{.Hex}}; width: {{printf "%.4f" .Percent}}%" title="{{.Start}} {{.Name}} {{.Hex}}"></div>{{end}}</div>
+<div class="axis"><span>{{.Start}}</span><span>{{.End}}</span></div>
+</body>
+</html>
+`))
+
+// writeTimelineHTML writes a page with the colors as a strip; hovering a
+// segment shows its time and color
+func writeTimelineHTML(w io.Writer, samples []logSample) error {
+	var total time.Duration
+	for _, s := range samples {
+		total += s.Duration
+	}
+	var segments []timelineSegment
+	var prev RGB
+	for i, s := range samples {
+		if total == 0 || s.Duration == 0 {
+			continue
+		}
+		percent := float64(s.Duration) / float64(total) * 100
+		if i > 0 && s.Color == prev && len(segments) > 0 {
+			segments[len(segments)-1].Percent += percent
+			continue
+		}
+		prev = s.Color
+		segments = append(segments, timelineSegment{
+			Start:   s.Time.Format(time.TimeOnly),
+			Hex:     fmt.Sprintf("#%02x%02x%02x", s.Color.R, s.Color.G, s.Color.B),
+			Name:    colorName(s.Color),
+			Percent: percent,
+		})
+	}
+	data := struct {
+		Start, End string
+		Segments   []timelineSegment
+	}{Segments: segments}
+	if len(samples) > 0 {
+		data.Start = samples[0].Time.Format(time.DateTime)
+		data.End = samples[len(samples)-1].Time.Format(time.DateTime)
+	}
+	return timelineTemplate.Execute(w, data)
+}
+
+// replayToLight sends the samples to the configured light until they end or
+// a signal arrives, then applies ON_STOP
+func replayToLight(cfg *Config, samples []logSample, speed float64) error {
+	out, err := newLightOutput(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create light output: %w", err)
+	}
+	defer out.Close()
+	original, err := out.GetState()
+	if err != nil {
+		logger.Warnf("Failed to read the LED state, it will not be restored: %v", err)
+	}
+	stop := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	go func() {
+		if _, ok := <-sigChan; ok {
+			close(stop)
+		}
+	}()
+	logger.Infof("Replaying %d colors to %s at %gx speed", len(samples), out.Name(), speed)
+	err = replayColorLog(samples, out, speed, cfg.Env.BRIGHTNESS.MAX, stop)
+	applyOnStop(out, cfg.Env.ON_STOP, original)
+	return err
+}
+
+// replayColorLog sends the samples to out with their original timing divided
+// by speed. Pauses between sync runs are shortened to logGap.
+func replayColorLog(samples []logSample, out LightOutput, speed float64, brightness int, stop <-chan struct{}) error {
+	var prev *RGB
+	for i, s := range samples {
+		if i > 0 {
+			gap := min(s.Time.Sub(samples[i-1].Time), logGap)
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(time.Duration(float64(gap) / speed)):
+			}
+		}
+		if prev != nil && *prev == s.Color {
+			continue
+		}
+		if err := out.SetColor(s.Color, brightness); err != nil {
+			logger.Warnf("Failed to set color %v: %v", s.Color, err)
+			continue
+		}
+		c := s.Color
+		prev = &c
+	}
+	return nil
+}
+
+// writeFile creates path and writes it with fn
+func writeFile(path string, fn func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return f.Close()
+}
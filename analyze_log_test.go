@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeColorLog writes one entry per color, interval apart
+func writeColorLog(t *testing.T, path string, start time.Time, interval time.Duration, colors []RGB) {
+	t.Helper()
+	var buf bytes.Buffer
+	for i, c := range colors {
+		e := newLogEntry(start.Add(time.Duration(i)*interval), image4x2, []struct {
+			Color RGB
+			Count int
+		}{{RGB{0, 0, 0}, 4}, {c, 4}}, 8)
+		line, _ := json.Marshal(e)
+		buf.Write(append(line, '\n'))
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func repeatColor(c RGB, n int) []RGB {
+	colors := make([]RGB, n)
+	for i := range colors {
+		colors[i] = c
+	}
+	return colors
+}
+
+var (
+	image4x2 = image.Rect(0, 0, 4, 2)
+	logRed   = RGB{224, 32, 32}
+	logBlue  = RGB{32, 32, 224}
+	logGray  = RGB{128, 128, 128}
+	logStart = time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+)
+
+func TestComputeLogStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "colorlog.ndjson")
+	colors := append(append(repeatColor(logRed, 30), repeatColor(logBlue, 20)...), repeatColor(logGray, 10)...)
+	writeColorLog(t, path, logStart, 100*time.Millisecond, colors)
+	// An earlier run in a rotated file, the hour in between must not count
+	rotated := rotatedLogPath(path, 1)
+	writeColorLog(t, rotated, logStart.Add(-time.Hour), 100*time.Millisecond, repeatColor(logRed, 20))
+
+	entries, err := readColorLogs([]string{path, rotated})
+	if err != nil {
+		t.Fatalf("readColorLogs failed: %v", err)
+	}
+	if len(entries) != 80 || entries[0].Timestamp >= entries[79].Timestamp {
+		t.Fatalf("expected 80 entries sorted by time, got %d", len(entries))
+	}
+	// Black is skipped in favor of the logged color
+	stats := computeLogStats(colorLogSamples(entries))
+	if stats.Active != 8*time.Second {
+		t.Errorf("expected 8s of synced time, got %s", stats.Active)
+	}
+	if stats.Changes != 2 {
+		t.Errorf("expected 2 changes (red to blue, blue to gray), got %d", stats.Changes)
+	}
+	if got := stats.ChangesPerMinute(); got != 15 {
+		t.Errorf("expected 15 changes per minute, got %v", got)
+	}
+	want := map[string]float64{"red": 62.5, "blue": 25, "gray": 12.5}
+	for _, h := range stats.Hues {
+		if h.Percent != want[h.Name] {
+			t.Errorf("hue %s: expected %v%%, got %v%%", h.Name, want[h.Name], h.Percent)
+		}
+	}
+	if len(stats.Hues) != 3 || stats.Hues[0].Name != "red" {
+		t.Errorf("expected hues sorted by time, got %+v", stats.Hues)
+	}
+	if stats.Names[0].Name != colorName(logRed) {
+		t.Errorf("expected %s to lead the names, got %+v", colorName(logRed), stats.Names)
+	}
+}
+
+func TestReadColorLogs_LegacyArray(t *testing.T) {
+	path := filepath.Join(t.TempDir(), legacyColorLogPath)
+	data, _ := json.MarshalIndent([]LogEntry{testLogEntry(logStart), testLogEntry(logStart.Add(time.Second))}, "", "  ")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readColorLogs([]string{path})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d, %v", len(entries), err)
+	}
+}
+
+func TestSortLogEntries(t *testing.T) {
+	entries := []LogEntry{
+		{Timestamp: "2026-10-25T02:30:00.000+02:00"}, // 00:30 UTC, before the clocks go back
+		{Timestamp: "2026-10-25T02:10:00.000+01:00"}, // 01:10 UTC, after
+		{Timestamp: "2026-10-25T01:00:00.500Z"},
+		{Timestamp: "2026-10-25T01:00:00Z"},
+	}
+	sortLogEntries(entries)
+	want := []string{
+		"2026-10-25T02:30:00.000+02:00",
+		"2026-10-25T01:00:00Z",
+		"2026-10-25T01:00:00.500Z",
+		"2026-10-25T02:10:00.000+01:00",
+	}
+	for i, e := range entries {
+		if e.Timestamp != want[i] {
+			t.Fatalf("expected %v, got %v", want, entries)
+		}
+	}
+}
+
+func TestWriteLogCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeLogCSV(&buf, []LogEntry{testLogEntry(logStart)}); err != nil {
+		t.Fatalf("writeLogCSV failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || lines[1] != "2026-10-16T20:00:00.000Z,4x2,1,255,0,0,#ff0000,light red,75.00" {
+		t.Errorf("unexpected CSV:\n%s", buf.String())
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	samples := colorLogSamples([]LogEntry{
+		testLogEntryColor(logStart, logRed),
+		testLogEntryColor(logStart.Add(3*time.Second), logBlue),
+		testLogEntryColor(logStart.Add(4*time.Second), logBlue),
+	})
+	img := renderTimelinePNG(samples, 100, 10)
+	for x, want := range map[int]RGB{0: logRed, 59: logRed, 61: logBlue, 99: logBlue} {
+		if c := img.RGBAAt(x, 5); (RGB{c.R, c.G, c.B}) != want {
+			t.Errorf("x=%d: expected %v, got %v", x, want, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeTimelineHTML(&buf, samples); err != nil {
+		t.Fatalf("writeTimelineHTML failed: %v", err)
+	}
+	html := buf.String()
+	if strings.Count(html, "background: #") != 2 || !strings.Contains(html, "background: #e02020; width: 60.0000%") {
+		t.Errorf("expected two merged segments, got:\n%s", html)
+	}
+}
+
+func testLogEntryColor(now time.Time, c RGB) LogEntry {
+	return newLogEntry(now, image4x2, []struct {
+		Color RGB
+		Count int
+	}{{c, 8}}, 8)
+}
+
+func TestReplayColorLog(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	samples := colorLogSamples([]LogEntry{
+		testLogEntryColor(logStart, logRed),
+		testLogEntryColor(logStart.Add(time.Second), logRed),
+		testLogEntryColor(logStart.Add(2*time.Second), logBlue),
+		// After an hour long pause, shortened to logGap
+		testLogEntryColor(logStart.Add(time.Hour), logGray),
+	})
+	out := &recordingOutput{}
+	begin := time.Now()
+	if err := replayColorLog(samples, out, 100, 200, nil); err != nil {
+		t.Fatalf("replayColorLog failed: %v", err)
+	}
+	// 1s + 1s + 5s at 100x
+	if elapsed := time.Since(begin); elapsed < 70*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected the replay to take about 70ms, took %s", elapsed)
+	}
+	want := []string{"color 224,32,32@200", "color 32,32,224@200", "color 128,128,128@200"}
+	if strings.Join(out.calls, ";") != strings.Join(want, ";") {
+		t.Errorf("expected %v, got %v", want, out.calls)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	out = &recordingOutput{}
+	replayColorLog(samples, out, 1, 200, stop)
+	if len(out.calls) != 1 {
+		t.Errorf("expected a stopped replay to end after the first color, got %v", out.calls)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// letterboxedFrame is 1000x500 with 100px black bars, red on the left 60%
+// of the picture and blue on the right
+func letterboxedFrame() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+	for y := 0; y < 500; y++ {
+		for x := 0; x < 1000; x++ {
+			c := color.RGBA{0, 0, 0, 255}
+			switch {
+			case y < 100 || y >= 400:
+			case x < 600:
+				c = color.RGBA{224, 32, 32, 255}
+			default:
+				c = color.RGBA{32, 32, 224, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestAnalyzeFrame(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Env.LETTERBOX.ENABLED = true
+	cfg.Env.COLOR_EXTRACTOR = "mean"
+	cfg.Env.ZONES = ZonesConfig{TOP: 2, RIGHT: 1, BOTTOM: 2, LEFT: 1, START: "top-left", DIRECTION: "clockwise", DEPTH_PERCENT: 10}
+
+	a, err := analyzeFrame(letterboxedFrame(), &cfg, 3, true)
+	if err != nil {
+		t.Fatalf("analyzeFrame failed: %v", err)
+	}
+	// Downscale blurs the edge of the bars a little
+	if a.Crop == nil || a.Crop.Top < 15 || a.Crop.Top != a.Crop.Bottom {
+		t.Errorf("expected the bars to be cropped, got %v", a.Crop)
+	}
+	if a.Histogram != (RGB{224, 32, 32}) {
+		t.Errorf("expected red as the most frequent color, got %v", a.Histogram)
+	}
+	if a.Extractor != "mean" || a.Color.R <= a.Color.B {
+		t.Errorf("expected the mean of mostly red, got %s %v", a.Extractor, a.Color)
+	}
+	if len(a.Top) != 3 || a.Top[0].Name != "light red" || a.Top[1].Name != "light blue" || a.Top[0].Percent <= a.Top[1].Percent {
+		t.Errorf("unexpected palette %+v", a.Top)
+	}
+	// Clockwise from the top left: top, top, right, bottom, bottom, left
+	if len(a.ZoneColors) != 6 {
+		t.Fatalf("expected 6 zones, got %v", a.ZoneColors)
+	}
+	for i, red := range []bool{true, false, false, false, true, true} {
+		if c := a.ZoneColors[i]; (c.R > c.B) != red {
+			t.Errorf("zone %d: expected red %v, got %v", i, red, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	printFrameAnalysis(&buf, "frame.png", a)
+	for _, want := range []string{"frame.png (1000x500, analyzed at 100x", "Histogram:    #e02020", "mean:", "light blue", "Zones (6, in LED order)"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %q in the output:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRenderSwatch(t *testing.T) {
+	cfg := defaultConfig()
+	a, err := analyzeFrame(letterboxedFrame(), &cfg, 10, false)
+	if err != nil {
+		t.Fatalf("analyzeFrame failed: %v", err)
+	}
+	img := renderSwatch(letterboxedFrame(), a)
+	if b := img.Bounds(); b.Dx() != swatchWidth || b.Dy() != swatchWidth/2+swatchPaletteSize {
+		t.Fatalf("unexpected swatch size %v", b)
+	}
+	// The chosen color sits at the bottom left of the palette
+	if c := img.RGBAAt(10, swatchWidth/2+10); (RGB{c.R, c.G, c.B}) != a.Color {
+		t.Errorf("expected the chosen color %v, got %v", a.Color, c)
+	}
+}
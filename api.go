@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiResponse is returned by every control endpoint that changes state
+type apiResponse struct {
+	OK     bool       `json:"ok"`
+	Error  string     `json:"error,omitempty"`
+	Status SyncStatus `json:"status"`
+}
+
+// newAPIHandler builds the local control API. Every request must send token
+// as "Authorization: Bearer <token>".
+func newAPIHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, getStatus())
+	})
+	mux.HandleFunc("POST /api/start", func(w http.ResponseWriter, r *http.Request) {
+		startSync()
+		writeAPIResult(w, nil)
+	})
+	mux.HandleFunc("POST /api/stop", func(w http.ResponseWriter, r *http.Request) {
+		stopSync()
+		writeAPIResult(w, nil)
+	})
+	mux.HandleFunc("POST /api/led/on", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIResult(w, setLEDOnOff(lightOutput, true))
+	})
+	mux.HandleFunc("POST /api/led/off", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIResult(w, setLEDOnOff(lightOutput, false))
+	})
+	mux.HandleFunc("POST /api/mode", func(w http.ResponseWriter, r *http.Request) {
+		// Accept ?mode=zones or a JSON body {"mode": "zones"}
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			var body struct {
+				Mode string `json:"mode"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSON(w, http.StatusBadRequest, apiResponse{Error: "expected ?mode= or a JSON body with \"mode\"", Status: getStatus()})
+				return
+			}
+			mode = body.Mode
+		}
+		if err := setSyncMode(strings.ToLower(mode)); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiResponse{Error: err.Error(), Status: getStatus()})
+			return
+		}
+		writeAPIResult(w, nil)
+	})
+	mux.HandleFunc("POST /api/profile", func(w http.ResponseWriter, r *http.Request) {
+		// Accept ?name=movie or a JSON body {"name": "movie"}, an empty name
+		// selects the default SMOOTHING settings
+		name := r.URL.Query().Get("name")
+		if !r.URL.Query().Has("name") {
+			var body struct {
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSON(w, http.StatusBadRequest, apiResponse{Error: "expected ?name= or a JSON body with \"name\"", Status: getStatus()})
+				return
+			}
+			name = body.Name
+		}
+		if err := setProfile(name); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiResponse{Error: err.Error(), Status: getStatus()})
+			return
+		}
+		writeAPIResult(w, nil)
+	})
+	return requireBearerToken(token, mux)
+}
+
+// requireBearerToken rejects requests without the configured bearer token. An
+// empty token rejects every request.
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAPIResult reports the outcome of a control call along with the new status
+func writeAPIResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, apiResponse{Error: err.Error(), Status: getStatus()})
+		return
+	}
+	writeJSON(w, http.StatusOK, apiResponse{OK: true, Status: getStatus()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// startAPIServer starts the control API in the background. It returns once
+// the listener is bound so address errors surface at startup.
+func startAPIServer(cfg APIConfig) (*http.Server, error) {
+	ln, err := net.Listen("tcp", cfg.LISTEN)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Handler:           newAPIHandler(cfg.TOKEN),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("Control API stopped: %v", err)
+		}
+	}()
+	logger.Infof("Control API listening on http://%s", ln.Addr())
+	return srv, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// bearerTransport adds the API token to every request
+type bearerTransport struct{ token string }
+
+func (b bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+b.token)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// setupAPITest serves the API with the token "secret" and returns a client
+// that sends it
+func setupAPITest(t *testing.T) (*httptest.Server, *http.Client, *recordingOutput) {
+	t.Helper()
+	logger = zap.NewNop().Sugar()
+	appConfig = &Config{}
+	appConfig.Env.ZONES = ZonesConfig{TOP: 4}
+	out := &recordingOutput{}
+	lightOutput = out
+	syncMode = ModeSingle
+	srv := httptest.NewServer(newAPIHandler("secret"))
+	t.Cleanup(srv.Close)
+	return srv, &http.Client{Transport: bearerTransport{"secret"}}, out
+}
+
+func TestAPI_Auth(t *testing.T) {
+	srv, client, _ := setupAPITest(t)
+
+	resp, err := http.Get(srv.URL + "/api/status")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", resp.StatusCode)
+	}
+
+	// The token alone, without the Bearer scheme, is not accepted
+	req, _ := http.NewRequest("GET", srv.URL+"/api/status", nil)
+	req.Header.Set("Authorization", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the Bearer prefix, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.Get(srv.URL + "/api/status")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 with token, got %d", resp.StatusCode)
+	}
+	var status SyncStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("invalid status JSON: %v", err)
+	}
+	if status.Running || status.Mode != ModeSingle || status.Output != "recording" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// An empty token must not open the API, e.g. to a form POST from a web page
+	open := httptest.NewServer(newAPIHandler(""))
+	defer open.Close()
+	resp, err = http.Post(open.URL+"/api/start", "application/x-www-form-urlencoded", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || getStatus().Running {
+		t.Errorf("expected 401 with an empty token, got %d", resp.StatusCode)
+	}
+}
+
+func TestAPI_LEDAndMode(t *testing.T) {
+	srv, client, out := setupAPITest(t)
+
+	resp, err := client.Post(srv.URL+"/api/led/off", "", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(out.calls) != 1 || out.calls[0] != "power false" {
+		t.Errorf("expected LED off, status %d, calls %v", resp.StatusCode, out.calls)
+	}
+
+	resp, err = client.Post(srv.URL+"/api/mode", "application/json", strings.NewReader(`{"mode":"zones"}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || getSyncMode() != ModeZones {
+		t.Errorf("expected zones mode, status %d, mode %s", resp.StatusCode, getSyncMode())
+	}
+
+	resp, err = client.Post(srv.URL+"/api/mode?mode=rainbow", "", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || getSyncMode() != ModeZones {
+		t.Errorf("expected unknown mode to be rejected, status %d, mode %s", resp.StatusCode, getSyncMode())
+	}
+
+	resp, err = client.Get(srv.URL + "/api/start")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET /api/start to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestAPI_Profile(t *testing.T) {
+	srv, client, _ := setupAPITest(t)
+	appConfig.Env.PROFILES = map[string]SmoothingConfig{"movie": {ALPHA: 0.2}}
+	t.Cleanup(func() { syncProfile = "" })
+
+	resp, err := client.Post(srv.URL+"/api/profile", "application/json", strings.NewReader(`{"name":"movie"}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || getProfile() != "movie" {
+		t.Errorf("expected movie profile, status %d, profile %q", resp.StatusCode, getProfile())
+	}
+
+	resp, err = client.Post(srv.URL+"/api/profile?name=disco", "", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || getProfile() != "movie" {
+		t.Errorf("expected unknown profile to be rejected, status %d, profile %q", resp.StatusCode, getProfile())
+	}
+
+	resp, err = client.Post(srv.URL+"/api/profile?name=", "", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || getProfile() != "" {
+		t.Errorf("expected default smoothing, status %d, profile %q", resp.StatusCode, getProfile())
+	}
+}
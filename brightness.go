@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+)
+
+// Brightness modes (BRIGHTNESS.MODE)
+const (
+	BrightnessFixed      = "fixed"      // always BRIGHTNESS.MAX
+	BrightnessAverage    = "average"    // mean luma of the frame
+	BrightnessPercentile = "percentile" // luma at BRIGHTNESS.PERCENTILE, ignores small bright spots
+)
+
+// BrightnessConfig tunes the brightness stage. It runs next to color
+// extraction, so brightness follows the scene while color selection can be
+// tuned on its own.
+type BrightnessConfig struct {
+	MODE             string  `yaml:"MODE"`             // fixed (default), average or percentile
+	PERCENTILE       float64 `yaml:"PERCENTILE"`       // 0-100 for the percentile mode (default 90)
+	MIN              int     `yaml:"MIN"`              // brightness floor, 1-255 (default 1)
+	MAX              int     `yaml:"MAX"`              // brightness ceiling, 0-255 (default 255)
+	GAMMA            float64 `yaml:"GAMMA"`            // curve exponent, <1 lifts dark scenes, >1 deepens them (default 1)
+	CHANGE_THRESHOLD int     `yaml:"CHANGE_THRESHOLD"` // brightness change that triggers an update on its own (default 8)
+}
+
+func (b BrightnessConfig) validate() error {
+	switch b.MODE {
+	case BrightnessFixed, BrightnessAverage, BrightnessPercentile:
+	default:
+		return fmt.Errorf("unknown BRIGHTNESS.MODE %q, use fixed, average or percentile", b.MODE)
+	}
+	if b.PERCENTILE < 0 || b.PERCENTILE > 100 {
+		return fmt.Errorf("BRIGHTNESS.PERCENTILE must be between 0 and 100, got %v", b.PERCENTILE)
+	}
+	// Home Assistant, WLED and MQTT lights treat a brightness of 0 as off,
+	// so a dark scene would switch the light off and on again
+	if b.MIN < 1 || b.MAX > 255 || b.MIN > b.MAX {
+		return fmt.Errorf("BRIGHTNESS.MIN and MAX must satisfy 1 <= MIN <= MAX <= 255, got %d and %d", b.MIN, b.MAX)
+	}
+	if b.GAMMA <= 0 {
+		return fmt.Errorf("BRIGHTNESS.GAMMA must be positive, got %v", b.GAMMA)
+	}
+	if b.CHANGE_THRESHOLD < 0 {
+		return fmt.Errorf("BRIGHTNESS.CHANGE_THRESHOLD must not be negative, got %d", b.CHANGE_THRESHOLD)
+	}
+	return nil
+}
+
+// luma709 returns the Rec.709 luma (0-1) of a gamma encoded sRGB color
+func luma709(c RGB) float64 {
+	return (0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)) / 255
+}
+
+// sceneLuma measures the luma (0-1) of a frame. Unlike color extraction it
+// counts every pixel, dark ones included, since they are what makes a
+// scene dark. Pixels count by their region weight.
+func sceneLuma(img image.Image, mode string, percentile float64) float64 {
+	type sample struct{ luma, weight float64 }
+	bounds := img.Bounds()
+	samples := make([]sample, 0, bounds.Dx()*bounds.Dy())
+	total := 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c, w := pixelWeight(img, x, y)
+			if w > 0 {
+				samples = append(samples, sample{luma709(c), w})
+				total += w
+			}
+		}
+	}
+	if len(samples) == 0 {
+		return 0
+	}
+	if mode == BrightnessPercentile {
+		sort.Slice(samples, func(i, j int) bool { return samples[i].luma < samples[j].luma })
+		// With equal weights this picks sample round(p/100*(n-1))
+		target := percentile/100*(total-1) + 0.5
+		cum := 0.0
+		for _, s := range samples {
+			if cum+s.weight > target {
+				return s.luma
+			}
+			cum += s.weight
+		}
+		return samples[len(samples)-1].luma
+	}
+	sum := 0.0
+	for _, s := range samples {
+		sum += s.luma * s.weight
+	}
+	return sum / total
+}
+
+// sceneBrightness maps the luma of a frame to a 0-255 light brightness
+// through the configured curve, MIN and MAX
+func sceneBrightness(img image.Image, cfg BrightnessConfig) int {
+	if cfg.MODE == BrightnessFixed || cfg.MODE == "" {
+		return cfg.MAX
+	}
+	return brightnessCurve(sceneLuma(img, cfg.MODE, cfg.PERCENTILE), cfg)
+}
+
+// brightnessCurve maps a luma of 0-1 to MIN-MAX
+func brightnessCurve(luma float64, cfg BrightnessConfig) int {
+	gamma := cfg.GAMMA
+	if gamma <= 0 {
+		gamma = 1
+	}
+	luma = math.Max(0, math.Min(1, luma))
+	return cfg.MIN + int(math.Round(float64(cfg.MAX-cfg.MIN)*math.Pow(luma, gamma)))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestLuma709(t *testing.T) {
+	if l := luma709(RGB{255, 255, 255}); math.Abs(l-1) > 1e-9 {
+		t.Errorf("expected 1 for white, got %v", l)
+	}
+	if l := luma709(RGB{0, 255, 0}); math.Abs(l-0.7152) > 1e-9 {
+		t.Errorf("expected the Rec.709 green weight, got %v", l)
+	}
+}
+
+// spotImage is a dark frame with a few white pixels
+func spotImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			img.Set(x, y, color.RGBA{20, 20, 20, 255})
+		}
+	}
+	for x := 0; x < 5; x++ {
+		img.Set(x, 0, color.RGBA{255, 255, 255, 255})
+	}
+	return img
+}
+
+func TestSceneLuma(t *testing.T) {
+	img := spotImage()
+	dark := 20.0 / 255
+	avg := sceneLuma(img, BrightnessAverage, 0)
+	if want := 0.95*dark + 0.05; math.Abs(avg-want) > 1e-9 {
+		t.Errorf("expected average %v, got %v", want, avg)
+	}
+	// The 90th percentile ignores the small bright spot, the 99th does not
+	if p := sceneLuma(img, BrightnessPercentile, 90); math.Abs(p-dark) > 1e-9 {
+		t.Errorf("expected the dark background at the 90th percentile, got %v", p)
+	}
+	if p := sceneLuma(img, BrightnessPercentile, 99); math.Abs(p-1) > 1e-9 {
+		t.Errorf("expected the bright spot at the 99th percentile, got %v", p)
+	}
+}
+
+func TestBrightnessCurve(t *testing.T) {
+	cfg := BrightnessConfig{MIN: 30, MAX: 230, GAMMA: 1}
+	if b := brightnessCurve(0, cfg); b != 30 {
+		t.Errorf("expected MIN for black, got %d", b)
+	}
+	if b := brightnessCurve(1, cfg); b != 230 {
+		t.Errorf("expected MAX for white, got %d", b)
+	}
+	if b := brightnessCurve(0.5, cfg); b != 130 {
+		t.Errorf("expected the middle for a linear curve, got %d", b)
+	}
+	cfg.GAMMA = 0.5
+	if b := brightnessCurve(0.25, cfg); b != 130 {
+		t.Errorf("expected gamma 0.5 to lift dark scenes, got %d", b)
+	}
+}
+
+func TestSceneBrightness_BlackFrameKeepsLightOn(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			img.Set(x, y, color.RGBA{0, 0, 0, 255})
+		}
+	}
+	cfg := defaultConfig().Env.BRIGHTNESS
+	for _, mode := range []string{BrightnessAverage, BrightnessPercentile} {
+		cfg.MODE = mode
+		if b := sceneBrightness(img, cfg); b < 1 {
+			t.Errorf("%s: expected the default MIN to keep the light on for a black frame, got %d", mode, b)
+		}
+	}
+	if err := (BrightnessConfig{MODE: BrightnessAverage, MIN: 0, MAX: 255, GAMMA: 1}).validate(); err == nil {
+		t.Error("expected MIN 0 to be rejected")
+	}
+}
+
+func TestSceneBrightness_Fixed(t *testing.T) {
+	cfg := BrightnessConfig{MODE: BrightnessFixed, MAX: 200, GAMMA: 1}
+	if b := sceneBrightness(spotImage(), cfg); b != 200 {
+		t.Errorf("expected MAX in fixed mode, got %d", b)
+	}
+	cfg.MODE = BrightnessAverage
+	if b := sceneBrightness(spotImage(), cfg); b >= 30 {
+		t.Errorf("expected a dark scene to dim the light, got %d", b)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Windows API constants (for ShellExecute only)
+const (
+	SW_SHOWNORMAL = 1
+)
+
+// Windows API functions (for ShellExecute only)
+var (
+	shell32       = syscall.NewLazyDLL("shell32.dll")
+	shellExecuteW = shell32.NewProc("ShellExecuteW")
+)
+
+// openBrowser opens url in the default browser using ShellExecute
+func openBrowser(url string) {
+	urlPtr, _ := syscall.UTF16PtrFromString(url)
+	openPtr, _ := syscall.UTF16PtrFromString("open")
+
+	shellExecuteW.Call(
+		0,
+		uintptr(unsafe.Pointer(openPtr)),
+		uintptr(unsafe.Pointer(urlPtr)),
+		0,
+		0,
+		uintptr(SW_SHOWNORMAL),
+	)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// legacyColorLogPath is where older versions wrote the color log as one JSON
+// array
+const legacyColorLogPath = "colorlog.json"
+
+// Timestamps of log entries, RFC 3339 with milliseconds
+const colorLogTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// ColorLogConfig controls the color log written with EXPORT_JSON
+type ColorLogConfig struct {
+	PATH          string  `yaml:"PATH"`          // NDJSON file, one entry per line (default colorlog.ndjson)
+	MAX_SIZE_MB   float64 `yaml:"MAX_SIZE_MB"`   // rotate when the file grows past this size (default 10)
+	MAX_AGE_HOURS float64 `yaml:"MAX_AGE_HOURS"` // rotate when the file is older, 0 = never (default 24)
+	MAX_FILES     int     `yaml:"MAX_FILES"`     // rotated files to keep as PATH.1 ... PATH.N (default 5)
+}
+
+func defaultColorLogConfig() ColorLogConfig {
+	return ColorLogConfig{PATH: "colorlog.ndjson", MAX_SIZE_MB: 10, MAX_AGE_HOURS: 24, MAX_FILES: 5}
+}
+
+func (c ColorLogConfig) validate() error {
+	if c.PATH == "" {
+		return fmt.Errorf("COLOR_LOG.PATH must not be empty")
+	}
+	if c.MAX_SIZE_MB <= 0 {
+		return fmt.Errorf("COLOR_LOG.MAX_SIZE_MB must be positive, got %v", c.MAX_SIZE_MB)
+	}
+	if c.MAX_AGE_HOURS < 0 {
+		return fmt.Errorf("COLOR_LOG.MAX_AGE_HOURS must not be negative, got %v", c.MAX_AGE_HOURS)
+	}
+	if c.MAX_FILES < 0 {
+		return fmt.Errorf("COLOR_LOG.MAX_FILES must not be negative, got %d", c.MAX_FILES)
+	}
+	return nil
+}
+
+type ColorStat struct {
+	R       uint8   `json:"r"`
+	G       uint8   `json:"g"`
+	B       uint8   `json:"b"`
+	Name    string  `json:"name"`
+	Percent float64 `json:"percent"`
+}
+
+type LogEntry struct {
+	Timestamp  string      `json:"timestamp"`
+	ScreenSize string      `json:"screen_size"`
+	TopColors  []ColorStat `json:"top_colors"`
+}
+
+// newLogEntry describes the top colors of one analyzed frame
+func newLogEntry(now time.Time, bounds image.Rectangle, top []struct {
+	Color RGB
+	Count int
+}, totalPixels int) LogEntry {
+	var stats []ColorStat
+	for _, entry := range top {
+		stats = append(stats, ColorStat{
+			R:       entry.Color.R,
+			G:       entry.Color.G,
+			B:       entry.Color.B,
+			Name:    colorName(entry.Color),
+			Percent: colorPercent(entry.Count, totalPixels),
+		})
+	}
+	return LogEntry{
+		Timestamp:  now.Format(colorLogTimeFormat),
+		ScreenSize: fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy()),
+		TopColors:  stats,
+	}
+}
+
+// colorPercent is the share of count in total pixels, 0 without pixels
+func colorPercent(count, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total) * 100
+}
+
+// colorLogWriter appends log entries as NDJSON. Each entry costs one write,
+// however large the log is. The file is rotated to PATH.1 when it reaches
+// MAX_SIZE_MB or MAX_AGE_HOURS; older files move up to PATH.MAX_FILES and
+// the oldest is deleted.
+type colorLogWriter struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	now      func() time.Time
+
+	f       *os.File
+	size    int64
+	created time.Time
+}
+
+func newColorLogWriter(cfg ColorLogConfig) (*colorLogWriter, error) {
+	w := &colorLogWriter{
+		path:     cfg.PATH,
+		maxSize:  int64(cfg.MAX_SIZE_MB * 1024 * 1024),
+		maxAge:   time.Duration(cfg.MAX_AGE_HOURS * float64(time.Hour)),
+		maxFiles: cfg.MAX_FILES,
+		now:      time.Now,
+	}
+	if n, err := importLegacyColorLog(w.path); err != nil {
+		logger.Warnf("Failed to import the old color log: %v", err)
+	} else if n > 0 {
+		logger.Infof("Imported %d entries of the old color log into %s", n, w.path)
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens PATH for appending. The age of an existing file counts from its
+// first entry.
+func (w *colorLogWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size, w.created = f, info.Size(), w.now()
+	if w.size > 0 {
+		if t, ok := firstEntryTime(w.path); ok {
+			w.created = t
+		}
+	}
+	return nil
+}
+
+// Write appends one entry, rotating the file first if it is due
+func (w *colorLogWriter) Write(entry LogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if w.size > 0 && (w.size+int64(len(line)) > w.maxSize || (w.maxAge > 0 && w.now().Sub(w.created) >= w.maxAge)) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+func (w *colorLogWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if w.maxFiles == 0 {
+		if err := os.Remove(w.path); err != nil {
+			return err
+		}
+		return w.open()
+	}
+	os.Remove(rotatedLogPath(w.path, w.maxFiles))
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedLogPath(w.path, i), rotatedLogPath(w.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(w.path, rotatedLogPath(w.path, 1)); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *colorLogWriter) Close() error {
+	return w.f.Close()
+}
+
+func rotatedLogPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// firstEntryTime reads the timestamp of the first entry of an NDJSON log
+func firstEntryTime(path string) (time.Time, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return time.Time{}, false
+	}
+	var e LogEntry
+	if json.Unmarshal(line, &e) != nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, e.Timestamp)
+	return t, err == nil
+}
+
+// importLegacyColorLog converts a color log in the old JSON array format to
+// NDJSON once. An array at path is converted in place; otherwise, if path
+// does not exist yet, the old colorlog.json next to it is converted into path
+// and renamed to colorlog.json.imported. It returns the number of entries
+// imported.
+func importLegacyColorLog(path string) (int, error) {
+	src := path
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		src = filepath.Join(filepath.Dir(path), legacyColorLogPath)
+	}
+	data, err := os.ReadFile(src)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '[' {
+		return 0, nil // already NDJSON
+	}
+	var entries []LogEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("%s: %w", src, err)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf) // Encode ends every entry with a newline
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return 0, err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if src != path {
+		if err := os.Rename(src, src+".imported"); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
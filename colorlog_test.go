@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// readColorLog decodes every line of an NDJSON log
+func readColorLog(t *testing.T, path string) []LogEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	var entries []LogEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid line %q in %s: %v", scanner.Text(), path, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func testLogEntry(now time.Time) LogEntry {
+	return newLogEntry(now, image.Rect(0, 0, 4, 2), []struct {
+		Color RGB
+		Count int
+	}{{RGB{255, 0, 0}, 6}, {RGB{0, 0, 255}, 2}}, 8)
+}
+
+func TestColorLogWriter_Appends(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	cfg := defaultColorLogConfig()
+	cfg.PATH = filepath.Join(t.TempDir(), "colorlog.ndjson")
+	for run := 0; run < 2; run++ {
+		w, err := newColorLogWriter(cfg)
+		if err != nil {
+			t.Fatalf("newColorLogWriter failed: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := w.Write(testLogEntry(time.Now())); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		w.Close()
+	}
+	entries := readColorLog(t, cfg.PATH)
+	if len(entries) != 6 {
+		t.Fatalf("expected 6 entries after two runs, got %d", len(entries))
+	}
+	if e := entries[0]; e.ScreenSize != "4x2" || len(e.TopColors) != 2 || e.TopColors[0].Percent != 75 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestColorLogWriter_Rotation(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	path := filepath.Join(t.TempDir(), "colorlog.ndjson")
+	line, _ := json.Marshal(testLogEntry(time.Now()))
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	// Room for two entries per file, two rotated files
+	cfg := ColorLogConfig{PATH: path, MAX_SIZE_MB: float64(2*(len(line)+1)) / 1024 / 1024, MAX_AGE_HOURS: 1, MAX_FILES: 2}
+	w, err := newColorLogWriter(cfg)
+	if err != nil {
+		t.Fatalf("newColorLogWriter failed: %v", err)
+	}
+	defer w.Close()
+	w.now = func() time.Time { return now }
+	w.created = now
+	for i := 0; i < 7; i++ {
+		if err := w.Write(testLogEntry(now)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	// 7 entries: 1 in the current file, 2 in .1, 2 in .2, the oldest 2 deleted
+	for file, want := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		if got := len(readColorLog(t, file)); got != want {
+			t.Errorf("%s: expected %d entries, got %d", filepath.Base(file), want, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected no third rotated file")
+	}
+
+	// Age: the next entry after an hour starts a new file
+	now = now.Add(time.Hour)
+	if err := w.Write(testLogEntry(now)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := len(readColorLog(t, path)); got != 1 {
+		t.Errorf("expected an old file to be rotated, current file has %d entries", got)
+	}
+	if got := len(readColorLog(t, path+".1")); got != 1 {
+		t.Errorf("expected the rotated file to hold the previous entry, got %d", got)
+	}
+}
+
+func TestColorLogWriter_AgeOfExistingFile(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	path := filepath.Join(t.TempDir(), "colorlog.ndjson")
+	old := time.Now().Add(-48 * time.Hour)
+	line, _ := json.Marshal(testLogEntry(old))
+	if err := os.WriteFile(path, append(line, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultColorLogConfig()
+	cfg.PATH = path
+	w, err := newColorLogWriter(cfg)
+	if err != nil {
+		t.Fatalf("newColorLogWriter failed: %v", err)
+	}
+	defer w.Close()
+	if err := w.Write(testLogEntry(time.Now())); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := len(readColorLog(t, path+".1")); got != 1 {
+		t.Errorf("expected the two day old file to be rotated on the first write, got %d entries in .1", got)
+	}
+}
+
+func TestImportLegacyColorLog(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	legacy := []LogEntry{testLogEntry(time.Now()), testLogEntry(time.Now())}
+	data, _ := json.MarshalIndent(legacy, "", "  ")
+
+	t.Run("next to the new log", func(t *testing.T) {
+		dir := t.TempDir()
+		old := filepath.Join(dir, legacyColorLogPath)
+		if err := os.WriteFile(old, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := defaultColorLogConfig()
+		cfg.PATH = filepath.Join(dir, "colorlog.ndjson")
+		w, err := newColorLogWriter(cfg)
+		if err != nil {
+			t.Fatalf("newColorLogWriter failed: %v", err)
+		}
+		w.Write(testLogEntry(time.Now()))
+		w.Close()
+		if got := len(readColorLog(t, cfg.PATH)); got != 3 {
+			t.Errorf("expected 2 imported entries and 1 new one, got %d", got)
+		}
+		if _, err := os.Stat(old); !os.IsNotExist(err) {
+			t.Errorf("expected the old log to be renamed")
+		}
+		if _, err := os.Stat(old + ".imported"); err != nil {
+			t.Errorf("expected the old log to be kept as .imported: %v", err)
+		}
+		// A second start does not import again
+		if n, err := importLegacyColorLog(cfg.PATH); n != 0 || err != nil {
+			t.Errorf("expected nothing to import, got %d, %v", n, err)
+		}
+	})
+
+	t.Run("in place", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), legacyColorLogPath)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		n, err := importLegacyColorLog(path)
+		if n != 2 || err != nil {
+			t.Fatalf("expected 2 entries imported, got %d, %v", n, err)
+		}
+		if got := readColorLog(t, path); len(got) != 2 || got[1].TopColors[0].Name != legacy[1].TopColors[0].Name {
+			t.Errorf("unexpected converted log %+v", got)
+		}
+	})
+}
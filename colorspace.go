@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Color distance metrics (COLOR_DISTANCE_METRIC)
+const (
+	MetricRGB       = "rgb"       // Euclidean RGB distance, 0-441
+	MetricCIE94     = "cie94"     // CIE94 ΔE (graphic arts weights), roughly 0-100
+	MetricCIEDE2000 = "ciede2000" // CIEDE2000 ΔE, roughly 0-100
+)
+
+// Largest useful threshold for the perceptual ΔE metrics
+const MaxDeltaE = 100.0
+
+// Lab is a color in the CIELAB space (D65 white point)
+type Lab struct {
+	L, A, B float64
+}
+
+// srgbToLinear undoes the sRGB gamma curve for one 0-255 channel
+func srgbToLinear(c uint8) float64 {
+	v := float64(c) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// rgbToLab converts an sRGB color to CIELAB via XYZ
+func rgbToLab(c RGB) Lab {
+	r, g, b := srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)
+	// sRGB -> XYZ, normalized to the D65 reference white
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / 0.95047
+	y := 0.2126729*r + 0.7151522*g + 0.0721750*b
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389.0 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27.0*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return Lab{L: 116*fy - 16, A: 500 * (fx - fy), B: 200 * (fy - fz)}
+}
+
+// deltaE94 returns the CIE94 color difference using graphic arts weights
+func deltaE94(x, y Lab) float64 {
+	dL := x.L - y.L
+	c1 := math.Hypot(x.A, x.B)
+	c2 := math.Hypot(y.A, y.B)
+	dC := c1 - c2
+	da := x.A - y.A
+	db := x.B - y.B
+	dH2 := da*da + db*db - dC*dC
+	if dH2 < 0 {
+		dH2 = 0
+	}
+	sc := 1 + 0.045*c1
+	sh := 1 + 0.015*c1
+	return math.Sqrt(dL*dL + (dC/sc)*(dC/sc) + dH2/(sh*sh))
+}
+
+// deltaE2000 returns the CIEDE2000 color difference (Sharma et al. 2005)
+func deltaE2000(x, y Lab) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	pow25to7 := math.Pow(25, 7)
+
+	c1 := math.Hypot(x.A, x.B)
+	c2 := math.Hypot(y.A, y.B)
+	cBar7 := math.Pow((c1+c2)/2, 7)
+	g := 0.5 * (1 - math.Sqrt(cBar7/(cBar7+pow25to7)))
+	a1p := (1 + g) * x.A
+	a2p := (1 + g) * y.A
+	c1p := math.Hypot(a1p, x.B)
+	c2p := math.Hypot(a2p, y.B)
+	h1p := hueAngle(a1p, x.B)
+	h2p := hueAngle(a2p, y.B)
+
+	dLp := y.L - x.L
+	dCp := c2p - c1p
+	var dhp float64
+	if c1p*c2p != 0 {
+		dhp = h2p - h1p
+		if dhp > 180 {
+			dhp -= 360
+		} else if dhp < -180 {
+			dhp += 360
+		}
+	}
+	dHp := 2 * math.Sqrt(c1p*c2p) * math.Sin(rad(dhp/2))
+
+	lBarp := (x.L + y.L) / 2
+	cBarp := (c1p + c2p) / 2
+	var hBarp float64
+	switch {
+	case c1p*c2p == 0:
+		hBarp = h1p + h2p
+	case math.Abs(h1p-h2p) <= 180:
+		hBarp = (h1p + h2p) / 2
+	case h1p+h2p < 360:
+		hBarp = (h1p + h2p + 360) / 2
+	default:
+		hBarp = (h1p + h2p - 360) / 2
+	}
+
+	t := 1 - 0.17*math.Cos(rad(hBarp-30)) + 0.24*math.Cos(rad(2*hBarp)) +
+		0.32*math.Cos(rad(3*hBarp+6)) - 0.20*math.Cos(rad(4*hBarp-63))
+	dTheta := 30 * math.Exp(-math.Pow((hBarp-275)/25, 2))
+	cBarp7 := math.Pow(cBarp, 7)
+	rc := 2 * math.Sqrt(cBarp7/(cBarp7+pow25to7))
+	lb50 := (lBarp - 50) * (lBarp - 50)
+	sl := 1 + 0.015*lb50/math.Sqrt(20+lb50)
+	sc := 1 + 0.045*cBarp
+	sh := 1 + 0.015*cBarp*t
+	rt := -math.Sin(rad(2*dTheta)) * rc
+
+	return math.Sqrt((dLp/sl)*(dLp/sl) + (dCp/sc)*(dCp/sc) + (dHp/sh)*(dHp/sh) + rt*(dCp/sc)*(dHp/sh))
+}
+
+// hueAngle returns the hue angle of (a, b) in degrees, 0-360
+func hueAngle(a, b float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	h := math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// colorDistanceFunc returns the distance function for a metric
+func colorDistanceFunc(metric string) (func(a, b RGB) float64, error) {
+	switch metric {
+	case "", MetricRGB:
+		return colorDistance, nil
+	case MetricCIE94:
+		return func(a, b RGB) float64 { return deltaE94(rgbToLab(a), rgbToLab(b)) }, nil
+	case MetricCIEDE2000:
+		return func(a, b RGB) float64 { return deltaE2000(rgbToLab(a), rgbToLab(b)) }, nil
+	default:
+		return nil, fmt.Errorf("unknown COLOR_DISTANCE_METRIC %q, use rgb, cie94 or ciede2000", metric)
+	}
+}
+
+// D65 white point in CIE 1931 xy, used for black which has no chromaticity
+const d65X, d65Y = 0.3127, 0.3290
+
+// rgbToXY converts an sRGB color to CIE 1931 xy chromaticity
+func rgbToXY(c RGB) (float64, float64) {
+	r, g, b := srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)
+	x := 0.4124564*r + 0.3575761*g + 0.1804375*b
+	y := 0.2126729*r + 0.7151522*g + 0.0721750*b
+	z := 0.0193339*r + 0.1191920*g + 0.9503041*b
+	sum := x + y + z
+	if sum == 0 {
+		return d65X, d65Y
+	}
+	return x / sum, y / sum
+}
+
+// xyToKelvin estimates the correlated color temperature of an xy
+// chromaticity (McCamy's approximation)
+func xyToKelvin(x, y float64) float64 {
+	n := (x - 0.3320) / (0.1858 - y)
+	return 449*n*n*n + 3525*n*n + 6823.3*n + 5520.33
+}
+
+// rgbToRGBW moves the gray part of a color to the white channel
+func rgbToRGBW(c RGB) [4]int {
+	w := min(c.R, c.G, c.B)
+	return [4]int{int(c.R - w), int(c.G - w), int(c.B - w), int(w)}
+}
+
+// rgbToRGBWW moves the gray part of a color to the cold and warm white
+// channels, split by how close the color temperature is to each end of the
+// light's range (minKelvin-maxKelvin)
+func rgbToRGBWW(c RGB, minKelvin, maxKelvin int) [5]int {
+	rgbw := rgbToRGBW(c)
+	w := float64(rgbw[3])
+	cold := 0.5
+	if maxKelvin > minKelvin {
+		kelvin := xyToKelvin(rgbToXY(c))
+		cold = (kelvin - float64(minKelvin)) / float64(maxKelvin-minKelvin)
+		cold = math.Max(0, math.Min(1, cold))
+	}
+	return [5]int{rgbw[0], rgbw[1], rgbw[2], int(math.Round(w * cold)), int(math.Round(w * (1 - cold)))}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRGBToLab(t *testing.T) {
+	white := rgbToLab(RGB{255, 255, 255})
+	if math.Abs(white.L-100) > 0.01 || math.Abs(white.A) > 0.01 || math.Abs(white.B) > 0.01 {
+		t.Errorf("unexpected Lab for white: %+v", white)
+	}
+	red := rgbToLab(RGB{255, 0, 0})
+	if math.Abs(red.L-53.24) > 0.05 || math.Abs(red.A-80.09) > 0.05 || math.Abs(red.B-67.20) > 0.05 {
+		t.Errorf("unexpected Lab for red: %+v", red)
+	}
+}
+
+func TestDeltaE2000(t *testing.T) {
+	// Reference pairs from Sharma, Wu and Dalal (2005)
+	cases := []struct {
+		a, b Lab
+		want float64
+	}{
+		{Lab{50, 2.6772, -79.7751}, Lab{50, 0, -82.7485}, 2.0425},
+		{Lab{50, 0, 0}, Lab{50, -1, 2}, 2.3669},
+		{Lab{50, 2.5, 0}, Lab{73, 25, -18}, 27.1492},
+		{Lab{60.2574, -34.0099, 36.2677}, Lab{60.4626, -34.1751, 39.4387}, 1.2644},
+		{Lab{2.0776, 0.0795, -1.1350}, Lab{0.9033, -0.0636, -0.5514}, 0.9082},
+	}
+	for _, c := range cases {
+		if got := deltaE2000(c.a, c.b); math.Abs(got-c.want) > 0.0001 {
+			t.Errorf("deltaE2000(%v, %v) = %.4f, want %.4f", c.a, c.b, got, c.want)
+		}
+		if got := deltaE2000(c.b, c.a); math.Abs(got-c.want) > 0.0001 {
+			t.Errorf("deltaE2000 should be symmetric, got %.4f", got)
+		}
+	}
+}
+
+func TestDeltaE94(t *testing.T) {
+	if d := deltaE94(Lab{50, 10, 10}, Lab{50, 10, 10}); d != 0 {
+		t.Errorf("expected 0 for identical colors, got %v", d)
+	}
+	// Pure lightness difference is not weighted
+	if d := deltaE94(Lab{50, 0, 0}, Lab{60, 0, 0}); math.Abs(d-10) > 1e-9 {
+		t.Errorf("expected 10 for a lightness step, got %v", d)
+	}
+}
+
+func TestPerceptualMetricWeighting(t *testing.T) {
+	dist, err := colorDistanceFunc(MetricCIEDE2000)
+	if err != nil {
+		t.Fatalf("colorDistanceFunc failed: %v", err)
+	}
+	// The same RGB step is much more visible in dark blue than in bright green
+	blue := dist(RGB{0, 0, 60}, RGB{0, 0, 80})
+	green := dist(RGB{0, 200, 0}, RGB{0, 220, 0})
+	if colorDistance(RGB{0, 0, 60}, RGB{0, 0, 80}) != colorDistance(RGB{0, 200, 0}, RGB{0, 220, 0}) {
+		t.Fatal("test colors should have the same RGB distance")
+	}
+	if blue <= green {
+		t.Errorf("expected dark blue step (%.2f) to be larger than green step (%.2f)", blue, green)
+	}
+	if _, err := colorDistanceFunc("manhattan"); err == nil {
+		t.Error("expected error for unknown metric")
+	}
+}
+
+func TestRGBToXY(t *testing.T) {
+	x, y := rgbToXY(RGB{255, 0, 0})
+	if math.Abs(x-0.64) > 0.001 || math.Abs(y-0.33) > 0.001 {
+		t.Errorf("expected sRGB red primary, got %.4f %.4f", x, y)
+	}
+	x, y = rgbToXY(RGB{255, 255, 255})
+	if math.Abs(x-d65X) > 0.001 || math.Abs(y-d65Y) > 0.001 {
+		t.Errorf("expected D65 white, got %.4f %.4f", x, y)
+	}
+	if x, y = rgbToXY(RGB{}); x != d65X || y != d65Y {
+		t.Errorf("expected D65 for black, got %.4f %.4f", x, y)
+	}
+}
+
+func TestXYToKelvin(t *testing.T) {
+	if k := xyToKelvin(d65X, d65Y); math.Abs(k-6504) > 50 {
+		t.Errorf("expected about 6500K for D65, got %.0f", k)
+	}
+	warm := xyToKelvin(rgbToXY(RGB{255, 200, 150}))
+	if warm < 2500 || warm > 4500 {
+		t.Errorf("expected a warm white, got %.0f", warm)
+	}
+}
+
+func TestRGBToRGBW(t *testing.T) {
+	if got := rgbToRGBW(RGB{200, 100, 50}); got != [4]int{150, 50, 0, 50} {
+		t.Errorf("unexpected rgbw: %v", got)
+	}
+	if got := rgbToRGBW(RGB{255, 255, 255}); got != [4]int{0, 0, 0, 255} {
+		t.Errorf("expected white on the white channel only, got %v", got)
+	}
+}
+
+func TestRGBToRGBWW(t *testing.T) {
+	got := rgbToRGBWW(RGB{255, 255, 255}, 2000, 6500)
+	if got[0] != 0 || got[1] != 0 || got[2] != 0 || got[3] < 240 || got[3]+got[4] != 255 {
+		t.Errorf("expected D65 white mostly on the cold channel, got %v", got)
+	}
+	got = rgbToRGBWW(RGB{255, 180, 110}, 2000, 6500)
+	if got[4] <= got[3] {
+		t.Errorf("expected a warm color mostly on the warm channel, got %v", got)
+	}
+}
@@ -1,26 +1,161 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Defaults for optional settings, applied before the YAML is decoded so an
+// explicit value (including 0) in the file always wins
+const (
+	DefaultColorChangeThreshold = 32.0
+	DefaultUpdateIntervalMS     = 100
+	// Largest possible RGB Euclidean distance, sqrt(3 * 255^2)
+	MaxColorDistance = 441.68
+	// Faster updates only burn CPU and flood the output
+	MinUpdateIntervalMS = 10
+	// Larger palettes only cost time on a downscaled frame
+	MaxPaletteSize = 64
+)
+
 type Config struct {
 	Env struct {
-		HA_URL                 string  `yaml:"HA_URL"`
-		HA_TOKEN               string  `yaml:"HA_TOKEN"`
-		LED_ENTITY             string  `yaml:"LED_ENTITY"`
-		EXPORT_JSON            bool    `yaml:"EXPORT_JSON"`
-		EXPORT_SCREENSHOT      bool    `yaml:"EXPORT_SCREENSHOT"`
-		COLOR_CHANGE_THRESHOLD float64 `yaml:"COLOR_CHANGE_THRESHOLD"`
-		UPDATE_INTERVAL_MS     int     `yaml:"UPDATE_INTERVAL_MS"`
-		LOG_LEVEL              string  `yaml:"LOG_LEVEL"`
+		HA_URL                 string                     `yaml:"HA_URL"`
+		HA_TOKEN               string                     `yaml:"HA_TOKEN"`
+		LED_ENTITY             string                     `yaml:"LED_ENTITY"`
+		HA_CLIENT              HAClientConfig             `yaml:"HA_CLIENT"`
+		EXPORT_JSON            bool                       `yaml:"EXPORT_JSON"`
+		EXPORT_SCREENSHOT      bool                       `yaml:"EXPORT_SCREENSHOT"`
+		COLOR_LOG              ColorLogConfig             `yaml:"COLOR_LOG"`
+		COLOR_CHANGE_THRESHOLD float64                    `yaml:"COLOR_CHANGE_THRESHOLD"`
+		COLOR_DISTANCE_METRIC  string                     `yaml:"COLOR_DISTANCE_METRIC"`
+		COLOR_EXTRACTOR        string                     `yaml:"COLOR_EXTRACTOR"`
+		PALETTE_SIZE           int                        `yaml:"PALETTE_SIZE"`
+		UPDATE_INTERVAL_MS     int                        `yaml:"UPDATE_INTERVAL_MS"`
+		LOG_LEVEL              string                     `yaml:"LOG_LEVEL"`
+		LOG_FILE               string                     `yaml:"LOG_FILE"`
+		ON_STOP                string                     `yaml:"ON_STOP"`
+		PAUSE                  PauseConfig                `yaml:"PAUSE"`
+		OUTPUT                 OutputConfig               `yaml:"OUTPUT"`
+		TARGETS                []TargetConfig             `yaml:"TARGETS"`
+		MODE                   string                     `yaml:"MODE"`
+		ZONES                  ZonesConfig                `yaml:"ZONES"`
+		DISPLAY                DisplayConfig              `yaml:"DISPLAY"`
+		SOURCE                 SourceConfig               `yaml:"SOURCE"`
+		API                    APIConfig                  `yaml:"API"`
+		METRICS                MetricsConfig              `yaml:"METRICS"`
+		REGION                 RegionConfig               `yaml:"REGION"`
+		LETTERBOX              LetterboxConfig            `yaml:"LETTERBOX"`
+		BRIGHTNESS             BrightnessConfig           `yaml:"BRIGHTNESS"`
+		SMOOTHING              SmoothingConfig            `yaml:"SMOOTHING"`
+		PROFILE                string                     `yaml:"PROFILE"`
+		PROFILES               map[string]SmoothingConfig `yaml:"PROFILES"`
 	} `yaml:"env"`
 }
 
-func LoadConfig(path string) (*Config, error) {
+// SmoothingConfig tunes the smoothing stage between analysis and output.
+// SMOOTHING holds the defaults, PROFILES can hold named alternatives.
+type SmoothingConfig struct {
+	ALPHA         float64 `yaml:"ALPHA"`         // weight of the new color per frame, 0-1 (0 or 1 = no averaging)
+	MAX_STEP      float64 `yaml:"MAX_STEP"`      // max RGB distance the output moves per frame, 0 = unlimited
+	HOLD_MS       int     `yaml:"HOLD_MS"`       // a new color must be stable this long before it is used
+	TRANSITION_MS int     `yaml:"TRANSITION_MS"` // fade duration passed to the light (Home Assistant transition)
+}
+
+// APIConfig configures the optional local HTTP control API
+type APIConfig struct {
+	ENABLED bool   `yaml:"ENABLED"`
+	LISTEN  string `yaml:"LISTEN"` // bind address (default 127.0.0.1:8765)
+	TOKEN   string `yaml:"TOKEN"`  // bearer token required by every request
+}
+
+// DisplayConfig selects the screen area that is captured
+type DisplayConfig struct {
+	MODE    string `yaml:"MODE"`    // single (default), combined or virtual
+	INDEX   int    `yaml:"INDEX"`   // display for single mode, 0 = primary
+	INDEXES []int  `yaml:"INDEXES"` // displays for combined mode, empty = all
+	RECT    []int  `yaml:"RECT"`    // x, y, width, height for virtual mode, empty = whole desktop
+}
+
+// ZonesConfig describes the LED layout around the screen for the zone mode
+type ZonesConfig struct {
+	TOP           int     `yaml:"TOP"`           // LEDs along the top edge
+	RIGHT         int     `yaml:"RIGHT"`         // LEDs along the right edge
+	BOTTOM        int     `yaml:"BOTTOM"`        // LEDs along the bottom edge
+	LEFT          int     `yaml:"LEFT"`          // LEDs along the left edge
+	START         string  `yaml:"START"`         // corner of LED 0: top-left (default), top-right, bottom-right, bottom-left
+	DIRECTION     string  `yaml:"DIRECTION"`     // clockwise (default) or counterclockwise
+	DEPTH_PERCENT float64 `yaml:"DEPTH_PERCENT"` // depth of the sampled border strip in percent (default 10)
+}
+
+// OutputConfig selects the light output backend
+type OutputConfig struct {
+	TYPE string     `yaml:"TYPE"` // homeassistant (default), homeassistant_ws, wled or mqtt
+	WLED WLEDConfig `yaml:"WLED"`
+	MQTT MQTTConfig `yaml:"MQTT"`
+}
+
+// MQTTConfig configures the MQTT backend and the optional Home Assistant
+// discovery of the app itself
+type MQTTConfig struct {
+	BROKER           string `yaml:"BROKER"`           // tcp://host:1883, ssl://host:8883 or ws://host:port
+	CLIENT_ID        string `yaml:"CLIENT_ID"`        // default led-screen-sync, also names the discovered device
+	USERNAME         string `yaml:"USERNAME"`         // optional broker login
+	PASSWORD         string `yaml:"PASSWORD"`         // optional broker login
+	COMMAND_TOPIC    string `yaml:"COMMAND_TOPIC"`    // JSON commands are published here, e.g. zigbee2mqtt/desk_led/set
+	STATE_TOPIC      string `yaml:"STATE_TOPIC"`      // optional JSON state of the light, used to restore it
+	QOS              int    `yaml:"QOS"`              // 0, 1 or 2
+	RETAIN           bool   `yaml:"RETAIN"`           // retain color commands on the broker
+	DISCOVERY        bool   `yaml:"DISCOVERY"`        // publish Home Assistant MQTT discovery for a sync switch and color sensor
+	DISCOVERY_PREFIX string `yaml:"DISCOVERY_PREFIX"` // default homeassistant
+}
+
+// WLEDConfig configures the native WLED backend
+type WLEDConfig struct {
+	HOST      string `yaml:"HOST"`      // host or host:port of the WLED controller
+	MODE      string `yaml:"MODE"`      // json (default), warls, drgb or dnrgb
+	UDP_PORT  int    `yaml:"UDP_PORT"`  // realtime UDP port (default 21324)
+	LED_COUNT int    `yaml:"LED_COUNT"` // number of LEDs on the strip, required for UDP modes
+	TIMEOUT_S int    `yaml:"TIMEOUT_S"` // seconds until WLED resumes its own effect (default 2)
+}
+
+// What to do with the LED when sync stops or the app quits
+const (
+	OnStopRestore = "restore" // restore the state saved when sync started
+	OnStopOff     = "off"     // turn the LED off
+	OnStopKeep    = "keep"    // leave the LED on the last synced color
+)
+
+func defaultConfig() Config {
 	var config Config
+	config.Env.COLOR_CHANGE_THRESHOLD = DefaultColorChangeThreshold
+	config.Env.COLOR_DISTANCE_METRIC = MetricRGB
+	config.Env.COLOR_EXTRACTOR = ExtractorHistogram
+	config.Env.PALETTE_SIZE = DefaultPaletteSize
+	config.Env.UPDATE_INTERVAL_MS = DefaultUpdateIntervalMS
+	config.Env.LOG_LEVEL = "info"
+	config.Env.ON_STOP = OnStopRestore
+	config.Env.PAUSE = PauseConfig{ACTION: OnStopKeep, MAX_BACKOFF_MS: 30000}
+	config.Env.MODE = ModeSingle
+	config.Env.OUTPUT.TYPE = OutputHomeAssistant
+	config.Env.HA_CLIENT = defaultHAClientConfig()
+	config.Env.COLOR_LOG = defaultColorLogConfig()
+	config.Env.OUTPUT.MQTT.CLIENT_ID = "led-screen-sync"
+	config.Env.OUTPUT.MQTT.DISCOVERY_PREFIX = "homeassistant"
+	config.Env.API.LISTEN = "127.0.0.1:8765"
+	config.Env.METRICS.LISTEN = "127.0.0.1:9765"
+	config.Env.SOURCE.FPS = DefaultSourceFPS
+	config.Env.LETTERBOX = LetterboxConfig{THRESHOLD: 24, STABLE_FRAMES: 10}
+	config.Env.BRIGHTNESS = BrightnessConfig{MODE: BrightnessFixed, PERCENTILE: 90, MIN: 1, MAX: 255, GAMMA: 1, CHANGE_THRESHOLD: 8}
+	return config
+}
+
+func LoadConfig(path string) (*Config, error) {
+	config := defaultConfig()
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -30,5 +165,144 @@ func LoadConfig(path string) (*Config, error) {
 	if err := dec.Decode(&config); err != nil {
 		return nil, err
 	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
+
+// Validate rejects values that would make the sync loop misbehave
+func (c *Config) Validate() error {
+	env := &c.Env
+	if _, err := colorDistanceFunc(env.COLOR_DISTANCE_METRIC); err != nil {
+		return err
+	}
+	maxThreshold := MaxColorDistance
+	if env.COLOR_DISTANCE_METRIC != MetricRGB {
+		maxThreshold = MaxDeltaE
+	}
+	if env.COLOR_CHANGE_THRESHOLD < 0 || env.COLOR_CHANGE_THRESHOLD > maxThreshold {
+		return fmt.Errorf("COLOR_CHANGE_THRESHOLD must be between 0 and %.0f for the %s metric, got %v",
+			maxThreshold, env.COLOR_DISTANCE_METRIC, env.COLOR_CHANGE_THRESHOLD)
+	}
+	if _, err := newColorExtractor(env.COLOR_EXTRACTOR, env.PALETTE_SIZE); err != nil {
+		return err
+	}
+	if env.PALETTE_SIZE < 1 || env.PALETTE_SIZE > MaxPaletteSize {
+		return fmt.Errorf("PALETTE_SIZE must be between 1 and %d, got %d", MaxPaletteSize, env.PALETTE_SIZE)
+	}
+	if env.UPDATE_INTERVAL_MS < MinUpdateIntervalMS {
+		return fmt.Errorf("UPDATE_INTERVAL_MS must be at least %d, got %d", MinUpdateIntervalMS, env.UPDATE_INTERVAL_MS)
+	}
+	switch env.LOG_LEVEL {
+	case "debug", "info", "warn", "error", "dpanic", "panic", "fatal":
+	default:
+		return fmt.Errorf("unknown LOG_LEVEL %q", env.LOG_LEVEL)
+	}
+	switch env.ON_STOP {
+	case OnStopRestore, OnStopOff, OnStopKeep:
+	default:
+		return fmt.Errorf("unknown ON_STOP %q, use restore, off or keep", env.ON_STOP)
+	}
+	switch strings.ToLower(env.OUTPUT.TYPE) {
+	case OutputHomeAssistant, OutputHomeAssistantWS, OutputWLED, OutputMQTT:
+	default:
+		return fmt.Errorf("unknown OUTPUT.TYPE %q", env.OUTPUT.TYPE)
+	}
+	switch strings.ToLower(env.DISPLAY.MODE) {
+	case "", DisplaySingle, DisplayCombined, DisplayVirtual:
+	default:
+		return fmt.Errorf("unknown DISPLAY.MODE %q, use single, combined or virtual", env.DISPLAY.MODE)
+	}
+	if env.DISPLAY.INDEX < 0 {
+		return fmt.Errorf("DISPLAY.INDEX must not be negative, got %d", env.DISPLAY.INDEX)
+	}
+	for _, i := range env.DISPLAY.INDEXES {
+		if i < 0 {
+			return fmt.Errorf("DISPLAY.INDEXES must not be negative, got %d", i)
+		}
+	}
+	if len(env.DISPLAY.RECT) != 0 && (len(env.DISPLAY.RECT) != 4 || env.DISPLAY.RECT[2] <= 0 || env.DISPLAY.RECT[3] <= 0) {
+		return fmt.Errorf("DISPLAY.RECT must be [x, y, width, height] with a positive size, got %v", env.DISPLAY.RECT)
+	}
+	if env.API.ENABLED {
+		if _, _, err := net.SplitHostPort(env.API.LISTEN); err != nil {
+			return fmt.Errorf("API.LISTEN must be host:port, got %q", env.API.LISTEN)
+		}
+		// Without a token any web page open in a browser could POST to the API
+		if env.API.TOKEN == "" {
+			return fmt.Errorf("API.TOKEN must be set when API.ENABLED is true")
+		}
+	}
+	if env.METRICS.ENABLED {
+		if _, _, err := net.SplitHostPort(env.METRICS.LISTEN); err != nil {
+			return fmt.Errorf("METRICS.LISTEN must be host:port, got %q", env.METRICS.LISTEN)
+		}
+	}
+	for i, t := range env.TARGETS {
+		if err := t.validate(fmt.Sprintf("TARGETS[%d]", i)); err != nil {
+			return err
+		}
+	}
+	if err := env.HA_CLIENT.validate(); err != nil {
+		return err
+	}
+	if err := env.COLOR_LOG.validate(); err != nil {
+		return err
+	}
+	if err := env.PAUSE.validate(); err != nil {
+		return err
+	}
+	if err := env.SOURCE.validate(); err != nil {
+		return err
+	}
+	if err := env.REGION.validate(); err != nil {
+		return err
+	}
+	if err := env.LETTERBOX.validate(); err != nil {
+		return err
+	}
+	if err := env.BRIGHTNESS.validate(); err != nil {
+		return err
+	}
+	if err := env.SMOOTHING.validate("SMOOTHING", env.COLOR_CHANGE_THRESHOLD); err != nil {
+		return err
+	}
+	for name, profile := range env.PROFILES {
+		if err := profile.validate("PROFILES."+name, env.COLOR_CHANGE_THRESHOLD); err != nil {
+			return err
+		}
+	}
+	if _, ok := env.PROFILES[env.PROFILE]; env.PROFILE != "" && !ok {
+		return fmt.Errorf("PROFILE %q not found in PROFILES", env.PROFILE)
+	}
+	switch env.MODE {
+	case ModeSingle:
+	case ModeZones:
+		if _, err := buildZoneLayout(env.ZONES); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown MODE %q, use single or zones", env.MODE)
+	}
+	return nil
+}
+
+// validate checks the settings, threshold is COLOR_CHANGE_THRESHOLD which the
+// hold uses as its tolerance
+func (s SmoothingConfig) validate(prefix string, threshold float64) error {
+	if s.ALPHA < 0 || s.ALPHA > 1 {
+		return fmt.Errorf("%s.ALPHA must be between 0 and 1, got %v", prefix, s.ALPHA)
+	}
+	if s.MAX_STEP < 0 {
+		return fmt.Errorf("%s.MAX_STEP must not be negative, got %v", prefix, s.MAX_STEP)
+	}
+	if s.HOLD_MS < 0 || s.TRANSITION_MS < 0 {
+		return fmt.Errorf("%s.HOLD_MS and TRANSITION_MS must not be negative", prefix)
+	}
+	if s.HOLD_MS > 0 && threshold == 0 {
+		// Every bit of noise would restart the hold and freeze the output
+		return fmt.Errorf("%s.HOLD_MS needs a COLOR_CHANGE_THRESHOLD above 0", prefix)
+	}
+	return nil
+}
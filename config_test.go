@@ -58,3 +58,91 @@ func TestLoadConfig_FileNotFound(t *testing.T) {
 		t.Error("expected error for missing file, got nil")
 	}
 }
+
+func writeTempConfig(t *testing.T, content string) string {
+	t.Helper()
+	f, err := os.CreateTemp("", "ledsync-test-*.yaml")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	_, err = f.WriteString(content)
+	f.Close()
+	if err != nil {
+		t.Fatalf("failed to write temp config: %v", err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfig_Defaults(t *testing.T) {
+	cfg, err := LoadConfig(writeTempConfig(t, "env:\n  HA_URL: \"http://localhost:8123\"\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Env.COLOR_CHANGE_THRESHOLD != DefaultColorChangeThreshold {
+		t.Errorf("expected default threshold, got %v", cfg.Env.COLOR_CHANGE_THRESHOLD)
+	}
+	if cfg.Env.UPDATE_INTERVAL_MS != DefaultUpdateIntervalMS {
+		t.Errorf("expected default interval, got %v", cfg.Env.UPDATE_INTERVAL_MS)
+	}
+	if cfg.Env.ON_STOP != OnStopRestore || cfg.Env.MODE != ModeSingle {
+		t.Errorf("unexpected defaults: ON_STOP=%q MODE=%q", cfg.Env.ON_STOP, cfg.Env.MODE)
+	}
+
+	// An explicit 0 threshold means "update on every change" and must be kept
+	cfg, err = LoadConfig(writeTempConfig(t, "env:\n  COLOR_CHANGE_THRESHOLD: 0\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Env.COLOR_CHANGE_THRESHOLD != 0 {
+		t.Errorf("explicit 0 threshold was overwritten: %v", cfg.Env.COLOR_CHANGE_THRESHOLD)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"negative threshold":     "env:\n  COLOR_CHANGE_THRESHOLD: -1\n",
+		"threshold too high":     "env:\n  COLOR_CHANGE_THRESHOLD: 1000\n",
+		"zero interval":          "env:\n  UPDATE_INTERVAL_MS: 0\n",
+		"negative interval":      "env:\n  UPDATE_INTERVAL_MS: -100\n",
+		"unknown metric":         "env:\n  COLOR_DISTANCE_METRIC: \"manhattan\"\n",
+		"deltaE too high":        "env:\n  COLOR_DISTANCE_METRIC: \"ciede2000\"\n  COLOR_CHANGE_THRESHOLD: 200\n",
+		"unknown log level":      "env:\n  LOG_LEVEL: \"verbose\"\n",
+		"unknown on stop":        "env:\n  ON_STOP: \"explode\"\n",
+		"unknown output":         "env:\n  OUTPUT:\n    TYPE: \"hue\"\n",
+		"unknown mode":           "env:\n  MODE: \"rainbow\"\n",
+		"zones without LEDs":     "env:\n  MODE: \"zones\"\n",
+		"unknown display":        "env:\n  DISPLAY:\n    MODE: \"all\"\n",
+		"bad API listen":         "env:\n  API:\n    ENABLED: true\n    LISTEN: \"8765\"\n    TOKEN: \"secret\"\n",
+		"API without token":      "env:\n  API:\n    ENABLED: true\n",
+		"bad metrics listen":     "env:\n  METRICS:\n    ENABLED: true\n    LISTEN: \"9765\"\n",
+		"short display rect":     "env:\n  DISPLAY:\n    RECT: [0, 0, 100]\n",
+		"alpha too high":         "env:\n  SMOOTHING:\n    ALPHA: 1.5\n",
+		"negative hold":          "env:\n  PROFILES:\n    movie:\n      HOLD_MS: -1\n",
+		"hold without tolerance": "env:\n  COLOR_CHANGE_THRESHOLD: 0\n  SMOOTHING:\n    HOLD_MS: 500\n",
+		"unknown profile":        "env:\n  PROFILE: \"movie\"\n",
+		"unknown extractor":      "env:\n  COLOR_EXTRACTOR: \"octree\"\n",
+		"zero palette size":      "env:\n  PALETTE_SIZE: 0\n",
+		"unknown brightness":     "env:\n  BRIGHTNESS:\n    MODE: \"auto\"\n",
+		"brightness min>max":     "env:\n  BRIGHTNESS:\n    MIN: 200\n    MAX: 100\n",
+		"brightness min 0":       "env:\n  BRIGHTNESS:\n    MIN: 0\n",
+		"zero gamma":             "env:\n  BRIGHTNESS:\n    GAMMA: 0\n",
+		"zero stable frames":     "env:\n  LETTERBOX:\n    STABLE_FRAMES: 0\n",
+		"unknown region unit":    "env:\n  REGION:\n    UNIT: \"cm\"\n",
+		"short region rect":      "env:\n  REGION:\n    EXCLUDE: [[0, 0, 10]]\n",
+		"center weight > 1":      "env:\n  REGION:\n    CENTER_WEIGHT: 1.5\n",
+		"unknown source":         "env:\n  SOURCE:\n    TYPE: \"webcam\"\n",
+		"source without path":    "env:\n  SOURCE:\n    TYPE: \"video\"\n",
+		"missing source path":    "env:\n  SOURCE:\n    TYPE: \"image\"\n    PATH: \"/nonexistent.png\"\n",
+		"missing mask":           "env:\n  REGION:\n    MASK: \"/nonexistent/mask.png\"\n",
+		"unknown target role":    "env:\n  TARGETS:\n    - ROLE: \"accent\"\n",
+		"zone without zone":      "env:\n  TARGETS:\n    - ROLE: \"zone\"\n",
+		"target scale > 1":       "env:\n  TARGETS:\n    - BRIGHTNESS_SCALE: 2\n",
+		"color log size 0":       "env:\n  COLOR_LOG:\n    MAX_SIZE_MB: -1\n",
+	}
+	for name, content := range cases {
+		if _, err := LoadConfig(writeTempConfig(t, content)); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
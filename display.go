@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"strings"
+	"sync"
+
+	"github.com/kbinani/screenshot"
+	"golang.org/x/image/draw"
+)
+
+// Display capture modes (DISPLAY.MODE)
+const (
+	DisplaySingle   = "single"   // one display (DISPLAY.INDEX)
+	DisplayCombined = "combined" // several displays reduced to one color (DISPLAY.INDEXES, empty = all)
+	DisplayVirtual  = "virtual"  // a rectangle of the virtual desktop (DISPLAY.RECT, empty = whole desktop)
+)
+
+// DisplaySelection is the set of screen areas the loop captures
+type DisplaySelection struct {
+	Mode    string
+	Index   int
+	Indexes []int
+	Rect    image.Rectangle
+}
+
+func (s DisplaySelection) String() string {
+	switch s.Mode {
+	case DisplayCombined:
+		if len(s.Indexes) == 0 {
+			return "all displays combined"
+		}
+		return fmt.Sprintf("displays %v combined", s.Indexes)
+	case DisplayVirtual:
+		if s.Rect.Empty() {
+			return "virtual desktop"
+		}
+		return fmt.Sprintf("virtual desktop rect %v", s.Rect)
+	default:
+		return fmt.Sprintf("display %d", s.Index)
+	}
+}
+
+var (
+	displayMu        sync.Mutex
+	displaySelection DisplaySelection
+)
+
+// displaySelectionFromConfig converts the DISPLAY config section
+func displaySelectionFromConfig(cfg DisplayConfig) DisplaySelection {
+	sel := DisplaySelection{
+		Mode:    strings.ToLower(cfg.MODE),
+		Index:   cfg.INDEX,
+		Indexes: cfg.INDEXES,
+	}
+	if sel.Mode == "" {
+		sel.Mode = DisplaySingle
+	}
+	if len(cfg.RECT) == 4 {
+		sel.Rect = image.Rect(cfg.RECT[0], cfg.RECT[1], cfg.RECT[0]+cfg.RECT[2], cfg.RECT[1]+cfg.RECT[3])
+	}
+	return sel
+}
+
+func getDisplaySelection() DisplaySelection {
+	displayMu.Lock()
+	defer displayMu.Unlock()
+	return displaySelection
+}
+
+func setDisplaySelection(sel DisplaySelection) {
+	displayMu.Lock()
+	displaySelection = sel
+	displayMu.Unlock()
+	logger.Infof("Capturing %s", sel)
+}
+
+// listDisplays returns the bounds of every active display
+func listDisplays() []image.Rectangle {
+	n := screenshot.NumActiveDisplays()
+	displays := make([]image.Rectangle, n)
+	for i := range displays {
+		displays[i] = screenshot.GetDisplayBounds(i)
+	}
+	return displays
+}
+
+// selectionRects resolves a selection into the screen rectangles to capture
+func selectionRects(sel DisplaySelection, displays []image.Rectangle) ([]image.Rectangle, error) {
+	if len(displays) == 0 {
+		return nil, errors.New("no active display found")
+	}
+	switch sel.Mode {
+	case DisplayCombined:
+		if len(sel.Indexes) == 0 {
+			return displays, nil
+		}
+		rects := make([]image.Rectangle, 0, len(sel.Indexes))
+		for _, i := range sel.Indexes {
+			if i < 0 || i >= len(displays) {
+				return nil, fmt.Errorf("display %d not found (%d active)", i, len(displays))
+			}
+			rects = append(rects, displays[i])
+		}
+		return rects, nil
+	case DisplayVirtual:
+		var desktop image.Rectangle
+		for _, d := range displays {
+			desktop = desktop.Union(d)
+		}
+		if sel.Rect.Empty() {
+			return []image.Rectangle{desktop}, nil
+		}
+		rect := sel.Rect.Intersect(desktop)
+		if rect.Empty() {
+			return nil, fmt.Errorf("rect %v is outside the virtual desktop %v", sel.Rect, desktop)
+		}
+		return []image.Rectangle{rect}, nil
+	default:
+		if sel.Index < 0 || sel.Index >= len(displays) {
+			return nil, fmt.Errorf("display %d not found (%d active)", sel.Index, len(displays))
+		}
+		return []image.Rectangle{displays[sel.Index]}, nil
+	}
+}
+
+// captureSelection captures every rectangle of the current display selection
+func captureSelection() ([]*image.RGBA, error) {
+	rects, err := selectionRects(getDisplaySelection(), listDisplays())
+	if err != nil {
+		return nil, err
+	}
+	imgs := make([]*image.RGBA, 0, len(rects))
+	for _, r := range rects {
+		img, err := screenshot.CaptureRect(r)
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+// combineFrames places frames side by side, scaled to the height of the
+// tallest one, so several displays can be analyzed as one image
+func combineFrames(frames []image.Image) image.Image {
+	if len(frames) == 1 {
+		return frames[0]
+	}
+	height := 0
+	for _, f := range frames {
+		if f.Bounds().Dy() > height {
+			height = f.Bounds().Dy()
+		}
+	}
+	width := 0
+	widths := make([]int, len(frames))
+	for i, f := range frames {
+		b := f.Bounds()
+		widths[i] = b.Dx() * height / b.Dy()
+		width += widths[i]
+	}
+	combined := image.NewRGBA(image.Rect(0, 0, width, height))
+	x := 0
+	for i, f := range frames {
+		dst := image.Rect(x, 0, x+widths[i], height)
+		draw.NearestNeighbor.Scale(combined, dst, f, f.Bounds(), draw.Src, nil)
+		x += widths[i]
+	}
+	return combined
+}
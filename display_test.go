@@ -0,0 +1,61 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSelectionRects(t *testing.T) {
+	displays := []image.Rectangle{
+		image.Rect(0, 0, 1920, 1080),
+		image.Rect(1920, 0, 4480, 1440),
+	}
+
+	rects, err := selectionRects(DisplaySelection{Mode: DisplaySingle, Index: 1}, displays)
+	if err != nil || len(rects) != 1 || rects[0] != displays[1] {
+		t.Errorf("single: unexpected rects %v (err %v)", rects, err)
+	}
+	if _, err := selectionRects(DisplaySelection{Mode: DisplaySingle, Index: 2}, displays); err == nil {
+		t.Error("single: expected error for missing display")
+	}
+
+	rects, err = selectionRects(DisplaySelection{Mode: DisplayCombined}, displays)
+	if err != nil || len(rects) != 2 {
+		t.Errorf("combined: unexpected rects %v (err %v)", rects, err)
+	}
+
+	rects, err = selectionRects(DisplaySelection{Mode: DisplayVirtual}, displays)
+	if err != nil || len(rects) != 1 || rects[0] != image.Rect(0, 0, 4480, 1440) {
+		t.Errorf("virtual: unexpected rects %v (err %v)", rects, err)
+	}
+	rects, err = selectionRects(DisplaySelection{Mode: DisplayVirtual, Rect: image.Rect(1000, 500, 3000, 2000)}, displays)
+	if err != nil || rects[0] != image.Rect(1000, 500, 3000, 1440) {
+		t.Errorf("virtual rect: expected clipping to the desktop, got %v (err %v)", rects, err)
+	}
+
+	if _, err := selectionRects(DisplaySelection{}, nil); err == nil {
+		t.Error("expected error without displays")
+	}
+}
+
+func TestCombineFrames(t *testing.T) {
+	red := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	blue := image.NewRGBA(image.Rect(0, 0, 10, 5))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			red.Set(x, y, color.RGBA{255, 0, 0, 255})
+			blue.Set(x, y, color.RGBA{0, 0, 255, 255})
+		}
+	}
+	combined := combineFrames([]image.Image{red, blue})
+	if combined.Bounds() != image.Rect(0, 0, 40, 10) {
+		t.Fatalf("unexpected combined bounds: %v", combined.Bounds())
+	}
+	if r, _, _, _ := combined.At(5, 5).RGBA(); r>>8 != 255 {
+		t.Error("expected red on the left")
+	}
+	if _, _, b, _ := combined.At(35, 5).RGBA(); b>>8 != 255 {
+		t.Error("expected blue on the right")
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Sync engine state, shared by the tray and headless frontends
+var (
+	running          = false
+	syncMu           sync.Mutex
+	quitChan         chan struct{}
+	loopDone         chan struct{}
+	originalLEDState *LightState
+
+	// syncStateListeners are called after sync starts or stops so
+	// frontends can update their controls
+	syncStateListeners []*syncStateListener
+
+	statusMu    sync.Mutex
+	syncStatus  SyncStatus
+	syncMode    string
+	syncProfile string
+)
+
+// SyncStatus is a snapshot of what the sync loop is doing
+type SyncStatus struct {
+	Running     bool        `json:"running"`
+	Mode        string      `json:"mode"`
+	Profile     string      `json:"profile,omitempty"`
+	Display     string      `json:"display"`
+	Output      string      `json:"output"`
+	LastColor   *RGB        `json:"last_color,omitempty"`
+	Brightness  int         `json:"brightness"`
+	Paused      bool        `json:"paused"`
+	Crop        *CropInsets `json:"crop,omitempty"`
+	ZoneColors  []RGB       `json:"zone_colors,omitempty"`
+	LastUpdate  time.Time   `json:"last_update,omitempty"`
+	Iterations  int64       `json:"iterations"`
+	IterationMS float64     `json:"iteration_ms"`
+	LastError   string      `json:"last_error,omitempty"`
+	LastErrorAt time.Time   `json:"last_error_at,omitempty"`
+}
+
+// getStatus returns a copy of the current sync status
+func getStatus() SyncStatus {
+	syncMu.Lock()
+	isRunning := running
+	syncMu.Unlock()
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	status := syncStatus
+	status.Running = isRunning
+	status.Mode = syncMode
+	status.Profile = syncProfile
+	status.Display = getDisplaySelection().String()
+	if lightOutput != nil {
+		status.Output = lightOutput.Name()
+	}
+	return status
+}
+
+// updateStatus applies fn to the shared sync status under its lock
+func updateStatus(fn func(s *SyncStatus)) {
+	statusMu.Lock()
+	fn(&syncStatus)
+	statusMu.Unlock()
+}
+
+// recordError remembers the last error of the sync loop for the status
+func recordError(err error) {
+	updateStatus(func(s *SyncStatus) {
+		s.LastError = err.Error()
+		s.LastErrorAt = time.Now()
+	})
+}
+
+func getSyncMode() string {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	return syncMode
+}
+
+// setSyncMode switches between single color and zone mode. A running loop
+// picks the new mode up on its next iteration.
+func setSyncMode(mode string) error {
+	switch mode {
+	case ModeSingle:
+	case ModeZones:
+		if _, err := buildZoneLayout(appConfig.Env.ZONES); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown mode %q, use single or zones", mode)
+	}
+	statusMu.Lock()
+	syncMode = mode
+	statusMu.Unlock()
+	logger.Infof("Sync mode: %s", mode)
+	return nil
+}
+
+func getProfile() string {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	return syncProfile
+}
+
+// smoothingFor returns the smoothing settings of a profile, "" selects the
+// base SMOOTHING section
+func smoothingFor(profile string) SmoothingConfig {
+	if p, ok := appConfig.Env.PROFILES[profile]; ok {
+		return p
+	}
+	return appConfig.Env.SMOOTHING
+}
+
+// setProfile switches the active smoothing profile. A running loop picks the
+// new settings up on its next iteration.
+func setProfile(profile string) error {
+	if _, ok := appConfig.Env.PROFILES[profile]; profile != "" && !ok {
+		return fmt.Errorf("unknown profile %q", profile)
+	}
+	statusMu.Lock()
+	syncProfile = profile
+	statusMu.Unlock()
+	applyTransition(smoothingFor(profile))
+	if profile == "" {
+		logger.Infof("Using default smoothing")
+	} else {
+		logger.Infof("Using profile %s", profile)
+	}
+	return nil
+}
+
+// applyTransition passes the profile's fade duration to outputs that support it
+func applyTransition(cfg SmoothingConfig) {
+	if t, ok := lightOutput.(TransitionOutput); ok {
+		t.SetTransition(time.Duration(cfg.TRANSITION_MS) * time.Millisecond)
+	}
+}
+
+// startSync saves the current LED state and starts the color update loop
+func startSync() bool {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	if running {
+		return false
+	}
+	running = true
+	originalLEDState = nil
+	state, err := lightOutput.GetState()
+	if err != nil {
+		logger.Errorf("Failed to get current LED state: %v", err)
+	} else {
+		originalLEDState = state
+		logger.Infof("Saved original LED state: on=%v, color=%v, brightness=%d", state.On, state.Color, state.Brightness)
+	}
+	quitChan = make(chan struct{})
+	loopDone = make(chan struct{})
+	go colorUpdateLoop(quitChan, loopDone)
+	notifySyncState(true)
+	return true
+}
+
+// stopSync stops the color update loop, waits for it to finish and then
+// applies the configured ON_STOP action to the LED
+func stopSync() bool {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	if !running {
+		return false
+	}
+	running = false
+	close(quitChan)
+	<-loopDone
+
+	applyOnStop(lightOutput, appConfig.Env.ON_STOP, originalLEDState)
+	notifySyncState(false)
+	return true
+}
+
+// syncStateListener wraps a listener so it can be found again for removal
+type syncStateListener struct {
+	fn func(running bool)
+}
+
+// onSyncStateChange registers fn to be called whenever sync starts or stops.
+// fn runs with the sync lock held, so it must not start or stop sync itself.
+// The returned function removes fn again.
+func onSyncStateChange(fn func(running bool)) (remove func()) {
+	l := &syncStateListener{fn: fn}
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	syncStateListeners = append(syncStateListeners, l)
+	return func() {
+		syncMu.Lock()
+		defer syncMu.Unlock()
+		syncStateListeners = slices.DeleteFunc(syncStateListeners, func(other *syncStateListener) bool { return other == l })
+	}
+}
+
+func notifySyncState(running bool) {
+	for _, l := range syncStateListeners {
+		l.fn(running)
+	}
+}
+
+// applyOnStop puts the LED into the state selected by ON_STOP
+func applyOnStop(out LightOutput, action string, original *LightState) {
+	switch action {
+	case OnStopKeep:
+		logger.Infof("Leaving LED as is")
+	case OnStopOff:
+		if err := setLEDOnOff(out, false); err != nil {
+			logger.Errorf("Failed to turn off LED: %v", err)
+		}
+	default:
+		if original == nil {
+			logger.Warn("No saved LED state to restore")
+			return
+		}
+		logger.Infof("Restoring original LED state: on=%v, color=%v, brightness=%d", original.On, original.Color, original.Brightness)
+		if err := out.RestoreState(original); err != nil {
+			logger.Errorf("Failed to restore LED state: %v", err)
+		}
+	}
+}
+
+// Turn LED on or off
+func setLEDOnOff(out LightOutput, on bool) error {
+	logger.Infof("Turning LED %s", map[bool]string{true: "on", false: "off"}[on])
+	return out.SetPower(on)
+}
+
+// shutdown stops sync and releases the light output before the app exits
+func shutdown() {
+	stopSync()
+	if err := lightOutput.Close(); err != nil {
+		logger.Warnf("Failed to close %s: %v", lightOutput.Name(), err)
+	}
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// setupZones builds the zone layout when mode is "zones". It returns nil
+// zones (single color mode) if the layout is invalid or the output backend
+// cannot address segments or individual LEDs.
+func setupZones(mode string) ([]Zone, MultiColorOutput) {
+	if mode != ModeZones {
+		return nil, nil
+	}
+	zones, err := buildZoneLayout(appConfig.Env.ZONES)
+	if err != nil {
+		logger.Errorf("Invalid zone layout, using single color mode: %v", err)
+		return nil, nil
+	}
+	multiOut, ok := lightOutput.(MultiColorOutput)
+	if !ok || lightOutput.Capabilities().Segments == 0 {
+		logger.Warnf("%s cannot address segments or LEDs, using single color mode", lightOutput.Name())
+		return nil, nil
+	}
+	if segments := lightOutput.Capabilities().Segments; segments < len(zones) {
+		logger.Warnf("Zone layout has %d zones but %s only has %d LEDs", len(zones), lightOutput.Name(), segments)
+	}
+	logger.Infof("Zone mode: %d zones", len(zones))
+	return zones, multiOut
+}
+
+// outputHealth tracks whether calls to a light work, so a failing output
+// logs once when it breaks and once when it recovers instead of on every
+// iteration
+type outputHealth struct {
+	failing bool
+}
+
+// report logs changes between working and failing and returns whether the
+// call to the light called name succeeded
+func (o *outputHealth) report(name string, err error) bool {
+	if err == nil {
+		if o.failing {
+			o.failing = false
+			logger.Infof("Calls to %s work again", name)
+		}
+		return true
+	}
+	recordError(err)
+	if !o.failing {
+		o.failing = true
+		logger.Warnf("Failed to call %s: %v", name, err)
+	} else {
+		logger.Debugf("Failed to call %s: %v", name, err)
+	}
+	return false
+}
+
+func colorUpdateLoop(quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	interval := time.Duration(appConfig.Env.UPDATE_INTERVAL_MS) * time.Millisecond
+	var prevColor *RGB
+	var prevColors []RGB
+	prevBrightness := -1
+	brightnessCfg := appConfig.Env.BRIGHTNESS
+	source, err := openFrameSource(appConfig.Env.SOURCE)
+	if err != nil {
+		logger.Errorf("Failed to open frame source: %v", err)
+		recordError(err)
+		go stopSync()
+		return
+	}
+	defer source.Close()
+	if appConfig.Env.SOURCE.TYPE != "" && appConfig.Env.SOURCE.TYPE != SourceScreen {
+		logger.Infof("Reading frames from %s", source.Name())
+	}
+	var health outputHealth
+	paused := false
+	backoff := pauseMinBackoff
+	maxBackoff := time.Duration(appConfig.Env.PAUSE.MAX_BACKOFF_MS) * time.Millisecond
+	defer func() {
+		if paused {
+			setPaused(false, nil)
+		}
+	}()
+	var region *regionMask
+	if appConfig.Env.REGION.enabled() {
+		if region, err = newRegionMask(appConfig.Env.REGION); err != nil {
+			logger.Errorf("%v, sampling the whole screen", err)
+		}
+	}
+	var colorLog *colorLogWriter
+	if appConfig.Env.EXPORT_JSON {
+		if colorLog, err = newColorLogWriter(appConfig.Env.COLOR_LOG); err != nil {
+			logger.Errorf("Failed to open color log: %v", err)
+		} else {
+			defer colorLog.Close()
+		}
+	}
+	var crop *cropTracker
+	if appConfig.Env.LETTERBOX.ENABLED {
+		crop = newCropTracker(appConfig.Env.LETTERBOX)
+	}
+	colorChangeThreshold := appConfig.Env.COLOR_CHANGE_THRESHOLD
+	distance, err := colorDistanceFunc(appConfig.Env.COLOR_DISTANCE_METRIC)
+	if err != nil {
+		logger.Errorf("%v, using rgb", err)
+		distance = colorDistance
+	}
+	extractor, err := newColorExtractor(appConfig.Env.COLOR_EXTRACTOR, appConfig.Env.PALETTE_SIZE)
+	if err != nil {
+		logger.Errorf("%v, using histogram", err)
+		extractor = histogramExtractor{}
+	}
+	mode := getSyncMode()
+	zones, multiOut := setupZones(mode)
+	profile := getProfile()
+	smoother := newSmoother(smoothingFor(profile), colorChangeThreshold, distance)
+	for {
+		iterStart := time.Now()
+		if m := getSyncMode(); m != mode {
+			mode = m
+			zones, multiOut = setupZones(mode)
+			prevColor, prevColors = nil, nil
+			smoother.Reset()
+		}
+		if p := getProfile(); p != profile {
+			profile = p
+			smoother = newSmoother(smoothingFor(profile), colorChangeThreshold, distance)
+		}
+		captureStart := time.Now()
+		imgs, err := source.Next()
+		syncMetrics.capture.since(captureStart)
+		if errors.Is(err, errSourceEnded) {
+			logger.Infof("%s ended, stopping sync", source.Name())
+			// stopSync waits for this loop, so it cannot run here
+			go stopSync()
+			return
+		}
+		if err != nil {
+			// Retry with backoff instead of giving up, capture usually comes
+			// back when the monitor wakes up or the session is unlocked
+			syncMetrics.captureErrors.Add(1)
+			if !paused {
+				paused = true
+				logger.Warnf("Failed to capture frame from %s: %v, pausing sync", source.Name(), err)
+				recordError(err)
+				setPaused(true, err)
+				applyPauseAction(lightOutput, appConfig.Env.PAUSE, originalLEDState)
+			} else {
+				logger.Debugf("Capture still failing: %v, retrying in %s", err, backoff)
+			}
+			select {
+			case <-quit:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		if paused {
+			paused = false
+			backoff = pauseMinBackoff
+			logger.Infof("Capture from %s works again, resuming sync", source.Name())
+			setPaused(false, nil)
+			// Send the next color even if it matches the one before the pause
+			prevColor, prevColors, prevBrightness = nil, nil, -1
+			smoother.Reset()
+		}
+		downscaleStart := time.Now()
+		frames := make([]image.Image, len(imgs))
+		smallFrames := make([]image.Image, len(imgs))
+		for i, img := range imgs {
+			frames[i] = img
+			var sampled image.Image = img
+			if region != nil {
+				// Masked pixels drop out before downscale mixes them in
+				sampled = region.Apply(img)
+			}
+			// Downscale for fast processing
+			smallFrames[i] = downscale(sampled)
+		}
+		syncMetrics.downscale.since(downscaleStart)
+		if appConfig.Env.EXPORT_SCREENSHOT {
+			if err := saveScreenshotPNG(combineFrames(frames), "screenshot.png"); err != nil {
+				logger.Warnf("Failed to save screenshot: %v", err)
+			}
+		}
+		smallImg := combineFrames(smallFrames)
+		if crop != nil {
+			// Everything below only looks at the picture inside black bars
+			rect, changed := crop.Update(smallImg)
+			if changed {
+				insets := crop.Insets()
+				logger.Debugf("Active crop: %s", insets)
+				updateStatus(func(s *SyncStatus) { s.Crop = &insets })
+			}
+			smallImg = cropImage(smallImg, rect)
+		}
+		brightness := sceneBrightness(smallImg, brightnessCfg)
+		if brightnessCfg.MODE != BrightnessFixed {
+			logger.Debugf("Scene brightness: %d", brightness)
+		}
+		brightnessChanged := prevBrightness < 0 || absInt(brightness-prevBrightness) >= brightnessCfg.CHANGE_THRESHOLD
+		if zones != nil {
+			extractStart := time.Now()
+			extracted := zoneColors(smallImg, zones)
+			syncMetrics.extraction.since(extractStart)
+			colors := smoother.Update(extracted, iterStart)
+			logger.Debugf("Zone colors: %v", colors)
+			if prevColors == nil || brightnessChanged || maxColorDistance(colors, prevColors, distance) >= colorChangeThreshold {
+				// Only what reached the light counts as applied, so a failed
+				// call is repeated on the next iteration
+				err := syncMetrics.timeOutput(func() error { return multiOut.SetColors(colors, brightness) })
+				if health.report(lightOutput.Name(), err) {
+					prevColors = colors
+					prevBrightness = brightness
+					syncMetrics.brightness.Set(float64(brightness))
+					updateStatus(func(s *SyncStatus) {
+						s.ZoneColors = colors
+						s.LastColor = nil
+						s.Brightness = brightness
+						s.LastUpdate = time.Now()
+					})
+				}
+			} else {
+				syncMetrics.framesSkipped.Inc("")
+				logger.Debugf("Skipped %s call (zone change < threshold %.1f)", lightOutput.Name(), colorChangeThreshold)
+			}
+		} else if targets, ok := lightOutput.(*targetsOutput); ok {
+			// Every target compares with what it last applied itself
+			extractStart := time.Now()
+			roleColors := targets.RoleColors(smallImg, extractor)
+			syncMetrics.extraction.since(extractStart)
+			colors := smoother.Update(roleColors, iterStart)
+			logger.Debugf("Role colors: %v", colors)
+			targets.Update(colors, brightness)
+			dominant := colors[0]
+			syncMetrics.setColor(dominant, brightness)
+			updateStatus(func(s *SyncStatus) {
+				s.LastColor = &dominant
+				s.Brightness = brightness
+				s.ZoneColors = nil
+				s.LastUpdate = time.Now()
+			})
+		} else {
+			extractStart := time.Now()
+			mostColor := extractor.Extract(smallImg)
+			syncMetrics.extraction.since(extractStart)
+			logger.Debugf("Extracted color (%s): R:%d G:%d B:%d", extractor.Name(), mostColor.R, mostColor.G, mostColor.B)
+			mostColor = smoother.Update([]RGB{mostColor}, iterStart)[0]
+			shouldCallHA := false
+			if prevColor == nil || brightnessChanged {
+				shouldCallHA = true
+			} else {
+				dist := distance(mostColor, *prevColor)
+				if dist >= colorChangeThreshold {
+					shouldCallHA = true
+				}
+			}
+			if shouldCallHA {
+				err := syncMetrics.timeOutput(func() error { return lightOutput.SetColor(mostColor, brightness) })
+				if health.report(lightOutput.Name(), err) {
+					prevColor = &mostColor
+					prevBrightness = brightness
+					syncMetrics.setColor(mostColor, brightness)
+					updateStatus(func(s *SyncStatus) {
+						s.LastColor = &mostColor
+						s.Brightness = brightness
+						s.ZoneColors = nil
+						s.LastUpdate = time.Now()
+					})
+				}
+			} else {
+				syncMetrics.framesSkipped.Inc("")
+				logger.Debugf("Skipped %s call (color change < threshold %.1f)", lightOutput.Name(), colorChangeThreshold)
+			}
+		}
+		iterEnd := time.Now()
+		iterDuration := iterEnd.Sub(iterStart).Seconds()
+		logger.Debugf("Iteration took %.3f seconds", iterDuration)
+		updateStatus(func(s *SyncStatus) {
+			s.Iterations++
+			s.IterationMS = iterDuration * 1000
+		})
+		if colorLog != nil {
+			top := topColors(smallImg, 10)
+			if err := colorLog.Write(newLogEntry(iterEnd, smallImg.Bounds(), top, unmaskedPixels(smallImg))); err != nil {
+				logger.Warnf("Failed to log JSON: %v", err)
+			}
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// failingOutput fails the first calls and then records colors
+type failingOutput struct {
+	recordingOutput
+	mu       sync.Mutex
+	failures int
+	sent     []RGB
+}
+
+func (o *failingOutput) SetColor(c RGB, brightness int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sent = append(o.sent, c)
+	if o.failures > 0 {
+		o.failures--
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (o *failingOutput) sentColors() []RGB {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]RGB(nil), o.sent...)
+}
+
+func TestSync_RetriesFailedColor(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	frame := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			frame.Set(x, y, color.RGBA{200, 30, 30, 255})
+		}
+	}
+	openFrameSource = func(SourceConfig) (FrameSource, error) { return &imageSource{path: "test", frame: frame}, nil }
+	defer func() { openFrameSource = newFrameSource }()
+
+	cfg := defaultConfig()
+	cfg.Env.UPDATE_INTERVAL_MS = 5
+	appConfig = &cfg
+	out := &failingOutput{recordingOutput: recordingOutput{state: &LightState{On: true}}, failures: 1}
+	lightOutput = out
+	if !startSync() {
+		t.Fatal("startSync failed")
+	}
+	defer stopSync()
+
+	// The same color is sent again after the failed call, then never again
+	deadline := time.Now().Add(5 * time.Second)
+	for len(out.sentColors()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	sent := out.sentColors()
+	want := quantizeRGB(RGB{200, 30, 30}, 16)
+	if len(sent) != 2 || sent[0] != want || sent[1] != want {
+		t.Errorf("expected the color to be sent twice, got %v", sent)
+	}
+	if status := getStatus(); status.LastColor == nil || *status.LastColor != want {
+		t.Errorf("expected the applied color in the status, got %v", status.LastColor)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+)
+
+// Color extraction algorithms (COLOR_EXTRACTOR)
+const (
+	ExtractorHistogram = "histogram" // most frequent quantized color
+	ExtractorMean      = "mean"      // average color
+	ExtractorKMeans    = "kmeans"    // center of the largest k-means cluster
+	ExtractorMedianCut = "mediancut" // largest box of a median cut palette
+	ExtractorVibrant   = "vibrant"   // most vibrant swatch, like Android's Palette
+)
+
+// Default number of clusters/palette entries (PALETTE_SIZE)
+const DefaultPaletteSize = 8
+
+// ColorExtractor reduces an (already downscaled) image to one color
+type ColorExtractor interface {
+	Name() string
+	Extract(img image.Image) RGB
+}
+
+// newColorExtractor returns the extractor for a COLOR_EXTRACTOR value.
+// paletteSize is the number of clusters or palette entries for the
+// k-means, median cut and vibrant extractors.
+func newColorExtractor(name string, paletteSize int) (ColorExtractor, error) {
+	if paletteSize < 1 {
+		paletteSize = DefaultPaletteSize
+	}
+	switch name {
+	case "", ExtractorHistogram:
+		return histogramExtractor{}, nil
+	case ExtractorMean:
+		return meanExtractor{}, nil
+	case ExtractorKMeans:
+		return kmeansExtractor{k: paletteSize}, nil
+	case ExtractorMedianCut:
+		return medianCutExtractor{colors: paletteSize}, nil
+	case ExtractorVibrant:
+		return vibrantExtractor{colors: paletteSize}, nil
+	default:
+		return nil, fmt.Errorf("unknown COLOR_EXTRACTOR %q, use histogram, mean, kmeans, mediancut or vibrant", name)
+	}
+}
+
+// Weighted pixels are repeated up to this many times in imagePixels
+const pixelWeightSteps = 4
+
+// imagePixels returns all pixels of img except near-black and near-white
+// ones. If nothing is left it returns all pixels. Masked pixels are left out.
+// Only if some region weight differs from 1 are pixels repeated by their
+// weight (in quarters), so the clustering extractors honor
+// REGION.CENTER_WEIGHT without extra work on unweighted frames.
+func imagePixels(img image.Image) []RGB {
+	bounds := img.Bounds()
+	all := make([]RGB, 0, bounds.Dx()*bounds.Dy())
+	var weights []float64
+	weighted := false
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c, w := pixelWeight(img, x, y)
+			if w == 0 {
+				continue
+			}
+			all = append(all, c)
+			weights = append(weights, w)
+			weighted = weighted || w != 1
+		}
+	}
+	if weighted {
+		repeated := make([]RGB, 0, len(all)*pixelWeightSteps)
+		for i, c := range all {
+			for n := int(math.Round(weights[i] * pixelWeightSteps)); n > 0; n-- {
+				repeated = append(repeated, c)
+			}
+		}
+		all = repeated
+	}
+	filtered := make([]RGB, 0, len(all))
+	for _, c := range all {
+		if !isBlackOrWhite(c) {
+			filtered = append(filtered, c)
+		}
+	}
+	if len(filtered) == 0 {
+		return all
+	}
+	return filtered
+}
+
+// meanColor averages colors
+func meanColor(colors []RGB) RGB {
+	if len(colors) == 0 {
+		return RGB{}
+	}
+	var r, g, b int
+	for _, c := range colors {
+		r += int(c.R)
+		g += int(c.G)
+		b += int(c.B)
+	}
+	n := len(colors)
+	return RGB{uint8((r + n/2) / n), uint8((g + n/2) / n), uint8((b + n/2) / n)}
+}
+
+// histogramExtractor is the original algorithm: the most common color after
+// quantizing to steps of 16
+type histogramExtractor struct{}
+
+func (histogramExtractor) Name() string { return ExtractorHistogram }
+
+func (histogramExtractor) Extract(img image.Image) RGB {
+	return mostFrequentColor(img)
+}
+
+// meanExtractor averages all pixels that are not near-black or near-white
+type meanExtractor struct{}
+
+func (meanExtractor) Name() string { return ExtractorMean }
+
+func (meanExtractor) Extract(img image.Image) RGB {
+	return meanColor(imagePixels(img))
+}
+
+// kmeansExtractor clusters the pixels and returns the center of the largest
+// cluster
+type kmeansExtractor struct {
+	k int
+}
+
+func (e kmeansExtractor) Name() string { return ExtractorKMeans }
+
+func (e kmeansExtractor) Extract(img image.Image) RGB {
+	clusters := kmeans(imagePixels(img), e.k, 10)
+	var best paletteEntry
+	for _, c := range clusters {
+		if c.Count > best.Count {
+			best = c
+		}
+	}
+	return best.Color
+}
+
+// paletteEntry is a palette color and the number of pixels it stands for
+type paletteEntry struct {
+	Color RGB
+	Count int
+}
+
+// kmeans clusters pixels into at most k groups. The centers are seeded
+// deterministically with the farthest-point heuristic so results are stable
+// between frames.
+func kmeans(pixels []RGB, k, iterations int) []paletteEntry {
+	if len(pixels) == 0 {
+		return nil
+	}
+	centers := [][3]float64{toVec(meanColor(pixels))}
+	for len(centers) < k {
+		var farthest RGB
+		farthestDist := 0.0
+		for _, p := range pixels {
+			d := math.MaxFloat64
+			for _, c := range centers {
+				d = math.Min(d, vecDistSq(toVec(p), c))
+			}
+			if d > farthestDist {
+				farthest, farthestDist = p, d
+			}
+		}
+		if farthestDist == 0 {
+			break // fewer distinct colors than clusters
+		}
+		centers = append(centers, toVec(farthest))
+	}
+
+	assign := make([]int, len(pixels))
+	for i := range assign {
+		assign[i] = -1
+	}
+	for iter := 0; iter < iterations; iter++ {
+		changed := false
+		for i, p := range pixels {
+			v := toVec(p)
+			best, bestDist := 0, math.MaxFloat64
+			for j, c := range centers {
+				if d := vecDistSq(v, c); d < bestDist {
+					best, bestDist = j, d
+				}
+			}
+			if assign[i] != best {
+				assign[i] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		sums := make([][3]float64, len(centers))
+		counts := make([]int, len(centers))
+		for i, p := range pixels {
+			v := toVec(p)
+			for ch := range v {
+				sums[assign[i]][ch] += v[ch]
+			}
+			counts[assign[i]]++
+		}
+		for j := range centers {
+			if counts[j] > 0 {
+				for ch := range centers[j] {
+					centers[j][ch] = sums[j][ch] / float64(counts[j])
+				}
+			}
+		}
+	}
+
+	counts := make([]int, len(centers))
+	for _, a := range assign {
+		counts[a]++
+	}
+	entries := make([]paletteEntry, 0, len(centers))
+	for j, c := range centers {
+		if counts[j] > 0 {
+			entries = append(entries, paletteEntry{
+				Color: RGB{roundChannel(c[0]), roundChannel(c[1]), roundChannel(c[2])},
+				Count: counts[j],
+			})
+		}
+	}
+	return entries
+}
+
+func toVec(c RGB) [3]float64 {
+	return [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+}
+
+func vecDistSq(a, b [3]float64) float64 {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dr*dr + dg*dg + db*db
+}
+
+// medianCutExtractor builds a median cut palette and returns the entry that
+// covers the most pixels
+type medianCutExtractor struct {
+	colors int
+}
+
+func (e medianCutExtractor) Name() string { return ExtractorMedianCut }
+
+func (e medianCutExtractor) Extract(img image.Image) RGB {
+	var best paletteEntry
+	for _, c := range medianCut(imagePixels(img), e.colors) {
+		if c.Count > best.Count {
+			best = c
+		}
+	}
+	return best.Color
+}
+
+// medianCut splits the pixels into at most n boxes. Each step cuts the box
+// with the widest channel range near the median of that channel.
+func medianCut(pixels []RGB, n int) []paletteEntry {
+	if len(pixels) == 0 {
+		return nil
+	}
+	boxes := [][]RGB{append([]RGB(nil), pixels...)}
+	for len(boxes) < n {
+		split, splitRange, splitChannel := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if ch, r := widestChannel(box); r > splitRange {
+				split, splitRange, splitChannel = i, r, ch
+			}
+		}
+		if split < 0 {
+			break // every box holds a single color
+		}
+		box := boxes[split]
+		sort.Slice(box, func(i, j int) bool {
+			return channel(box[i], splitChannel) < channel(box[j], splitChannel)
+		})
+		// Cut between two different values near the median so pixels of the
+		// same color stay together
+		mid := len(box) / 2
+		v := channel(box[mid], splitChannel)
+		for mid > 0 && channel(box[mid-1], splitChannel) == v {
+			mid--
+		}
+		if mid == 0 {
+			for mid < len(box) && channel(box[mid], splitChannel) == v {
+				mid++
+			}
+		}
+		boxes[split] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+	entries := make([]paletteEntry, len(boxes))
+	for i, box := range boxes {
+		entries[i] = paletteEntry{Color: meanColor(box), Count: len(box)}
+	}
+	return entries
+}
+
+// widestChannel returns the channel (0=R, 1=G, 2=B) with the largest range
+func widestChannel(colors []RGB) (int, int) {
+	lo := [3]int{255, 255, 255}
+	hi := [3]int{}
+	for _, c := range colors {
+		for ch := 0; ch < 3; ch++ {
+			v := int(channel(c, ch))
+			if v < lo[ch] {
+				lo[ch] = v
+			}
+			if v > hi[ch] {
+				hi[ch] = v
+			}
+		}
+	}
+	best := 0
+	for ch := 1; ch < 3; ch++ {
+		if hi[ch]-lo[ch] > hi[best]-lo[best] {
+			best = ch
+		}
+	}
+	return best, hi[best] - lo[best]
+}
+
+func channel(c RGB, ch int) uint8 {
+	switch ch {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	default:
+		return c.B
+	}
+}
+
+// vibrantExtractor picks the swatch closest to a saturated, mid-lightness
+// target, weighted by how much of the screen it covers (the "Vibrant" target
+// of Android's Palette). Without a vibrant swatch it falls back to the
+// largest one.
+type vibrantExtractor struct {
+	colors int
+}
+
+func (e vibrantExtractor) Name() string { return ExtractorVibrant }
+
+// Vibrant target of Android's Palette
+const (
+	vibrantMinSaturation    = 0.35
+	vibrantTargetSaturation = 1.0
+	vibrantMinLightness     = 0.3
+	vibrantTargetLightness  = 0.5
+	vibrantMaxLightness     = 0.7
+	vibrantWeightSaturation = 0.24
+	vibrantWeightLightness  = 0.52
+	vibrantWeightPopulation = 0.24
+)
+
+func (e vibrantExtractor) Extract(img image.Image) RGB {
+	// A larger palette than the other extractors so small accents survive
+	swatches := medianCut(imagePixels(img), e.colors*2)
+	var largest paletteEntry
+	for _, s := range swatches {
+		if s.Count > largest.Count {
+			largest = s
+		}
+	}
+	var best RGB
+	bestScore := -1.0
+	for _, s := range swatches {
+		_, sat, light := rgbToHSL(s.Color)
+		if sat < vibrantMinSaturation || light < vibrantMinLightness || light > vibrantMaxLightness {
+			continue
+		}
+		score := vibrantWeightSaturation*(1-math.Abs(sat-vibrantTargetSaturation)) +
+			vibrantWeightLightness*(1-math.Abs(light-vibrantTargetLightness)) +
+			vibrantWeightPopulation*float64(s.Count)/float64(largest.Count)
+		if score > bestScore {
+			best, bestScore = s.Color, score
+		}
+	}
+	if bestScore < 0 {
+		return largest.Color
+	}
+	return best
+}
+
+// rgbToHSL returns hue (0-360), saturation and lightness (0-1)
+func rgbToHSL(c RGB) (h, s, l float64) {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	l = (max + min) / 2
+	d := max - min
+	if d == 0 {
+		return 0, 0, l
+	}
+	s = d / (1 - math.Abs(2*l-1))
+	switch max {
+	case r:
+		h = math.Mod((g-b)/d, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h, s, l
+}
+
+// hslToRGB is the inverse of rgbToHSL
+func hslToRGB(h, s, l float64) RGB {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g = c, x
+	case h < 120:
+		r, g = x, c
+	case h < 180:
+		g, b = c, x
+	case h < 240:
+		g, b = x, c
+	case h < 300:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	return RGB{roundChannel((r + m) * 255), roundChannel((g + m) * 255), roundChannel((b + m) * 255)}
+}
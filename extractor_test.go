@@ -0,0 +1,138 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// stripedImage builds a 10x10 image whose rows are filled with colors[i] for
+// rows[i] rows each
+func stripedImage(colors []RGB, rows []int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	y := 0
+	for i, c := range colors {
+		for n := 0; n < rows[i]; n++ {
+			for x := 0; x < 10; x++ {
+				img.Set(x, y, color.RGBA{c.R, c.G, c.B, 255})
+			}
+			y++
+		}
+	}
+	return img
+}
+
+func mustExtractor(t *testing.T, name string) ColorExtractor {
+	t.Helper()
+	e, err := newColorExtractor(name, 4)
+	if err != nil {
+		t.Fatalf("newColorExtractor(%q) failed: %v", name, err)
+	}
+	return e
+}
+
+func TestExtractors_SingleColor(t *testing.T) {
+	teal := RGB{0, 128, 128}
+	img := stripedImage([]RGB{teal}, []int{10})
+	for _, name := range []string{ExtractorHistogram, ExtractorMean, ExtractorKMeans, ExtractorMedianCut, ExtractorVibrant} {
+		if got := mustExtractor(t, name).Extract(img); got != teal {
+			t.Errorf("%s: expected %v, got %v", name, teal, got)
+		}
+	}
+}
+
+func TestExtractors_IgnoreBlackBars(t *testing.T) {
+	green := RGB{40, 180, 60}
+	img := stripedImage([]RGB{{0, 0, 0}, green, {0, 0, 0}}, []int{4, 2, 4})
+	for _, name := range []string{ExtractorMean, ExtractorKMeans, ExtractorMedianCut, ExtractorVibrant} {
+		if got := mustExtractor(t, name).Extract(img); got != green {
+			t.Errorf("%s: expected black bars to be ignored, got %v", name, got)
+		}
+	}
+}
+
+func TestMeanExtractor(t *testing.T) {
+	img := stripedImage([]RGB{{200, 0, 0}, {0, 0, 100}}, []int{5, 5})
+	if got := mustExtractor(t, ExtractorMean).Extract(img); got != (RGB{100, 0, 50}) {
+		t.Errorf("expected the average color, got %v", got)
+	}
+}
+
+func TestClusterExtractors_LargestGroup(t *testing.T) {
+	// Two shades of blue form the largest group, a single red stripe the smallest
+	img := stripedImage([]RGB{{20, 40, 200}, {30, 50, 210}, {220, 30, 30}}, []int{4, 3, 3})
+	for _, name := range []string{ExtractorKMeans, ExtractorMedianCut} {
+		got := mustExtractor(t, name).Extract(img)
+		if got.B < 190 || got.R > 40 {
+			t.Errorf("%s: expected the blue group, got %v", name, got)
+		}
+	}
+}
+
+func TestMedianCut_Palette(t *testing.T) {
+	pixels := []RGB{{255, 0, 0}, {255, 0, 0}, {0, 255, 0}, {0, 0, 255}}
+	palette := medianCut(pixels, 8)
+	if len(palette) != 3 {
+		t.Fatalf("expected one entry per distinct color, got %v", palette)
+	}
+	total := 0
+	for _, e := range palette {
+		total += e.Count
+		if e.Color == (RGB{255, 0, 0}) && e.Count != 2 {
+			t.Errorf("expected both red pixels in one box, got %v", palette)
+		}
+	}
+	if total != len(pixels) {
+		t.Errorf("palette counts %d pixels, expected %d", total, len(pixels))
+	}
+}
+
+func TestVibrantExtractor(t *testing.T) {
+	// A dull background dominates, the saturated accent is what you notice
+	brown, red := RGB{112, 96, 80}, RGB{220, 30, 30}
+	img := stripedImage([]RGB{brown, red}, []int{7, 3})
+	if got := mustExtractor(t, ExtractorHistogram).Extract(img); got != brown {
+		t.Errorf("histogram: expected the dull background, got %v", got)
+	}
+	if got := mustExtractor(t, ExtractorVibrant).Extract(img); got != red {
+		t.Errorf("vibrant: expected the saturated accent, got %v", got)
+	}
+
+	// Without a vibrant swatch the largest one is used
+	gray := RGB{128, 128, 128}
+	img = stripedImage([]RGB{gray, {100, 100, 100}}, []int{8, 2})
+	if got := mustExtractor(t, ExtractorVibrant).Extract(img); got != gray {
+		t.Errorf("vibrant fallback: expected %v, got %v", gray, got)
+	}
+}
+
+func TestImagePixels_Weights(t *testing.T) {
+	img := stripedImage([]RGB{{200, 50, 50}}, []int{10}).(*image.RGBA)
+	if n := len(imagePixels(img)); n != 100 {
+		t.Errorf("expected every unweighted pixel once, got %d", n)
+	}
+
+	// A masked and a half weighted pixel switch to repeating by weight
+	img.Set(0, 0, color.RGBA{})
+	img.Set(1, 0, color.RGBA{100, 25, 25, 128})
+	if n, want := len(imagePixels(img)), 98*pixelWeightSteps+pixelWeightSteps/2; n != want {
+		t.Errorf("expected %d weighted pixels, got %d", want, n)
+	}
+}
+
+func TestRGBToHSL(t *testing.T) {
+	h, s, l := rgbToHSL(RGB{255, 0, 0})
+	if h != 0 || s != 1 || l != 0.5 {
+		t.Errorf("unexpected HSL for red: %v %v %v", h, s, l)
+	}
+	h, s, _ = rgbToHSL(RGB{0, 0, 255})
+	if h != 240 || s != 1 {
+		t.Errorf("unexpected HSL for blue: %v %v", h, s)
+	}
+}
+
+func TestNewColorExtractor_Unknown(t *testing.T) {
+	if _, err := newColorExtractor("octree", 8); err == nil {
+		t.Error("expected error for unknown extractor")
+	}
+}
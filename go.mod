@@ -3,7 +3,9 @@ module github.com/aldjinn/led-screen-sync
 go 1.24.4
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.5.1
 	github.com/getlantern/systray v1.2.2
+	github.com/gorilla/websocket v1.5.3
 	github.com/kbinani/screenshot v0.0.0-20250624051815-089614a94018
 	github.com/sqweek/dialog v0.0.0-20240226140203-065105509627
 	go.uber.org/zap v1.27.1
@@ -32,5 +34,7 @@ require (
 	go.opentelemetry.io/otel/metric v1.38.0 // indirect
 	go.opentelemetry.io/otel/trace v1.38.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
+	golang.org/x/net v0.44.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 )
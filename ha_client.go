@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("Home Assistant unreachable, calls paused")
+
+// Delay before the first retry of a one-off call, doubled for each further
+// attempt
+var haRetryDelay = 250 * time.Millisecond
+
+// HAClientConfig tunes how the Home Assistant backends handle failures
+type HAClientConfig struct {
+	TIMEOUT_MS        int `yaml:"TIMEOUT_MS"`        // timeout of one request (default 5000)
+	RETRIES           int `yaml:"RETRIES"`           // extra attempts for one-off calls like reading or restoring the state (default 2)
+	FAILURE_THRESHOLD int `yaml:"FAILURE_THRESHOLD"` // consecutive failed calls that pause all calls (default 5)
+	MAX_BACKOFF_MS    int `yaml:"MAX_BACKOFF_MS"`    // longest pause between probe calls while paused (default 30000)
+}
+
+func defaultHAClientConfig() HAClientConfig {
+	return HAClientConfig{TIMEOUT_MS: 5000, RETRIES: 2, FAILURE_THRESHOLD: 5, MAX_BACKOFF_MS: 30000}
+}
+
+func (c HAClientConfig) validate() error {
+	if c.TIMEOUT_MS < 1 {
+		return fmt.Errorf("HA_CLIENT.TIMEOUT_MS must be positive, got %d", c.TIMEOUT_MS)
+	}
+	if c.RETRIES < 0 {
+		return fmt.Errorf("HA_CLIENT.RETRIES must not be negative, got %d", c.RETRIES)
+	}
+	if c.FAILURE_THRESHOLD < 1 {
+		return fmt.Errorf("HA_CLIENT.FAILURE_THRESHOLD must be at least 1, got %d", c.FAILURE_THRESHOLD)
+	}
+	if c.MAX_BACKOFF_MS < 1000 {
+		return fmt.Errorf("HA_CLIENT.MAX_BACKOFF_MS must be at least 1000, got %d", c.MAX_BACKOFF_MS)
+	}
+	return nil
+}
+
+// haStatusError is a response from Home Assistant with an error status
+type haStatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *haStatusError) Error() string { return e.Status }
+
+// haTransient reports whether err means Home Assistant is unreachable or
+// failing, as opposed to rejecting the request (4xx)
+func haTransient(err error) bool {
+	var status *haStatusError
+	if errors.As(err, &status) {
+		return status.Code >= 500
+	}
+	return err != nil && !errors.Is(err, errNoHAToken) && !errors.Is(err, errCircuitOpen)
+}
+
+// circuitBreaker stops calling Home Assistant after FAILURE_THRESHOLD
+// failed calls in a row. While open, calls fail right away. After a cooldown
+// one probe call is let through: success closes the circuit, failure doubles
+// the cooldown up to the maximum. Only changes of state are logged above
+// debug level.
+type circuitBreaker struct {
+	name        string
+	threshold   int
+	minCooldown time.Duration
+	maxCooldown time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	probing  bool
+	cooldown time.Duration
+	retryAt  time.Time
+}
+
+func newCircuitBreaker(name string, cfg HAClientConfig) *circuitBreaker {
+	return &circuitBreaker{
+		name:        name,
+		threshold:   cfg.FAILURE_THRESHOLD,
+		minCooldown: time.Second,
+		maxCooldown: time.Duration(cfg.MAX_BACKOFF_MS) * time.Millisecond,
+		now:         time.Now,
+	}
+}
+
+// call runs fn unless the circuit is open and records its result
+func (b *circuitBreaker) call(fn func() error) error {
+	b.mu.Lock()
+	if b.open {
+		if b.probing || b.now().Before(b.retryAt) {
+			b.mu.Unlock()
+			syncMetrics.haCall(errCircuitOpen)
+			return errCircuitOpen
+		}
+		b.probing = true
+	}
+	b.mu.Unlock()
+
+	err := fn()
+	syncMetrics.haCall(err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !haTransient(err) {
+		if b.open {
+			logger.Infof("%s reachable again, resuming calls", b.name)
+		}
+		b.open, b.failures, b.cooldown = false, 0, 0
+		return err
+	}
+	b.failures++
+	switch {
+	case b.open:
+		b.cooldown = min(b.cooldown*2, b.maxCooldown)
+		b.retryAt = b.now().Add(b.cooldown)
+		logger.Debugf("%s still unreachable: %v, next try in %s", b.name, err, b.cooldown)
+	case b.failures >= b.threshold:
+		b.open = true
+		b.cooldown = b.minCooldown
+		b.retryAt = b.now().Add(b.cooldown)
+		logger.Warnf("%s unreachable after %d failed calls (%v), pausing calls", b.name, b.failures, err)
+	}
+	return err
+}
+
+// haClient sends requests to the Home Assistant REST API with a timeout,
+// retries with backoff for one-off calls and a circuit breaker
+type haClient struct {
+	url     string
+	token   string
+	http    *http.Client
+	retries int
+	breaker *circuitBreaker
+}
+
+func newHAClient(url, token string, cfg HAClientConfig) *haClient {
+	return &haClient{
+		url:     url,
+		token:   token,
+		http:    &http.Client{Timeout: time.Duration(cfg.TIMEOUT_MS) * time.Millisecond},
+		retries: cfg.RETRIES,
+		breaker: newCircuitBreaker("Home Assistant at "+url, cfg),
+	}
+}
+
+// get returns the body of a GET request, retrying transient failures
+func (c *haClient) get(path string) ([]byte, error) {
+	var body []byte
+	err := c.do(true, func() error {
+		req, err := http.NewRequest("GET", c.url+path, nil)
+		if err != nil {
+			return err
+		}
+		body, err = c.send(req)
+		return err
+	})
+	return body, err
+}
+
+// post sends payload as JSON. Only one-off calls are retried; the sync loop
+// sends a fresh color on its next iteration anyway.
+func (c *haClient) post(path string, payload interface{}, retry bool) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.do(retry, func() error {
+		req, err := http.NewRequest("POST", c.url+path, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		_, err = c.send(req)
+		return err
+	})
+}
+
+func (c *haClient) do(retry bool, attempt func() error) error {
+	if c.token == "" {
+		return errNoHAToken
+	}
+	return c.breaker.call(func() error {
+		err := attempt()
+		delay := haRetryDelay
+		for i := 0; retry && i < c.retries && haTransient(err); i++ {
+			logger.Debugf("Home Assistant request failed: %v, retrying in %s", err, delay)
+			time.Sleep(delay)
+			delay *= 2
+			err = attempt()
+		}
+		return err
+	})
+}
+
+func (c *haClient) send(req *http.Request) ([]byte, error) {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, &haStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	return body, nil
+}
+
+func (c *haClient) close() {
+	c.http.CloseIdleConnections()
+}
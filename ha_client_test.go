@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	cfg := defaultHAClientConfig()
+	cfg.FAILURE_THRESHOLD = 3
+	b := newCircuitBreaker("test", cfg)
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	down := errors.New("connection refused")
+	calls := 0
+	failing := func() error { calls++; return down }
+
+	for i := 0; i < 3; i++ {
+		if err := b.call(failing); err != down {
+			t.Fatalf("call %d: expected the call's error, got %v", i, err)
+		}
+	}
+	if err := b.call(failing); err != errCircuitOpen || calls != 3 {
+		t.Fatalf("expected an open circuit without calling, got %v after %d calls", err, calls)
+	}
+
+	// The first probe after a second fails and doubles the cooldown
+	now = now.Add(time.Second)
+	if err := b.call(failing); err != down || calls != 4 {
+		t.Fatalf("expected a probe call, got %v after %d calls", err, calls)
+	}
+	now = now.Add(time.Second)
+	if err := b.call(failing); err != errCircuitOpen {
+		t.Fatalf("expected the circuit to stay open for 2s, got %v", err)
+	}
+	now = now.Add(time.Second)
+	if err := b.call(func() error { return nil }); err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	if err := b.call(failing); err != down {
+		t.Errorf("expected a closed circuit after a successful probe, got %v", err)
+	}
+}
+
+func TestCircuitBreaker_IgnoresRejectedCalls(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	cfg := defaultHAClientConfig()
+	cfg.FAILURE_THRESHOLD = 1
+	b := newCircuitBreaker("test", cfg)
+	rejected := &haStatusError{Code: 400, Status: "400 Bad Request"}
+	for i := 0; i < 3; i++ {
+		if err := b.call(func() error { return rejected }); err != rejected {
+			t.Fatalf("expected the rejection, got %v", err)
+		}
+	}
+}
+
+func TestHomeAssistantOutput_Retries(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	haRetryDelay = time.Millisecond
+	defer func() { haRetryDelay = 250 * time.Millisecond }()
+	var requests, failures atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failures.Load() > 0 {
+			failures.Add(-1)
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == "GET" {
+			w.Write([]byte(`{"state":"on","attributes":{"rgb_color":[1,2,3],"brightness":10}}`))
+		}
+	}))
+	defer srv.Close()
+	out := newHomeAssistantOutput(srv.URL, "testtoken", "light.test", defaultHAClientConfig())
+
+	// One-off calls are retried
+	failures.Store(2)
+	if _, err := out.GetState(); err != nil {
+		t.Fatalf("GetState failed despite retries: %v", err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+
+	// Color updates are not, the next iteration sends a fresh one
+	requests.Store(0)
+	failures.Store(1)
+	if err := out.SetColor(RGB{1, 2, 3}, 255); err == nil {
+		t.Error("expected SetColor to fail")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected a single request, got %d", n)
+	}
+}
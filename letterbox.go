@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// LetterboxConfig controls detection of black bars around the picture
+type LetterboxConfig struct {
+	ENABLED       bool `yaml:"ENABLED"`
+	THRESHOLD     int  `yaml:"THRESHOLD"`     // pixels with all channels at or below this count as black (default 24)
+	STABLE_FRAMES int  `yaml:"STABLE_FRAMES"` // consistent frames before the crop changes (default 10)
+}
+
+func (l LetterboxConfig) validate() error {
+	if l.THRESHOLD < 0 || l.THRESHOLD > 255 {
+		return fmt.Errorf("LETTERBOX.THRESHOLD must be between 0 and 255, got %d", l.THRESHOLD)
+	}
+	if l.STABLE_FRAMES < 1 {
+		return fmt.Errorf("LETTERBOX.STABLE_FRAMES must be at least 1, got %d", l.STABLE_FRAMES)
+	}
+	return nil
+}
+
+// CropInsets is the size of the detected bars in percent of the frame
+type CropInsets struct {
+	Top    float64 `json:"top"`
+	Bottom float64 `json:"bottom"`
+	Left   float64 `json:"left"`
+	Right  float64 `json:"right"`
+}
+
+func (c CropInsets) String() string {
+	return fmt.Sprintf("top %.1f%%, bottom %.1f%%, left %.1f%%, right %.1f%%", c.Top, c.Bottom, c.Left, c.Right)
+}
+
+// Bars never take more than this fraction of the frame on each side
+const maxBarFraction = 1.0 / 3
+
+// detectContentRect returns the part of img inside letterbox (top/bottom)
+// and pillarbox (left/right) bars. Bars are cropped symmetrically to the
+// thinner side, so subtitles inside one bar do not shift the crop. A frame
+// that is black everywhere (fade to black) returns the full bounds.
+func detectContentRect(img image.Image, threshold int) image.Rectangle {
+	b := img.Bounds()
+	isBlack := func(x, y int) bool {
+		// Pixels masked by REGION count as black
+		c, w := pixelWeight(img, x, y)
+		t := uint8(threshold)
+		return w == 0 || (c.R <= t && c.G <= t && c.B <= t)
+	}
+	blackRow := func(y int) bool {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !isBlack(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	blackCol := func(x int) bool {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			if !isBlack(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	maxRows := int(float64(b.Dy()) * maxBarFraction)
+	top, bottom := 0, 0
+	for top < maxRows && blackRow(b.Min.Y+top) {
+		top++
+	}
+	for bottom < maxRows && blackRow(b.Max.Y-1-bottom) {
+		bottom++
+	}
+	if top == maxRows && bottom == maxRows && blackRow(b.Min.Y+b.Dy()/2) {
+		return b // all black, nothing to measure
+	}
+	maxCols := int(float64(b.Dx()) * maxBarFraction)
+	left, right := 0, 0
+	for left < maxCols && blackCol(b.Min.X+left) {
+		left++
+	}
+	for right < maxCols && blackCol(b.Max.X-1-right) {
+		right++
+	}
+	rows, cols := min(top, bottom), min(left, right)
+	return image.Rect(b.Min.X+cols, b.Min.Y+rows, b.Max.X-cols, b.Max.Y-rows)
+}
+
+// cropTracker keeps the active crop stable: a new content rectangle only
+// takes over after it has been detected in enough consecutive frames
+type cropTracker struct {
+	cfg       LetterboxConfig
+	bounds    image.Rectangle
+	active    image.Rectangle
+	candidate image.Rectangle
+	seen      int
+}
+
+func newCropTracker(cfg LetterboxConfig) *cropTracker {
+	return &cropTracker{cfg: cfg}
+}
+
+// Update feeds a frame and returns the active crop and whether it changed
+func (t *cropTracker) Update(img image.Image) (image.Rectangle, bool) {
+	b := img.Bounds()
+	if b != t.bounds {
+		// New display selection or resolution, start over uncropped
+		t.bounds, t.active, t.candidate, t.seen = b, b, b, 0
+	}
+	detected := detectContentRect(img, t.cfg.THRESHOLD)
+	if detected == t.active {
+		t.seen = 0
+		return t.active, false
+	}
+	if detected != t.candidate {
+		t.candidate, t.seen = detected, 0
+	}
+	t.seen++
+	if t.seen < t.cfg.STABLE_FRAMES {
+		return t.active, false
+	}
+	t.active, t.seen = detected, 0
+	return t.active, true
+}
+
+// Insets reports the active crop in percent of the frame
+func (t *cropTracker) Insets() CropInsets {
+	w, h := float64(t.bounds.Dx()), float64(t.bounds.Dy())
+	if w == 0 || h == 0 {
+		return CropInsets{}
+	}
+	return CropInsets{
+		Top:    float64(t.active.Min.Y-t.bounds.Min.Y) / h * 100,
+		Bottom: float64(t.bounds.Max.Y-t.active.Max.Y) / h * 100,
+		Left:   float64(t.active.Min.X-t.bounds.Min.X) / w * 100,
+		Right:  float64(t.bounds.Max.X-t.active.Max.X) / w * 100,
+	}
+}
+
+// cropImage returns the part of img inside r, sharing its pixels
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	if r == img.Bounds() {
+		return img
+	}
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	return img
+}
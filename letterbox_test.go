@@ -0,0 +1,90 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// barImage is a 40x20 frame with bars of the given size around a gray picture
+func barImage(top, bottom, left, right int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.RGBA{0, 0, 0, 255}
+			if y >= top && y < 20-bottom && x >= left && x < 40-right {
+				c = color.RGBA{120, 90, 60, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestDetectContentRect(t *testing.T) {
+	cases := []struct {
+		name string
+		img  *image.RGBA
+		want image.Rectangle
+	}{
+		{"no bars", barImage(0, 0, 0, 0), image.Rect(0, 0, 40, 20)},
+		{"letterbox", barImage(3, 3, 0, 0), image.Rect(0, 3, 40, 17)},
+		{"pillarbox", barImage(0, 0, 5, 5), image.Rect(5, 0, 35, 20)},
+		{"windowbox", barImage(2, 2, 4, 4), image.Rect(4, 2, 36, 18)},
+		{"uneven bars use the thinner side", barImage(4, 2, 0, 0), image.Rect(0, 2, 40, 18)},
+	}
+	for _, tc := range cases {
+		if got := detectContentRect(tc.img, 24); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+
+	// Subtitles inside the bottom bar limit both bars to the rows below them
+	img := barImage(4, 4, 0, 0)
+	img.Set(20, 18, color.RGBA{255, 255, 255, 255})
+	if got := detectContentRect(img, 24); got != image.Rect(0, 1, 40, 19) {
+		t.Errorf("subtitle: expected the crop to stop at the subtitle line, got %v", got)
+	}
+
+	black := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	if got := detectContentRect(black, 24); got != black.Bounds() {
+		t.Errorf("black frame: expected no crop, got %v", got)
+	}
+}
+
+func TestCropTracker_Stable(t *testing.T) {
+	tracker := newCropTracker(LetterboxConfig{THRESHOLD: 24, STABLE_FRAMES: 3})
+	boxed, full := barImage(3, 3, 0, 0), barImage(0, 0, 0, 0)
+
+	if rect, changed := tracker.Update(full); changed || rect != full.Bounds() {
+		t.Fatalf("expected the full frame first, got %v %v", rect, changed)
+	}
+	for i := 0; i < 2; i++ {
+		if _, changed := tracker.Update(boxed); changed {
+			t.Fatalf("crop changed after %d frames, expected 3", i+1)
+		}
+	}
+	// A single different frame restarts the count
+	tracker.Update(full)
+	for i := 0; i < 2; i++ {
+		tracker.Update(boxed)
+	}
+	rect, changed := tracker.Update(boxed)
+	if !changed || rect != image.Rect(0, 3, 40, 17) {
+		t.Fatalf("expected the letterbox crop after 3 frames, got %v %v", rect, changed)
+	}
+	if insets := tracker.Insets(); insets.Top != 15 || insets.Bottom != 15 || insets.Left != 0 {
+		t.Errorf("unexpected insets: %+v", insets)
+	}
+}
+
+func TestCropImage(t *testing.T) {
+	img := barImage(3, 3, 0, 0)
+	cropped := cropImage(img, image.Rect(0, 3, 40, 17))
+	if cropped.Bounds() != image.Rect(0, 3, 40, 17) {
+		t.Errorf("unexpected bounds: %v", cropped.Bounds())
+	}
+	if c := mostFrequentColor(cropped); c != quantizeRGB(RGB{120, 90, 60}, 16) {
+		t.Errorf("expected the picture color, got %v", c)
+	}
+}
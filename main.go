@@ -1,25 +1,16 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"image"
 	"image/png"
-	"io"
-	"net/http"
+	"math"
 	"os"
-	"os/exec"
-	"runtime"
+	"os/signal"
 	"sort"
 	"syscall"
-	"time"
-	"unsafe"
 
-	"github.com/getlantern/systray"
-	"github.com/kbinani/screenshot"
-	"github.com/sqweek/dialog"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/image/draw"
@@ -32,67 +23,16 @@ var (
 	date    = "unknown" // Will be replaced with build date
 )
 
-// Windows API constants (for ShellExecute only)
-const (
-	SW_SHOWNORMAL = 1
-)
-
-// Windows API functions (for ShellExecute only)
 var (
-	shell32       = syscall.NewLazyDLL("shell32.dll")
-	shellExecuteW = shell32.NewProc("ShellExecuteW")
+	appConfig   *Config
+	lightOutput LightOutput
+	logger      *zap.SugaredLogger
 )
 
-// showAboutDialog displays an About dialog with version info and option to open GitHub
-func showAboutDialog() {
-	aboutText := fmt.Sprintf("LED Screen Sync\n\nVersion: %s\nCommit: %.8s\nBuilt: %s\n\nGitHub: https://github.com/aldjinn/led-screen-sync\n\nWould you like to open the GitHub repository?",
-		version, commit, date)
-
-	// Show the info dialog with Yes/No buttons
-	choice := dialog.Message("%s", aboutText).
-		Title("About LED Screen Sync").
-		YesNo()
-
-	// If user clicked Yes, open GitHub repository
-	if choice {
-		openGitHubRepo()
-	}
-}
-
-// openGitHubRepo opens the GitHub repository in the default browser
-func openGitHubRepo() {
-	url := "https://github.com/aldjinn/led-screen-sync"
-
-	if runtime.GOOS == "windows" {
-		// Use ShellExecute on Windows
-		urlPtr, _ := syscall.UTF16PtrFromString(url)
-		openPtr, _ := syscall.UTF16PtrFromString("open")
-
-		shellExecuteW.Call(
-			0,
-			uintptr(unsafe.Pointer(openPtr)),
-			uintptr(unsafe.Pointer(urlPtr)),
-			0,
-			0,
-			uintptr(SW_SHOWNORMAL),
-		)
-	} else {
-		// Fallback for other platforms
-		var cmd *exec.Cmd
-		switch runtime.GOOS {
-		case "linux":
-			cmd = exec.Command("xdg-open", url)
-		case "darwin":
-			cmd = exec.Command("open", url)
-		default:
-			return
-		}
-		cmd.Start()
-	}
-}
-
 type RGB struct {
-	R, G, B uint8
+	R uint8 `json:"r"`
+	G uint8 `json:"g"`
+	B uint8 `json:"b"`
 }
 
 // Quantize an RGB color to reduce the number of unique colors (e.g., to the nearest 16)
@@ -126,36 +66,34 @@ func downscale(img image.Image) image.Image {
 }
 
 func mostFrequentColor(img image.Image) RGB {
-	countMap := make(map[RGB]int)
+	// Pixels count by their region weight, masked pixels not at all
+	countMap := make(map[RGB]float64)
 	bounds := img.Bounds()
 	quantStep := uint8(16) // quantize to nearest 16
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			cr := uint8(r >> 8)
-			cg := uint8(g >> 8)
-			cb := uint8(b >> 8)
-			color := quantizeRGB(RGB{cr, cg, cb}, quantStep)
-			if isBlackOrWhite(color) {
+			c, w := pixelWeight(img, x, y)
+			color := quantizeRGB(c, quantStep)
+			if w == 0 || isBlackOrWhite(color) {
 				continue
 			}
-			countMap[color]++
+			countMap[color] += w
 		}
 	}
 	if len(countMap) == 0 {
 		// fallback: use all colors if nothing left after filtering
 		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				r, g, b, _ := img.At(x, y).RGBA()
-				cr := uint8(r >> 8)
-				cg := uint8(g >> 8)
-				cb := uint8(b >> 8)
-				color := quantizeRGB(RGB{cr, cg, cb}, quantStep)
-				countMap[color]++
+				c, w := pixelWeight(img, x, y)
+				if w == 0 {
+					continue
+				}
+				color := quantizeRGB(c, quantStep)
+				countMap[color] += w
 			}
 		}
 	}
-	var maxCount int
+	var maxCount float64
 	var mostColor RGB
 
 	// Find the color with the highest count
@@ -222,11 +160,11 @@ func topColors(img image.Image, topN int) []struct {
 	quantStep := uint8(16)
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			cr := uint8(r >> 8)
-			cg := uint8(g >> 8)
-			cb := uint8(b >> 8)
-			color := quantizeRGB(RGB{cr, cg, cb}, quantStep)
+			c, w := pixelWeight(img, x, y)
+			if w == 0 {
+				continue // masked by REGION
+			}
+			color := quantizeRGB(c, quantStep)
 			countMap[color]++
 			total++
 		}
@@ -260,77 +198,6 @@ func topColors(img image.Image, topN int) []struct {
 	return result
 }
 
-type ColorStat struct {
-	R       uint8   `json:"r"`
-	G       uint8   `json:"g"`
-	B       uint8   `json:"b"`
-	Name    string  `json:"name"`
-	Percent float64 `json:"percent"`
-}
-
-type LogEntry struct {
-	Timestamp  string      `json:"timestamp"`
-	ScreenSize string      `json:"screen_size"`
-	TopColors  []ColorStat `json:"top_colors"`
-}
-
-func logTopColorsJSON(filename string, bounds image.Rectangle, top []struct {
-	Color RGB
-	Count int
-}, totalPixels int) error {
-	var stats []ColorStat
-	for _, entry := range top {
-		stats = append(stats, ColorStat{
-			R:       entry.Color.R,
-			G:       entry.Color.G,
-			B:       entry.Color.B,
-			Name:    colorName(entry.Color),
-			Percent: float64(entry.Count) / float64(totalPixels) * 100,
-		})
-	}
-	logEntry := LogEntry{
-		Timestamp:  time.Now().Format(time.RFC3339),
-		ScreenSize: fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy()),
-		TopColors:  stats,
-	}
-
-	// Read existing log entries (if any)
-	var entries []LogEntry
-	if data, err := os.ReadFile(filename); err == nil && len(data) > 0 {
-		if err := json.Unmarshal(data, &entries); err != nil {
-			// If file is not a valid array, try to recover from NDJSON (old format)
-			var lines []LogEntry
-			for _, line := range bytes.Split(data, []byte{'\n'}) {
-				if len(bytes.TrimSpace(line)) == 0 {
-					continue
-				}
-				var e LogEntry
-				if err := json.Unmarshal(line, &e); err == nil {
-					lines = append(lines, e)
-				}
-			}
-			entries = lines
-		}
-	}
-	entries = append(entries, logEntry)
-
-	// Write the updated array back to file
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(entries); err != nil {
-		return err
-	}
-	if err := f.Sync(); err != nil {
-		return err
-	}
-	return nil
-}
-
 func saveScreenshotPNG(img image.Image, filename string) error {
 	f, err := os.Create(filename)
 	if err != nil {
@@ -381,118 +248,23 @@ func rgbToHSColor(c RGB) (int, int) {
 	return int(h + 0.5), int(s + 0.5)
 }
 
-// Struct for Home Assistant state response
-// Add RGBColor to attributes
-type haState struct {
-	State      string `json:"state"`
-	Attributes struct {
-		HSColor    []float64 `json:"hs_color"`
-		RGBColor   []int     `json:"rgb_color"`
-		Brightness int       `json:"brightness"`
-	} `json:"attributes"`
-}
-
-// Get current LED state from Home Assistant
-func getCurrentLEDState(token string) (*haState, error) {
-	url := appConfig.Env.HA_URL + "/api/states/" + appConfig.Env.LED_ENTITY
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("Failed to get LED state: %s", resp.Status)
-	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	var state haState
-	if err := json.Unmarshal(body, &state); err != nil {
-		return nil, err
-	}
-	return &state, nil
-}
-
-// Set LED state (rgb_color and brightness)
-func setLEDState(r, g, b, brightness int, token string) error {
-	url := appConfig.Env.HA_URL + "/api/services/light/turn_on"
-	body := fmt.Sprintf(`{"entity_id":"%s","rgb_color":[%d,%d,%d],"brightness":%d}`,
-		appConfig.Env.LED_ENTITY, r, g, b, brightness)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(body)))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("Home Assistant call failed: %s", resp.Status)
-	}
-	return nil
-}
-
-// Turn LED on or off using Home Assistant API
-func setLEDOnOff(on bool) error {
-	logger.Infof("Turning LED %s", map[bool]string{true: "on", false: "off"}[on])
-	urlPath := "/api/services/light/turn_on"
-	if !on {
-		urlPath = "/api/services/light/turn_off"
-	}
-
-	url := appConfig.Env.HA_URL + urlPath
-	body := fmt.Sprintf(`{"entity_id":"%s"}`, appConfig.Env.LED_ENTITY)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(body)))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", "Bearer "+appConfig.Env.HA_TOKEN)
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("Home Assistant on/off call failed: %s", resp.Status)
-	}
-	return nil
-}
-
-// Calculate Euclidean distance between two RGB colors
+// Calculate Euclidean distance between two RGB colors (0-441)
 func colorDistance(a, b RGB) float64 {
 	dr := int(a.R) - int(b.R)
 	dg := int(a.G) - int(b.G)
 	db := int(a.B) - int(b.B)
-	return (float64(dr*dr + dg*dg + db*db))
+	return math.Sqrt(float64(dr*dr + dg*dg + db*db))
 }
 
-var (
-	running          = false
-	quitChan         = make(chan struct{})
-	originalLEDState *haState
-	appConfig        *Config
-	logger           *zap.SugaredLogger
-)
-
 func setupLogger() {
 	cfg := zap.NewProductionConfig()
 	cfg.EncoderConfig.TimeKey = "ts"
 	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	cfg.Encoding = "console"
 	cfg.OutputPaths = []string{"stdout"}
+	if appConfig.Env.LOG_FILE != "" {
+		cfg.OutputPaths = []string{appConfig.Env.LOG_FILE}
+	}
 
 	level := zapcore.InfoLevel
 	switch appConfig.Env.LOG_LEVEL {
@@ -518,72 +290,6 @@ func setupLogger() {
 	logger = l.Sugar()
 }
 
-func onReady() {
-	systray.SetIcon(ledIcon)
-	systray.SetTitle("LED Sync")
-	systray.SetTooltip("LED Screen Sync")
-	// You can set a custom icon here with systray.SetIcon([]byte{})
-	mStart := systray.AddMenuItem("Start Sync", "Start color updates")
-	mStop := systray.AddMenuItem("Stop Sync", "Stop color updates")
-	mTurnOn := systray.AddMenuItem("Turn On", "Turn on the LED strip")
-	mTurnOff := systray.AddMenuItem("Turn Off", "Turn off the LED strip")
-	systray.AddSeparator()
-	mAbout := systray.AddMenuItem("About", "About LED Screen Sync")
-	mQuit := systray.AddMenuItem("Quit", "Quit the app")
-	mStop.Disable()
-
-	go func() {
-		for {
-			select {
-			case <-mStart.ClickedCh:
-				if !running {
-					running = true
-					mStart.Disable()
-					mStop.Enable()
-					token := os.Getenv("HA_TOKEN")
-					if token != "" {
-						state, err := getCurrentLEDState(token)
-						if err != nil {
-							logger.Errorf("Failed to get current LED state: %v", err)
-						} else {
-							originalLEDState = state
-							logger.Infof("Saved original LED state: hs_color=%v, brightness=%d", state.Attributes.HSColor, state.Attributes.Brightness)
-						}
-					}
-					go colorUpdateLoop()
-				}
-			case <-mStop.ClickedCh:
-				if running {
-					running = false
-					mStart.Enable()
-					mStop.Disable()
-					quitChan <- struct{}{}
-				}
-			case <-mTurnOn.ClickedCh:
-				go func() {
-					err := setLEDOnOff(true)
-					if err != nil {
-						logger.Errorf("Failed to turn on LED: %v", err)
-					}
-				}()
-			case <-mTurnOff.ClickedCh:
-				go func() {
-					err := setLEDOnOff(false)
-					if err != nil {
-						logger.Errorf("Failed to turn off LED: %v", err)
-					}
-				}()
-			case <-mAbout.ClickedCh:
-				go showAboutDialog()
-			case <-mQuit.ClickedCh:
-				logger.Infof("Exiting LED Sync app")
-				systray.Quit()
-				os.Exit(0)
-			}
-		}
-	}()
-}
-
 // Convert HS to RGB (Home Assistant style)
 func hsToRGB(h, s float64) (int, int, int) {
 	// h: 0-360, s: 0-100
@@ -613,69 +319,6 @@ func hsToRGB(h, s float64) (int, int, int) {
 	return int(r*255 + 0.5), int(g*255 + 0.5), int(b*255 + 0.5)
 }
 
-func colorUpdateLoop() {
-	interval := 100 * time.Millisecond
-	var prevColor *RGB
-	colorChangeThreshold := 32.0
-	for running {
-		iterStart := time.Now()
-		numDisplay := screenshot.NumActiveDisplays()
-		if numDisplay <= 0 {
-			logger.Fatal("No active display found")
-		}
-		bounds := screenshot.GetDisplayBounds(0)
-		img, err := screenshot.CaptureRect(bounds)
-		if err != nil {
-			logger.Fatalf("Failed to capture screenshot: %v", err)
-		}
-		if appConfig.Env.EXPORT_SCREENSHOT {
-			if err := saveScreenshotPNG(img, "screenshot.png"); err != nil {
-				logger.Warnf("Failed to save screenshot: %v", err)
-			}
-		}
-		// Downscale for fast processing
-		smallImg := downscale(img)
-		mostColor := mostFrequentColor(smallImg)
-		logger.Debugf("Most frequent color: R:%d G:%d B:%d", mostColor.R, mostColor.G, mostColor.B)
-		shouldCallHA := false
-		if prevColor == nil {
-			shouldCallHA = true
-		} else {
-			dist := colorDistance(mostColor, *prevColor)
-			if dist >= colorChangeThreshold {
-				shouldCallHA = true
-			}
-		}
-		token := appConfig.Env.HA_TOKEN
-		if token == "" {
-			logger.Warn("HA_TOKEN not set in config, skipping Home Assistant call.")
-		} else if shouldCallHA {
-			err := setLEDState(int(mostColor.R), int(mostColor.G), int(mostColor.B), 255, token)
-			if err != nil {
-				logger.Warnf("Failed to call Home Assistant: %v", err)
-			}
-			prevColor = &mostColor
-		} else {
-			logger.Debugf("Skipped Home Assistant call (color change < threshold %.1f)", colorChangeThreshold)
-		}
-		iterEnd := time.Now()
-		iterDuration := iterEnd.Sub(iterStart).Seconds()
-		logger.Debugf("Iteration took %.3f seconds", iterDuration)
-		if appConfig.Env.EXPORT_JSON {
-			top := topColors(smallImg, 10)
-			totalPixels := smallImg.Bounds().Dx() * smallImg.Bounds().Dy()
-			if err := logTopColorsJSON("colorlog.json", smallImg.Bounds(), top, totalPixels); err != nil {
-				logger.Warnf("Failed to log JSON: %v", err)
-			}
-		}
-		select {
-		case <-quitChan:
-			return
-		case <-time.After(interval):
-		}
-	}
-}
-
 func maskToken(token string) string {
 	if len(token) <= 8 {
 		return "********"
@@ -683,9 +326,43 @@ func maskToken(token string) string {
 	return token[:4] + "..." + token[len(token)-4:]
 }
 
+// runHeadless starts sync right away without the system tray and runs
+// until a signal arrives on sigChan
+func runHeadless(sigChan <-chan os.Signal) {
+	logger.Infof("Running headless")
+	// A directory or video source without LOOP ends the run when it is done
+	stopped := make(chan struct{}, 1)
+	if appConfig.Env.SOURCE.finite() {
+		onSyncStateChange(func(running bool) {
+			if !running {
+				select {
+				case stopped <- struct{}{}:
+				default:
+				}
+			}
+		})
+	}
+	startSync()
+	select {
+	case sig := <-sigChan:
+		logger.Infof("Received %s, exiting LED Sync app", sig)
+	case <-stopped:
+		logger.Infof("Sync stopped, exiting LED Sync app")
+	}
+	shutdown()
+}
+
 func main() {
 	// Parse command line flags
 	var showVersion = flag.Bool("v", false, "show version information")
+	var headless = flag.Bool("headless", false, "run without the system tray and start syncing right away")
+	var configPath = flag.String("config", "led-screen-sync.yaml", "path to the config file")
+	var logFile = flag.String("log-file", "", "write logs to this file instead of LOG_FILE/stdout")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [run | analyze ... | analyze-log ...]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n  run\tsame as -headless\n  analyze\tcolor analysis of image files (analyze -h for its flags)\n  analyze-log\tstatistics, export and replay of the color log (analyze-log -h for its flags)\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// Handle version flag
@@ -696,24 +373,90 @@ func main() {
 		os.Exit(0)
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "run":
+		*headless = true
+	case "analyze", "analyze-log":
+		run := runAnalyze
+		if flag.Arg(0) == "analyze-log" {
+			run = runAnalyzeLog
+		}
+		err := run(*configPath, flag.Args()[1:])
+		if err != nil && err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	var err error
-	appConfig, err = LoadConfig("led-screen-sync.yaml")
+	appConfig, err = LoadConfig(*configPath)
 	if err != nil {
-		logger.Fatalf("Failed to load config: %v", err)
+		// The logger is configured from the config, so report this one directly
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	if *logFile != "" {
+		appConfig.Env.LOG_FILE = *logFile
 	}
 	setupLogger()
 
 	logger.Infof("Starting LED Sync app")
 	logger.Infof("Version: %s, Commit: %s, Built: %s", version, commit, date)
 
-	logger.Infof("Config loaded: HA_URL=%s, LED_ENTITY=%s, EXPORT_JSON=%v, EXPORT_SCREENSHOT=%v, COLOR_CHANGE_THRESHOLD=%.2f, UPDATE_INTERVAL_MS=%d, HA_TOKEN=%s",
+	displaySelection = displaySelectionFromConfig(appConfig.Env.DISPLAY)
+	syncMode = appConfig.Env.MODE
+
+	lightOutput, err = newLightOutput(appConfig)
+	if err != nil {
+		logger.Fatalf("Failed to create light output: %v", err)
+	}
+
+	logger.Infof("Config loaded: OUTPUT=%s, MODE=%s, DISPLAY=%s, HA_URL=%s, LED_ENTITY=%s, EXPORT_JSON=%v, EXPORT_SCREENSHOT=%v, COLOR_EXTRACTOR=%s, COLOR_CHANGE_THRESHOLD=%.2f (%s), UPDATE_INTERVAL_MS=%d, ON_STOP=%s, HA_TOKEN=%s",
+		lightOutput.Name(),
+		appConfig.Env.MODE,
+		displaySelection,
 		appConfig.Env.HA_URL,
 		appConfig.Env.LED_ENTITY,
 		appConfig.Env.EXPORT_JSON,
 		appConfig.Env.EXPORT_SCREENSHOT,
+		appConfig.Env.COLOR_EXTRACTOR,
 		appConfig.Env.COLOR_CHANGE_THRESHOLD,
+		appConfig.Env.COLOR_DISTANCE_METRIC,
 		appConfig.Env.UPDATE_INTERVAL_MS,
+		appConfig.Env.ON_STOP,
 		maskToken(appConfig.Env.HA_TOKEN),
 	)
-	systray.Run(onReady, func() {})
+
+	// Stop sync and restore the LED on Ctrl+C or termination
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	setProfile(appConfig.Env.PROFILE)
+
+	if appConfig.Env.API.ENABLED {
+		srv, err := startAPIServer(appConfig.Env.API)
+		if err != nil {
+			logger.Fatalf("Failed to start control API: %v", err)
+		}
+		defer srv.Close()
+	}
+	if appConfig.Env.METRICS.ENABLED {
+		srv, err := startMetricsServer(appConfig.Env.METRICS)
+		if err != nil {
+			logger.Fatalf("Failed to start metrics endpoint: %v", err)
+		}
+		defer srv.Close()
+	}
+
+	if *headless {
+		runHeadless(sigChan)
+	} else {
+		runTray(sigChan)
+	}
 }
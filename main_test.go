@@ -27,9 +27,13 @@ func TestIsBlackOrWhite(t *testing.T) {
 
 func TestColorDistance(t *testing.T) {
 	d := colorDistance(RGB{0, 0, 0}, RGB{255, 0, 0})
-	if d != 255*255 {
+	if d != 255 {
 		t.Errorf("unexpected color distance: %v", d)
 	}
+	d = colorDistance(RGB{0, 0, 0}, RGB{255, 255, 255})
+	if d < 441 || d > MaxColorDistance {
+		t.Errorf("black to white should be the documented maximum, got %v", d)
+	}
 }
 
 func TestColorName(t *testing.T) {
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsConfig configures the optional Prometheus endpoint
+type MetricsConfig struct {
+	ENABLED bool   `yaml:"ENABLED"`
+	LISTEN  string `yaml:"LISTEN"` // bind address (default 127.0.0.1:9765)
+}
+
+// Outcomes of Home Assistant calls (led_screen_sync_ha_calls_total)
+const (
+	HAOutcomeSuccess     = "success"      // the call worked
+	HAOutcomeError       = "error"        // Home Assistant unreachable or failing (5xx, timeout)
+	HAOutcomeRejected    = "rejected"     // Home Assistant refused the call (4xx)
+	HAOutcomeCircuitOpen = "circuit_open" // not sent, calls are paused after repeated failures
+)
+
+// Upper bounds in seconds of the latency histograms
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// histogram counts observations into cumulative buckets like a Prometheus
+// histogram
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// since observes the seconds since start
+func (h *histogram) since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// counterVec is a counter per label value
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func (c *counterVec) Inc(label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	c.values[label]++
+}
+
+func (c *counterVec) Get(label string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[label]
+}
+
+// labels returns the label values counted so far, sorted
+func (c *counterVec) labels() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	labels := make([]string, 0, len(c.values))
+	for label := range c.values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// gauge holds a float64 that can be set from any goroutine
+type gauge struct{ bits atomic.Uint64 }
+
+func (g *gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+func (g *gauge) Get() float64  { return math.Float64frombits(g.bits.Load()) }
+
+// syncMetrics collects how the sync loop performs. It is recorded whether or
+// not the endpoint is enabled; recording costs a lock per observation.
+var syncMetrics = newMetrics()
+
+type metrics struct {
+	capture    *histogram
+	downscale  *histogram
+	extraction *histogram
+	output     *histogram
+
+	haCalls counterVec // by outcome
+	// by target name, "" for the single light and the zone mode, where a
+	// skipped frame means no call at all. Targets apply frames on their own,
+	// so each counts the frames it skipped.
+	framesSkipped counterVec
+	captureErrors atomic.Uint64
+
+	red, green, blue gauge
+	brightness       gauge
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		capture:    newHistogram(latencyBuckets),
+		downscale:  newHistogram(latencyBuckets),
+		extraction: newHistogram(latencyBuckets),
+		output:     newHistogram(latencyBuckets),
+	}
+}
+
+// timeOutput runs a call to a light and observes how long it took
+func (m *metrics) timeOutput(call func() error) error {
+	start := time.Now()
+	err := call()
+	m.output.since(start)
+	return err
+}
+
+// haCall counts a finished Home Assistant call by its outcome
+func (m *metrics) haCall(err error) {
+	var status *haStatusError
+	switch {
+	case err == nil:
+		m.haCalls.Inc(HAOutcomeSuccess)
+	case errors.Is(err, errCircuitOpen):
+		m.haCalls.Inc(HAOutcomeCircuitOpen)
+	case errors.As(err, &status) && status.Code < 500:
+		m.haCalls.Inc(HAOutcomeRejected)
+	default:
+		m.haCalls.Inc(HAOutcomeError)
+	}
+}
+
+// setColor records the color and brightness last sent to the light
+func (m *metrics) setColor(c RGB, brightness int) {
+	m.red.Set(float64(c.R))
+	m.green.Set(float64(c.G))
+	m.blue.Set(float64(c.B))
+	m.brightness.Set(float64(brightness))
+}
+
+// write writes all metrics in the Prometheus text format
+func (m *metrics) write(w io.Writer) {
+	writeHistogram(w, "led_screen_sync_capture_seconds", "Time to capture a frame from the source.", m.capture)
+	writeHistogram(w, "led_screen_sync_downscale_seconds", "Time to apply REGION and downscale a frame.", m.downscale)
+	writeHistogram(w, "led_screen_sync_extraction_seconds", "Time to extract the colors of a downscaled frame.", m.extraction)
+	writeHistogram(w, "led_screen_sync_output_seconds", "Time of a color update call to the light.", m.output)
+
+	fmt.Fprintf(w, "# HELP led_screen_sync_ha_calls_total Home Assistant calls by outcome.\n")
+	fmt.Fprintf(w, "# TYPE led_screen_sync_ha_calls_total counter\n")
+	m.haCalls.mu.Lock()
+	for _, outcome := range []string{HAOutcomeSuccess, HAOutcomeError, HAOutcomeRejected, HAOutcomeCircuitOpen} {
+		fmt.Fprintf(w, "led_screen_sync_ha_calls_total{outcome=%q} %d\n", outcome, m.haCalls.values[outcome])
+	}
+	m.haCalls.mu.Unlock()
+	fmt.Fprintf(w, "# HELP led_screen_sync_frames_skipped_total Frames not sent because the change was below COLOR_CHANGE_THRESHOLD, per target with TARGETS.\n")
+	fmt.Fprintf(w, "# TYPE led_screen_sync_frames_skipped_total counter\n")
+	fmt.Fprintf(w, "led_screen_sync_frames_skipped_total %d\n", m.framesSkipped.Get(""))
+	for _, target := range m.framesSkipped.labels() {
+		if target != "" {
+			fmt.Fprintf(w, "led_screen_sync_frames_skipped_total{target=%q} %d\n", target, m.framesSkipped.Get(target))
+		}
+	}
+	writeSample(w, "led_screen_sync_capture_errors_total", "Failed frame captures.", "counter", float64(m.captureErrors.Load()))
+
+	fmt.Fprintf(w, "# HELP led_screen_sync_color Channel value (0-255) of the color last sent to the light.\n")
+	fmt.Fprintf(w, "# TYPE led_screen_sync_color gauge\n")
+	fmt.Fprintf(w, "led_screen_sync_color{channel=\"r\"} %s\n", formatFloat(m.red.Get()))
+	fmt.Fprintf(w, "led_screen_sync_color{channel=\"g\"} %s\n", formatFloat(m.green.Get()))
+	fmt.Fprintf(w, "led_screen_sync_color{channel=\"b\"} %s\n", formatFloat(m.blue.Get()))
+	writeSample(w, "led_screen_sync_brightness", "Brightness (0-255) last sent to the light.", "gauge", m.brightness.Get())
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+}
+
+func writeSample(w io.Writer, name, help, typ string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatFloat(v))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func newMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var b strings.Builder
+		syncMetrics.write(&b)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		io.WriteString(w, b.String())
+	})
+}
+
+// startMetricsServer serves /metrics in the background. It returns once the
+// listener is bound so address errors surface at startup.
+func startMetricsServer(cfg MetricsConfig) (*http.Server, error) {
+	ln, err := net.Listen("tcp", cfg.LISTEN)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newMetricsHandler())
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("Metrics endpoint stopped: %v", err)
+		}
+	}()
+	logger.Infof("Metrics listening on http://%s/metrics", ln.Addr())
+	return srv, nil
+}
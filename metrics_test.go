@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func metricsText(m *metrics) string {
+	var b strings.Builder
+	m.write(&b)
+	return b.String()
+}
+
+func TestMetrics_Format(t *testing.T) {
+	m := newMetrics()
+	for _, v := range []float64{0.003, 0.02, 5} {
+		m.capture.Observe(v)
+	}
+	m.haCall(nil)
+	m.haCall(nil)
+	m.haCall(&haStatusError{Code: 401, Status: "401 Unauthorized"})
+	m.haCall(&haStatusError{Code: 502, Status: "502 Bad Gateway"})
+	m.haCall(errors.New("connection refused"))
+	m.haCall(errCircuitOpen)
+	for i := 0; i < 7; i++ {
+		m.framesSkipped.Inc("")
+	}
+	m.framesSkipped.Inc("desk")
+	m.setColor(RGB{10, 20, 30}, 128)
+
+	text := metricsText(m)
+	for _, want := range []string{
+		"# TYPE led_screen_sync_capture_seconds histogram",
+		`led_screen_sync_capture_seconds_bucket{le="0.0025"} 0`,
+		`led_screen_sync_capture_seconds_bucket{le="0.005"} 1`,
+		`led_screen_sync_capture_seconds_bucket{le="0.025"} 2`,
+		`led_screen_sync_capture_seconds_bucket{le="2.5"} 2`,
+		`led_screen_sync_capture_seconds_bucket{le="+Inf"} 3`,
+		"led_screen_sync_capture_seconds_sum 5.023",
+		"led_screen_sync_capture_seconds_count 3",
+		"led_screen_sync_output_seconds_count 0",
+		`led_screen_sync_ha_calls_total{outcome="success"} 2`,
+		`led_screen_sync_ha_calls_total{outcome="error"} 2`,
+		`led_screen_sync_ha_calls_total{outcome="rejected"} 1`,
+		`led_screen_sync_ha_calls_total{outcome="circuit_open"} 1`,
+		"led_screen_sync_frames_skipped_total 7",
+		`led_screen_sync_frames_skipped_total{target="desk"} 1`,
+		"led_screen_sync_capture_errors_total 0",
+		`led_screen_sync_color{channel="g"} 20`,
+		"led_screen_sync_brightness 128",
+	} {
+		if !strings.Contains(text, want+"\n") {
+			t.Errorf("expected %q in:\n%s", want, text)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newMetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "led_screen_sync_extraction_seconds_bucket") {
+		t.Errorf("expected the histograms in the body:\n%s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	newMetricsHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestSync_Metrics(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	frame := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			frame.Set(x, y, color.RGBA{200, 30, 30, 255})
+		}
+	}
+	openFrameSource = func(SourceConfig) (FrameSource, error) { return &imageSource{path: "test", frame: frame}, nil }
+	defer func() { openFrameSource = newFrameSource }()
+	saved := syncMetrics
+	syncMetrics = newMetrics()
+	defer func() { syncMetrics = saved }()
+
+	cfg := defaultConfig()
+	cfg.Env.UPDATE_INTERVAL_MS = 5
+	appConfig = &cfg
+	out := &failingOutput{recordingOutput: recordingOutput{state: &LightState{On: true}}}
+	lightOutput = out
+	if !startSync() {
+		t.Fatal("startSync failed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for syncMetrics.framesSkipped.Get("") < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stopSync()
+
+	// The same frame is sent once, every later iteration is skipped
+	m := syncMetrics
+	if m.output.count != 1 || m.framesSkipped.Get("") < 3 {
+		t.Errorf("expected 1 output call and skipped frames, got %d and %d", m.output.count, m.framesSkipped.Get(""))
+	}
+	if m.capture.count < 4 || m.downscale.count != m.capture.count || m.extraction.count != m.capture.count {
+		t.Errorf("expected every stage timed once per frame, got capture %d, downscale %d, extraction %d",
+			m.capture.count, m.downscale.count, m.extraction.count)
+	}
+	want := quantizeRGB(RGB{200, 30, 30}, 16)
+	if m.red.Get() != float64(want.R) || m.blue.Get() != float64(want.B) || m.brightness.Get() != float64(cfg.Env.BRIGHTNESS.MAX) {
+		t.Errorf("expected the sent color in the gauges, got %v %v %v @%v", m.red.Get(), m.green.Get(), m.blue.Get(), m.brightness.Get())
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Supported OUTPUT.TYPE values
+const (
+	OutputHomeAssistant   = "homeassistant"
+	OutputHomeAssistantWS = "homeassistant_ws"
+	OutputWLED            = "wled"
+	OutputMQTT            = "mqtt"
+)
+
+// Capabilities describes what a light output backend can do
+type Capabilities struct {
+	Color      bool // accepts RGB colors
+	Brightness bool // accepts a separate brightness value
+	Segments   int  // number of individually addressable segments/LEDs (0 = single color only)
+}
+
+// LightState is a snapshot of a light, used to restore it when sync stops
+type LightState struct {
+	On         bool
+	Color      RGB
+	Brightness int
+	// raw holds the backend specific state needed for an exact restore
+	raw interface{}
+}
+
+// LightOutput is implemented by every backend that can drive a light
+type LightOutput interface {
+	// Name returns a short human readable description for logs
+	Name() string
+	// Capabilities reports what the backend supports
+	Capabilities() Capabilities
+	// GetState returns the current state of the light
+	GetState() (*LightState, error)
+	// SetColor turns the light on with the given color and brightness (0-255)
+	SetColor(c RGB, brightness int) error
+	// SetPower turns the light on or off
+	SetPower(on bool) error
+	// RestoreState puts the light back into a state returned by GetState
+	RestoreState(state *LightState) error
+	// Close releases any connection held by the backend
+	Close() error
+}
+
+// MultiColorOutput is implemented by backends that can address segments or
+// individual LEDs, used by the zone mode
+type MultiColorOutput interface {
+	LightOutput
+	// SetColors sends one color per segment/LED, in LED order
+	SetColors(colors []RGB, brightness int) error
+}
+
+// TransitionOutput is implemented by backends that can fade between colors
+// on the device itself
+type TransitionOutput interface {
+	// SetTransition sets the fade duration used by following SetColor calls
+	SetTransition(d time.Duration)
+}
+
+// deviceTransition implements TransitionOutput for backends that send the
+// fade duration with every color command. The engine sets it while the loop
+// runs, so it is stored atomically in milliseconds.
+type deviceTransition struct {
+	ms atomic.Int64
+}
+
+func (t *deviceTransition) SetTransition(d time.Duration) {
+	t.ms.Store(d.Milliseconds())
+}
+
+// transitionMS returns the fade duration in milliseconds, 0 for none
+func (t *deviceTransition) transitionMS() int64 {
+	return t.ms.Load()
+}
+
+// newLightOutput creates the backend selected by OUTPUT.TYPE, or one per
+// entry of TARGETS
+func newLightOutput(cfg *Config) (LightOutput, error) {
+	if len(cfg.Env.TARGETS) > 0 {
+		return newTargetsOutput(cfg)
+	}
+	switch strings.ToLower(cfg.Env.OUTPUT.TYPE) {
+	case "", OutputHomeAssistant:
+		return newHomeAssistantOutput(cfg.Env.HA_URL, cfg.Env.HA_TOKEN, cfg.Env.LED_ENTITY, cfg.Env.HA_CLIENT), nil
+	case OutputHomeAssistantWS:
+		return newHomeAssistantWSOutput(cfg.Env.HA_URL, cfg.Env.HA_TOKEN, cfg.Env.LED_ENTITY, cfg.Env.HA_CLIENT), nil
+	case OutputWLED:
+		return newWLEDOutput(cfg.Env.OUTPUT.WLED)
+	case OutputMQTT:
+		return newMQTTOutput(cfg.Env.OUTPUT.MQTT)
+	default:
+		return nil, fmt.Errorf("unknown OUTPUT.TYPE %q", cfg.Env.OUTPUT.TYPE)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+var errNoHAToken = errors.New("HA_TOKEN not set in config")
+
+// Struct for Home Assistant state response
+type haState struct {
+	State      string `json:"state"`
+	Attributes struct {
+		ColorMode           string    `json:"color_mode"`
+		SupportedColorModes []string  `json:"supported_color_modes"`
+		HSColor             []float64 `json:"hs_color"`
+		RGBColor            []int     `json:"rgb_color"`
+		RGBWColor           []int     `json:"rgbw_color"`
+		RGBWWColor          []int     `json:"rgbww_color"`
+		XYColor             []float64 `json:"xy_color"`
+		ColorTemp           int       `json:"color_temp"`
+		ColorTempKelvin     int       `json:"color_temp_kelvin"`
+		MinColorTempKelvin  int       `json:"min_color_temp_kelvin"`
+		MaxColorTempKelvin  int       `json:"max_color_temp_kelvin"`
+		Brightness          int       `json:"brightness"`
+	} `json:"attributes"`
+}
+
+// Home Assistant color modes (supported_color_modes)
+const (
+	haModeRGB       = "rgb"
+	haModeRGBW      = "rgbw"
+	haModeRGBWW     = "rgbww"
+	haModeHS        = "hs"
+	haModeXY        = "xy"
+	haModeColorTemp = "color_temp"
+)
+
+// Colors with a lower HS saturation (0-100) count as white and are sent as
+// color_temp when the light supports it
+const haWhiteSaturation = 15
+
+// haColorCaps is what a light accepts, read from its state attributes
+type haColorCaps struct {
+	Modes     []string
+	MinKelvin int
+	MaxKelvin int
+}
+
+func (c *haColorCaps) supports(mode string) bool {
+	if c == nil {
+		return false
+	}
+	for _, m := range c.Modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// homeAssistantOutput drives a light entity through the Home Assistant REST API
+type homeAssistantOutput struct {
+	entity string
+	client *haClient
+	deviceTransition
+	// color modes of the light, nil until its state has been read
+	colorCaps atomic.Pointer[haColorCaps]
+}
+
+func newHomeAssistantOutput(url, token, entity string, cfg HAClientConfig) *homeAssistantOutput {
+	return &homeAssistantOutput{
+		entity: entity,
+		client: newHAClient(url, token, cfg),
+	}
+}
+
+func (h *homeAssistantOutput) Name() string {
+	return "Home Assistant " + h.entity
+}
+
+func (h *homeAssistantOutput) Capabilities() Capabilities {
+	return Capabilities{Color: true, Brightness: true}
+}
+
+// Get current LED state from Home Assistant
+func (h *homeAssistantOutput) GetState() (*LightState, error) {
+	body, err := h.client.get("/api/states/" + h.entity)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get LED state: %w", err)
+	}
+	var state haState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return nil, err
+	}
+	if caps := state.colorCaps(); caps != nil {
+		h.colorCaps.Store(caps)
+	}
+	return state.lightState(), nil
+}
+
+// Set LED state (rgb_color, brightness and optional transition)
+func (h *homeAssistantOutput) SetColor(c RGB, brightness int) error {
+	return h.callService("turn_on", colorPayload(c, brightness, h.colorCaps.Load(), h.transitionMS()), false)
+}
+
+// Turn LED on or off using Home Assistant API
+func (h *homeAssistantOutput) SetPower(on bool) error {
+	if on {
+		return h.callService("turn_on", nil, true)
+	}
+	return h.callService("turn_off", nil, true)
+}
+
+// Restore a previously saved LED state (on/off, color mode and brightness)
+func (h *homeAssistantOutput) RestoreState(state *LightState) error {
+	saved, ok := state.raw.(*haState)
+	if !ok {
+		if !state.On {
+			return h.SetPower(false)
+		}
+		return h.SetColor(state.Color, state.Brightness)
+	}
+	service, payload := saved.restoreCall()
+	return h.callService(service, payload, true)
+}
+
+func (h *homeAssistantOutput) Close() error {
+	h.client.close()
+	return nil
+}
+
+// callService calls light.<service> for the configured entity. retry is set
+// for one-off calls, color updates are not retried.
+func (h *homeAssistantOutput) callService(service string, payload map[string]interface{}, retry bool) error {
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	payload["entity_id"] = h.entity
+	if err := h.client.post("/api/services/light/"+service, payload, retry); err != nil {
+		return fmt.Errorf("Home Assistant %s call failed: %w", service, err)
+	}
+	return nil
+}
+
+// colorPayload builds the light.turn_on data for a color in a mode the light
+// supports. Without known caps it sends rgb_color. transitionMS <= 0 leaves
+// the fade to the light's default.
+func colorPayload(c RGB, brightness int, caps *haColorCaps, transitionMS int64) map[string]interface{} {
+	payload := map[string]interface{}{"brightness": brightness}
+	if transitionMS > 0 {
+		payload["transition"] = float64(transitionMS) / 1000
+	}
+	if c == (RGB{}) {
+		// Black has no hue and hs_color [0, 0] would be white, so the light
+		// keeps its color and only dims to the brightness
+		return payload
+	}
+	h, s := rgbToHSColor(c)
+	white := s < haWhiteSaturation
+	switch {
+	case caps == nil || caps.supports(haModeRGB) && !(white && caps.supports(haModeColorTemp)):
+		payload["rgb_color"] = []int{int(c.R), int(c.G), int(c.B)}
+	case caps.supports(haModeRGBWW):
+		// The white channels render whites better than color_temp would
+		ww := rgbToRGBWW(c, caps.MinKelvin, caps.MaxKelvin)
+		payload["rgbww_color"] = ww[:]
+	case caps.supports(haModeRGBW):
+		w := rgbToRGBW(c)
+		payload["rgbw_color"] = w[:]
+	case caps.supports(haModeColorTemp) && (white || !caps.supports(haModeHS) && !caps.supports(haModeXY)):
+		payload["color_temp_kelvin"] = caps.clampKelvin(xyToKelvin(rgbToXY(c)))
+	case caps.supports(haModeHS):
+		payload["hs_color"] = []int{h, s}
+	case caps.supports(haModeXY):
+		x, y := rgbToXY(c)
+		payload["xy_color"] = []float64{math.Round(x*10000) / 10000, math.Round(y*10000) / 10000}
+	}
+	// brightness or onoff only lights get no color at all
+	return payload
+}
+
+// clampKelvin limits a color temperature to the light's range
+func (c *haColorCaps) clampKelvin(kelvin float64) int {
+	k := int(math.Round(kelvin))
+	if c.MinKelvin > 0 && k < c.MinKelvin {
+		k = c.MinKelvin
+	}
+	if c.MaxKelvin > 0 && k > c.MaxKelvin {
+		k = c.MaxKelvin
+	}
+	return k
+}
+
+// colorCaps returns the color modes and color temperature range of the
+// light, nil if the state does not list supported_color_modes
+func (s *haState) colorCaps() *haColorCaps {
+	if len(s.Attributes.SupportedColorModes) == 0 {
+		return nil
+	}
+	return &haColorCaps{
+		Modes:     s.Attributes.SupportedColorModes,
+		MinKelvin: s.Attributes.MinColorTempKelvin,
+		MaxKelvin: s.Attributes.MaxColorTempKelvin,
+	}
+}
+
+// restoreCall returns the light service and data that put the light back
+// into this state (on/off, color mode and brightness)
+func (s *haState) restoreCall() (string, map[string]interface{}) {
+	if s.State != "on" {
+		return "turn_off", nil
+	}
+	attrs := s.Attributes
+	payload := map[string]interface{}{}
+	switch {
+	case attrs.ColorMode == "color_temp" && attrs.ColorTempKelvin > 0:
+		payload["color_temp_kelvin"] = attrs.ColorTempKelvin
+	case attrs.ColorMode == "color_temp" && attrs.ColorTemp > 0:
+		payload["color_temp"] = attrs.ColorTemp
+	case attrs.ColorMode == "hs" && len(attrs.HSColor) == 2:
+		payload["hs_color"] = attrs.HSColor
+	case attrs.ColorMode == "xy" && len(attrs.XYColor) == 2:
+		payload["xy_color"] = attrs.XYColor
+	case attrs.ColorMode == "rgbw" && len(attrs.RGBWColor) == 4:
+		payload["rgbw_color"] = attrs.RGBWColor
+	case attrs.ColorMode == "rgbww" && len(attrs.RGBWWColor) == 5:
+		payload["rgbww_color"] = attrs.RGBWWColor
+	case len(attrs.RGBColor) == 3:
+		payload["rgb_color"] = attrs.RGBColor
+	case len(attrs.HSColor) == 2:
+		payload["hs_color"] = attrs.HSColor
+	}
+	if attrs.Brightness > 0 {
+		payload["brightness"] = attrs.Brightness
+	}
+	return "turn_on", payload
+}
+
+// lightState converts a Home Assistant state into a LightState
+func (s *haState) lightState() *LightState {
+	state := &LightState{
+		On:         s.State == "on",
+		Brightness: s.Attributes.Brightness,
+		raw:        s,
+	}
+	if len(s.Attributes.RGBColor) == 3 {
+		state.Color = RGB{uint8(s.Attributes.RGBColor[0]), uint8(s.Attributes.RGBColor[1]), uint8(s.Attributes.RGBColor[2])}
+	} else if len(s.Attributes.HSColor) == 2 {
+		r, g, b := hsToRGB(s.Attributes.HSColor[0], s.Attributes.HSColor[1])
+		state.Color = RGB{uint8(r), uint8(g), uint8(b)}
+	}
+	return state
+}
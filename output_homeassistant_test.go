@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHomeAssistantOutput_SetColor(t *testing.T) {
+	var gotPath, gotAuth string
+	var gotBody map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&gotBody)
+	}))
+	defer srv.Close()
+
+	out := newHomeAssistantOutput(srv.URL, "testtoken", "light.test", defaultHAClientConfig())
+	if err := out.SetColor(RGB{10, 20, 30}, 200); err != nil {
+		t.Fatalf("SetColor failed: %v", err)
+	}
+	if gotPath != "/api/services/light/turn_on" {
+		t.Errorf("unexpected service path: %s", gotPath)
+	}
+	if gotAuth != "Bearer testtoken" {
+		t.Errorf("unexpected auth header: %s", gotAuth)
+	}
+	if gotBody["entity_id"] != "light.test" || gotBody["brightness"] != float64(200) {
+		t.Errorf("unexpected body: %v", gotBody)
+	}
+}
+
+func TestHomeAssistantOutput_Transition(t *testing.T) {
+	var gotBody map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody = nil
+		json.NewDecoder(r.Body).Decode(&gotBody)
+	}))
+	defer srv.Close()
+
+	out := newHomeAssistantOutput(srv.URL, "testtoken", "light.test", defaultHAClientConfig())
+	out.SetTransition(400 * time.Millisecond)
+	if err := out.SetColor(RGB{10, 20, 30}, 200); err != nil {
+		t.Fatalf("SetColor failed: %v", err)
+	}
+	if gotBody["transition"] != 0.4 {
+		t.Errorf("expected transition 0.4s, got %v", gotBody["transition"])
+	}
+
+	out.SetTransition(0)
+	if err := out.SetColor(RGB{10, 20, 30}, 200); err != nil {
+		t.Fatalf("SetColor failed: %v", err)
+	}
+	if _, ok := gotBody["transition"]; ok {
+		t.Errorf("expected no transition, got %v", gotBody)
+	}
+}
+
+func TestHomeAssistantOutput_NoToken(t *testing.T) {
+	out := newHomeAssistantOutput("http://localhost:1", "", "light.test", defaultHAClientConfig())
+	if err := out.SetColor(RGB{1, 2, 3}, 255); !errors.Is(err, errNoHAToken) {
+		t.Errorf("expected errNoHAToken, got %v", err)
+	}
+}
+
+func TestHomeAssistantOutput_RestoreState(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(`{"state":"on","attributes":{"color_mode":"color_temp","color_temp_kelvin":2700,"rgb_color":[255,167,87],"brightness":120}}`))
+			return
+		}
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&gotBody)
+	}))
+	defer srv.Close()
+
+	out := newHomeAssistantOutput(srv.URL, "testtoken", "light.test", defaultHAClientConfig())
+	state, err := out.GetState()
+	if err != nil {
+		t.Fatalf("GetState failed: %v", err)
+	}
+	if !state.On || state.Brightness != 120 || state.Color != (RGB{255, 167, 87}) {
+		t.Errorf("unexpected state: %+v", state)
+	}
+	if err := out.RestoreState(state); err != nil {
+		t.Fatalf("RestoreState failed: %v", err)
+	}
+	if gotPath != "/api/services/light/turn_on" {
+		t.Errorf("unexpected service path: %s", gotPath)
+	}
+	if gotBody["color_temp_kelvin"] != float64(2700) || gotBody["brightness"] != float64(120) {
+		t.Errorf("unexpected restore body: %v", gotBody)
+	}
+	if _, ok := gotBody["rgb_color"]; ok {
+		t.Errorf("rgb_color should not be sent in color_temp mode: %v", gotBody)
+	}
+
+	if err := out.RestoreState(&LightState{On: false}); err != nil {
+		t.Fatalf("RestoreState failed: %v", err)
+	}
+	if gotPath != "/api/services/light/turn_off" {
+		t.Errorf("expected turn_off for a light that was off, got %s", gotPath)
+	}
+}
+
+func TestColorPayload_SupportedModes(t *testing.T) {
+	red, white := RGB{255, 0, 0}, RGB{250, 245, 240}
+	cases := []struct {
+		name  string
+		c     RGB
+		caps  *haColorCaps
+		field string
+	}{
+		{"unknown caps", red, nil, "rgb_color"},
+		{"rgb", red, &haColorCaps{Modes: []string{"rgb"}}, "rgb_color"},
+		{"rgb white without color_temp", white, &haColorCaps{Modes: []string{"rgb"}}, "rgb_color"},
+		{"rgb white with color_temp", white, &haColorCaps{Modes: []string{"color_temp", "rgb"}}, "color_temp_kelvin"},
+		{"hs", red, &haColorCaps{Modes: []string{"color_temp", "hs"}}, "hs_color"},
+		{"hs white", white, &haColorCaps{Modes: []string{"color_temp", "hs"}}, "color_temp_kelvin"},
+		{"xy", red, &haColorCaps{Modes: []string{"xy"}}, "xy_color"},
+		{"rgbw", red, &haColorCaps{Modes: []string{"rgbw"}}, "rgbw_color"},
+		{"rgbww white", white, &haColorCaps{Modes: []string{"color_temp", "rgbww"}}, "rgbww_color"},
+		{"color_temp only", red, &haColorCaps{Modes: []string{"color_temp"}}, "color_temp_kelvin"},
+	}
+	colorFields := []string{"rgb_color", "hs_color", "xy_color", "rgbw_color", "rgbww_color", "color_temp_kelvin"}
+	for _, tc := range cases {
+		payload := colorPayload(tc.c, 128, tc.caps, 0)
+		for _, f := range colorFields {
+			if _, ok := payload[f]; ok != (f == tc.field) {
+				t.Errorf("%s: expected only %s, got %v", tc.name, tc.field, payload)
+				break
+			}
+		}
+		if payload["brightness"] != 128 {
+			t.Errorf("%s: expected brightness, got %v", tc.name, payload)
+		}
+	}
+
+	payload := colorPayload(RGB{10, 20, 30}, 10, &haColorCaps{Modes: []string{"brightness"}}, 0)
+	if len(payload) != 1 || payload["brightness"] != 10 {
+		t.Errorf("expected brightness only, got %v", payload)
+	}
+	// Black on an hs light must not become hs_color [0, 0], which is white
+	for _, caps := range []*haColorCaps{nil, {Modes: []string{"hs"}}, {Modes: []string{"color_temp", "xy"}}} {
+		payload = colorPayload(RGB{}, 10, caps, 0)
+		if len(payload) != 1 || payload["brightness"] != 10 {
+			t.Errorf("expected black to send brightness only, got %v", payload)
+		}
+	}
+	payload = colorPayload(RGB{255, 120, 40}, 255, &haColorCaps{Modes: []string{"color_temp"}, MinKelvin: 2700, MaxKelvin: 6500}, 0)
+	if k := payload["color_temp_kelvin"]; k != 2700 {
+		t.Errorf("expected kelvin clamped to the light's range, got %v", k)
+	}
+}
+
+func TestHomeAssistantOutput_UsesSupportedColorModes(t *testing.T) {
+	var gotBody map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(`{"state":"on","attributes":{"color_mode":"hs","supported_color_modes":["hs"],"hs_color":[30,50],"brightness":100}}`))
+			return
+		}
+		gotBody = nil
+		json.NewDecoder(r.Body).Decode(&gotBody)
+	}))
+	defer srv.Close()
+
+	out := newHomeAssistantOutput(srv.URL, "testtoken", "light.test", defaultHAClientConfig())
+	if _, err := out.GetState(); err != nil {
+		t.Fatalf("GetState failed: %v", err)
+	}
+	if err := out.SetColor(RGB{0, 0, 255}, 200); err != nil {
+		t.Fatalf("SetColor failed: %v", err)
+	}
+	hs, ok := gotBody["hs_color"].([]interface{})
+	if !ok || hs[0] != float64(240) || hs[1] != float64(100) || gotBody["rgb_color"] != nil {
+		t.Errorf("expected hs_color for an hs-only light, got %v", gotBody)
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reconnect backoff of the WebSocket backend
+const (
+	haWSMinBackoff = time.Second
+	haWSMaxBackoff = 30 * time.Second
+)
+
+var (
+	errHAWSNotConnected = errors.New("not connected to the Home Assistant WebSocket API")
+	errHAWSClosed       = errors.New("Home Assistant WebSocket output closed")
+)
+
+// haWSMessage is any message received from /api/websocket
+type haWSMessage struct {
+	ID      int             `json:"id"`
+	Type    string          `json:"type"`
+	Success bool            `json:"success"`
+	Result  json.RawMessage `json:"result"`
+	Error   *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Event *struct {
+		Variables struct {
+			Trigger struct {
+				EntityID string         `json:"entity_id"`
+				ToState  *haEntityState `json:"to_state"`
+			} `json:"trigger"`
+		} `json:"variables"`
+	} `json:"event"`
+}
+
+// haEntityState is a state as listed by get_states and state trigger events
+type haEntityState struct {
+	EntityID string `json:"entity_id"`
+	haState
+}
+
+// homeAssistantWSOutput drives a light entity over one persistent connection
+// to the Home Assistant WebSocket API. It authenticates once, sends
+// call_service messages on the open socket, keeps the entity state up to date
+// through a state trigger subscription for the entity and reconnects with
+// backoff.
+type homeAssistantWSOutput struct {
+	wsURL   string
+	token   string
+	entity  string
+	timeout time.Duration
+	dialer  *websocket.Dialer
+	breaker *circuitBreaker
+	deviceTransition
+	// color modes of the light, nil until its state has been seen
+	colorCaps atomic.Pointer[haColorCaps]
+
+	// Reconnect delays, doubled after every failed attempt
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	done      chan struct{}
+	running   sync.WaitGroup
+	writeMu   sync.Mutex
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	ready   chan struct{} // closed while connected
+	nextID  int
+	pending map[int]chan haWSMessage
+	state   *haState // last state seen for the entity, nil if unknown
+}
+
+func newHomeAssistantWSOutput(url, token, entity string, cfg HAClientConfig) *homeAssistantWSOutput {
+	return &homeAssistantWSOutput{
+		wsURL:      haWebSocketURL(url),
+		token:      token,
+		entity:     entity,
+		timeout:    time.Duration(cfg.TIMEOUT_MS) * time.Millisecond,
+		breaker:    newCircuitBreaker("Home Assistant WebSocket API at "+url, cfg),
+		dialer:     &websocket.Dialer{HandshakeTimeout: 10 * time.Second, Proxy: http.ProxyFromEnvironment},
+		minBackoff: haWSMinBackoff,
+		maxBackoff: haWSMaxBackoff,
+		done:       make(chan struct{}),
+		ready:      make(chan struct{}),
+		pending:    make(map[int]chan haWSMessage),
+	}
+}
+
+// haWebSocketURL turns HA_URL (http/https) into the WebSocket API URL
+func haWebSocketURL(url string) string {
+	url = strings.TrimSuffix(url, "/")
+	switch {
+	case strings.HasPrefix(url, "https://"):
+		url = "wss://" + strings.TrimPrefix(url, "https://")
+	case strings.HasPrefix(url, "http://"):
+		url = "ws://" + strings.TrimPrefix(url, "http://")
+	}
+	return url + "/api/websocket"
+}
+
+func (h *homeAssistantWSOutput) Name() string {
+	return "Home Assistant (WebSocket) " + h.entity
+}
+
+func (h *homeAssistantWSOutput) Capabilities() Capabilities {
+	return Capabilities{Color: true, Brightness: true}
+}
+
+// GetState returns the state from the subscription, or asks Home Assistant
+// if no state event has been seen yet
+func (h *homeAssistantWSOutput) GetState() (*LightState, error) {
+	if err := h.waitReady(); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	cached := h.state
+	h.mu.Unlock()
+	if cached != nil {
+		state := *cached
+		return state.lightState(), nil
+	}
+
+	var res haWSMessage
+	err := h.breaker.call(func() error {
+		var err error
+		res, err = h.request(map[string]interface{}{"type": "get_states"})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var states []haEntityState
+	if err := json.Unmarshal(res.Result, &states); err != nil {
+		return nil, err
+	}
+	for i := range states {
+		if states[i].EntityID == h.entity {
+			h.mu.Lock()
+			if h.state == nil {
+				h.state = &states[i].haState
+			}
+			h.mu.Unlock()
+			if caps := states[i].colorCaps(); caps != nil {
+				h.colorCaps.Store(caps)
+			}
+			return states[i].haState.lightState(), nil
+		}
+	}
+	return nil, fmt.Errorf("entity %s not found in Home Assistant", h.entity)
+}
+
+func (h *homeAssistantWSOutput) SetColor(c RGB, brightness int) error {
+	return h.callService("turn_on", colorPayload(c, brightness, h.colorCaps.Load(), h.transitionMS()))
+}
+
+func (h *homeAssistantWSOutput) SetPower(on bool) error {
+	if on {
+		return h.callService("turn_on", nil)
+	}
+	return h.callService("turn_off", nil)
+}
+
+func (h *homeAssistantWSOutput) RestoreState(state *LightState) error {
+	saved, ok := state.raw.(*haState)
+	if !ok {
+		if !state.On {
+			return h.SetPower(false)
+		}
+		return h.SetColor(state.Color, state.Brightness)
+	}
+	return h.callService(saved.restoreCall())
+}
+
+func (h *homeAssistantWSOutput) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.done)
+		h.mu.Lock()
+		if h.conn != nil {
+			h.conn.Close()
+		}
+		h.mu.Unlock()
+		h.running.Wait()
+	})
+	return nil
+}
+
+// callService sends light.<service> for the configured entity and waits for
+// the result. While disconnected it fails right away and leaves recovery to
+// the reconnect loop, so the sync loop is not held up by a timeout per frame.
+func (h *homeAssistantWSOutput) callService(service string, data map[string]interface{}) error {
+	msg := map[string]interface{}{
+		"type":    "call_service",
+		"domain":  "light",
+		"service": service,
+		"target":  map[string]string{"entity_id": h.entity},
+	}
+	if len(data) > 0 {
+		msg["service_data"] = data
+	}
+	ready, first, err := h.start()
+	if err == nil && first {
+		// The call that opens the connection waits for it once
+		err = h.waitReady()
+	} else if err == nil {
+		select {
+		case <-ready:
+		default:
+			err = errHAWSNotConnected
+		}
+	}
+	if err == nil {
+		err = h.breaker.call(func() error {
+			_, err := h.request(msg)
+			return err
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("Home Assistant %s call failed: %w", service, err)
+	}
+	return nil
+}
+
+// start starts the connection loop on first use, first reports whether this
+// call did. It returns the channel that is closed while connected.
+func (h *homeAssistantWSOutput) start() (ready chan struct{}, first bool, err error) {
+	if h.token == "" {
+		return nil, false, errNoHAToken
+	}
+	select {
+	case <-h.done:
+		return nil, false, errHAWSClosed
+	default:
+	}
+	h.startOnce.Do(func() {
+		first = true
+		h.running.Add(1)
+		go func() {
+			defer h.running.Done()
+			h.run()
+		}()
+	})
+	h.mu.Lock()
+	ready = h.ready
+	h.mu.Unlock()
+	return ready, first, nil
+}
+
+// waitReady starts the connection on first use and waits until it is up
+func (h *homeAssistantWSOutput) waitReady() error {
+	ready, _, err := h.start()
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-h.done:
+		return errHAWSClosed
+	case <-timer.C:
+		return errHAWSNotConnected
+	}
+}
+
+// request sends a command with a fresh id and waits for its result
+func (h *homeAssistantWSOutput) request(msg map[string]interface{}) (haWSMessage, error) {
+	h.mu.Lock()
+	conn := h.conn
+	if conn == nil {
+		h.mu.Unlock()
+		return haWSMessage{}, errHAWSNotConnected
+	}
+	h.nextID++
+	id := h.nextID
+	ch := make(chan haWSMessage, 1)
+	h.pending[id] = ch
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, id)
+		h.mu.Unlock()
+	}()
+
+	msg["id"] = id
+	if err := h.write(conn, msg); err != nil {
+		return haWSMessage{}, err
+	}
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return haWSMessage{}, errHAWSNotConnected
+		}
+		if !res.Success {
+			// Rejected commands are not connection problems, so they do not
+			// count for the circuit breaker
+			status := "request failed"
+			if res.Error != nil {
+				status = fmt.Sprintf("%s: %s", res.Error.Code, res.Error.Message)
+			}
+			return res, &haStatusError{Code: http.StatusBadRequest, Status: status}
+		}
+		return res, nil
+	case <-timer.C:
+		return haWSMessage{}, errors.New("timed out waiting for Home Assistant")
+	}
+}
+
+func (h *homeAssistantWSOutput) write(conn *websocket.Conn, msg interface{}) error {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(h.timeout))
+	return conn.WriteJSON(msg)
+}
+
+// run keeps the connection alive until Close, reconnecting with exponential
+// backoff. Only changes between connected and disconnected are logged.
+func (h *homeAssistantWSOutput) run() {
+	backoff := h.minBackoff
+	for {
+		conn, err := h.connect()
+		if err == nil {
+			logger.Infof("Connected to Home Assistant WebSocket API at %s", h.wsURL)
+			backoff = h.minBackoff
+			err = h.readLoop(conn)
+			select {
+			case <-h.done:
+				return
+			default:
+			}
+			logger.Warnf("Home Assistant WebSocket connection lost: %v, reconnecting in %s", err, backoff)
+		} else {
+			logger.Warnf("Failed to connect to Home Assistant WebSocket API: %v, retrying in %s", err, backoff)
+		}
+		select {
+		case <-h.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > h.maxBackoff {
+			backoff = h.maxBackoff
+		}
+	}
+}
+
+// connect dials, authenticates and subscribes to state changes of the entity
+func (h *homeAssistantWSOutput) connect() (*websocket.Conn, error) {
+	conn, _, err := h.dialer.Dial(h.wsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(h.timeout))
+	var msg haWSMessage
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "auth_required" {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting %q: %v", msg.Type, err)
+	}
+	if err := h.write(conn, map[string]string{"type": "auth", "access_token": h.token}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	msg = haWSMessage{}
+	if err := conn.ReadJSON(&msg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if msg.Type != "auth_ok" {
+		conn.Close()
+		return nil, fmt.Errorf("authentication failed (%s), check HA_TOKEN", msg.Type)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.done:
+		conn.Close()
+		return nil, errHAWSClosed
+	default:
+	}
+	// A state trigger only streams changes of the entity, where state_changed
+	// events would stream every entity of the instance. The subscription
+	// result is not awaited, readLoop drops it as unknown id.
+	h.nextID++
+	if err := h.write(conn, map[string]interface{}{
+		"id":      h.nextID,
+		"type":    "subscribe_trigger",
+		"trigger": map[string]string{"platform": "state", "entity_id": h.entity},
+	}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	h.conn = conn
+	close(h.ready)
+	return conn, nil
+}
+
+// readLoop dispatches results and state events until the connection fails
+func (h *homeAssistantWSOutput) readLoop(conn *websocket.Conn) error {
+	var err error
+	for {
+		var msg haWSMessage
+		if err = conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		switch msg.Type {
+		case "result":
+			h.mu.Lock()
+			if ch, ok := h.pending[msg.ID]; ok {
+				ch <- msg
+				delete(h.pending, msg.ID)
+			}
+			h.mu.Unlock()
+		case "event":
+			if msg.Event != nil && msg.Event.Variables.Trigger.EntityID == h.entity && msg.Event.Variables.Trigger.ToState != nil {
+				newState := &msg.Event.Variables.Trigger.ToState.haState
+				h.mu.Lock()
+				h.state = newState
+				h.mu.Unlock()
+				if caps := newState.colorCaps(); caps != nil {
+					h.colorCaps.Store(caps)
+				}
+			}
+		}
+	}
+
+	conn.Close()
+	h.mu.Lock()
+	h.conn = nil
+	h.state = nil
+	h.ready = make(chan struct{})
+	for id, ch := range h.pending {
+		close(ch)
+		delete(h.pending, id)
+	}
+	h.mu.Unlock()
+	return err
+}
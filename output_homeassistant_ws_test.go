@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// fakeHAWebSocket is a minimal stand-in for Home Assistant's /api/websocket
+type fakeHAWebSocket struct {
+	t     *testing.T
+	token string
+
+	mu       sync.Mutex
+	calls    []map[string]interface{}
+	conns    []*websocket.Conn
+	connects int
+	triggers []map[string]interface{} // triggers subscribed with subscribe_trigger
+}
+
+func (f *fakeHAWebSocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/websocket" {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		f.t.Errorf("upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.WriteJSON(map[string]string{"type": "auth_required"})
+	var auth map[string]interface{}
+	if err := conn.ReadJSON(&auth); err != nil {
+		return
+	}
+	if auth["type"] != "auth" || auth["access_token"] != f.token {
+		conn.WriteJSON(map[string]string{"type": "auth_invalid"})
+		return
+	}
+	conn.WriteJSON(map[string]string{"type": "auth_ok"})
+	f.mu.Lock()
+	f.conns = append(f.conns, conn)
+	f.connects++
+	f.mu.Unlock()
+
+	var subscription interface{} // id of the state trigger for light.test
+	for {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		id := msg["id"]
+		switch msg["type"] {
+		case "subscribe_trigger":
+			trigger, _ := msg["trigger"].(map[string]interface{})
+			f.mu.Lock()
+			f.triggers = append(f.triggers, trigger)
+			f.mu.Unlock()
+			if trigger["platform"] == "state" && trigger["entity_id"] == "light.test" {
+				subscription = id
+			}
+			conn.WriteJSON(map[string]interface{}{"id": id, "type": "result", "success": true})
+		case "get_states":
+			conn.WriteJSON(map[string]interface{}{"id": id, "type": "result", "success": true, "result": []interface{}{
+				map[string]interface{}{"entity_id": "light.other", "state": "off"},
+				map[string]interface{}{"entity_id": "light.test", "state": "on", "attributes": map[string]interface{}{
+					"color_mode": "hs", "hs_color": []float64{120, 50}, "brightness": 80,
+				}},
+			}})
+		case "call_service":
+			f.mu.Lock()
+			f.calls = append(f.calls, msg)
+			f.mu.Unlock()
+			if msg["service"] == "toggle" {
+				conn.WriteJSON(map[string]interface{}{"id": id, "type": "result", "success": false,
+					"error": map[string]string{"code": "not_found", "message": "Service not found."}})
+				continue
+			}
+			conn.WriteJSON(map[string]interface{}{"id": id, "type": "result", "success": true})
+			if subscription == nil {
+				continue
+			}
+			// Report the new state like Home Assistant does after a service call
+			conn.WriteJSON(map[string]interface{}{"id": subscription, "type": "event", "event": map[string]interface{}{
+				"variables": map[string]interface{}{"trigger": map[string]interface{}{
+					"platform":  "state",
+					"entity_id": "light.test",
+					"to_state": map[string]interface{}{"entity_id": "light.test", "state": "on", "attributes": map[string]interface{}{
+						"color_mode": "rgb", "rgb_color": []int{1, 2, 3}, "brightness": 255,
+					}},
+				}},
+			}})
+		}
+	}
+}
+
+// dropConnections closes every open client connection
+func (f *fakeHAWebSocket) dropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func setupHAWebSocketTest(t *testing.T) (*fakeHAWebSocket, *homeAssistantWSOutput) {
+	t.Helper()
+	logger = zap.NewNop().Sugar()
+	fake := &fakeHAWebSocket{t: t, token: "testtoken"}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	out := newHomeAssistantWSOutput(srv.URL, "testtoken", "light.test", defaultHAClientConfig())
+	out.timeout = 2 * time.Second
+	out.minBackoff = 10 * time.Millisecond
+	t.Cleanup(func() { out.Close() })
+	return fake, out
+}
+
+func TestHAWebSocketURL(t *testing.T) {
+	cases := map[string]string{
+		"http://ha.local:8123":   "ws://ha.local:8123/api/websocket",
+		"https://ha.example.com": "wss://ha.example.com/api/websocket",
+		"http://ha.local:8123/":  "ws://ha.local:8123/api/websocket",
+	}
+	for in, want := range cases {
+		if got := haWebSocketURL(in); got != want {
+			t.Errorf("haWebSocketURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestHomeAssistantWSOutput_SetColorAndState(t *testing.T) {
+	fake, out := setupHAWebSocketTest(t)
+
+	state, err := out.GetState()
+	if err != nil {
+		t.Fatalf("GetState failed: %v", err)
+	}
+	if !state.On || state.Brightness != 80 {
+		t.Errorf("unexpected state from get_states: %+v", state)
+	}
+
+	out.SetTransition(250 * time.Millisecond)
+	if err := out.SetColor(RGB{10, 20, 30}, 200); err != nil {
+		t.Fatalf("SetColor failed: %v", err)
+	}
+	fake.mu.Lock()
+	if len(fake.calls) != 1 {
+		t.Fatalf("expected one call_service, got %v", fake.calls)
+	}
+	call := fake.calls[0]
+	data, _ := call["service_data"].(map[string]interface{})
+	target, _ := call["target"].(map[string]interface{})
+	if call["domain"] != "light" || call["service"] != "turn_on" || target["entity_id"] != "light.test" ||
+		data["brightness"] != float64(200) || data["transition"] != 0.25 {
+		t.Errorf("unexpected call_service: %v", call)
+	}
+	fake.mu.Unlock()
+
+	// The trigger event sent after the call replaces the cached state
+	deadline := time.Now().Add(time.Second)
+	for {
+		state, err = out.GetState()
+		if err != nil {
+			t.Fatalf("GetState failed: %v", err)
+		}
+		if state.Color == (RGB{1, 2, 3}) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state.Color != (RGB{1, 2, 3}) || state.Brightness != 255 {
+		t.Errorf("expected state from the subscription, got %+v", state)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.triggers) != 1 {
+		t.Errorf("expected one state trigger subscription for the entity, got %v", fake.triggers)
+	}
+}
+
+func TestHomeAssistantWSOutput_ServiceError(t *testing.T) {
+	_, out := setupHAWebSocketTest(t)
+	if err := out.callService("toggle", nil); err == nil {
+		t.Error("expected error for a failed service call")
+	}
+}
+
+func TestHomeAssistantWSOutput_Reconnect(t *testing.T) {
+	fake, out := setupHAWebSocketTest(t)
+	if err := out.SetPower(true); err != nil {
+		t.Fatalf("SetPower failed: %v", err)
+	}
+	fake.dropConnections()
+
+	// Calls fail until the reconnect loop is back
+	deadline := time.Now().Add(2 * time.Second)
+	var err error
+	for time.Now().Before(deadline) {
+		if err = out.SetPower(false); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("SetPower after reconnect failed: %v", err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.connects != 2 {
+		t.Errorf("expected exactly one reconnect, got %d connections", fake.connects)
+	}
+}
+
+func TestHomeAssistantWSOutput_FailFastWhileDisconnected(t *testing.T) {
+	fake, out := setupHAWebSocketTest(t)
+	out.minBackoff = time.Hour // no reconnect during the test
+	if err := out.SetPower(true); err != nil {
+		t.Fatalf("SetPower failed: %v", err)
+	}
+	fake.dropConnections()
+
+	// Once the loss is noticed, calls return at once instead of waiting for
+	// the timeout
+	deadline := time.Now().Add(time.Second)
+	for {
+		start := time.Now()
+		err := out.SetPower(false)
+		if errors.Is(err, errHAWSNotConnected) {
+			if took := time.Since(start); took > out.timeout/2 {
+				t.Errorf("expected the call to fail fast, took %s", took)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v while disconnected, got %v", errHAWSNotConnected, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHomeAssistantWSOutput_AuthInvalid(t *testing.T) {
+	_, out := setupHAWebSocketTest(t)
+	out.token = "wrong"
+	out.timeout = 100 * time.Millisecond
+	if err := out.SetPower(true); err == nil {
+		t.Error("expected error with an invalid token")
+	}
+}
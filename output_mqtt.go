@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttTimeout = 5 * time.Second
+
+var errMQTTNotConnected = errors.New("not connected to the MQTT broker")
+
+// mqttClient is the part of an MQTT client the backend uses
+type mqttClient interface {
+	// Connected reports whether the connection to the broker is up
+	Connected() bool
+	// Publish sends a message and waits until the broker has it
+	Publish(topic string, qos byte, retain bool, payload []byte) error
+	// Send queues a message without waiting, failures are only logged
+	Send(topic string, qos byte, retain bool, payload []byte)
+	Subscribe(topic string, qos byte, handler func(payload []byte)) error
+	Close()
+}
+
+// mqttOutput publishes JSON light commands in the Home Assistant JSON schema,
+// which Zigbee2MQTT and ESPHome's MQTT lights understand:
+// {"state": "ON", "color": {"r": 255, "g": 0, "b": 0}, "brightness": 255}
+//
+// With DISCOVERY it also announces the app itself to Home Assistant as a
+// "LED Screen Sync" device with a switch to toggle sync and a color sensor.
+type mqttOutput struct {
+	cfg    MQTTConfig
+	client mqttClient
+	// base topic for the app's own entities, led-screen-sync/<node>
+	base string
+	node string
+	deviceTransition
+
+	mu        sync.Mutex
+	state     map[string]interface{} // last JSON state seen on STATE_TOPIC
+	lastColor *RGB                   // last color published to the sensor
+
+	syncStateMu        sync.Mutex // serializes sync state publishes
+	removeSyncListener func()     // set with DISCOVERY
+}
+
+func newMQTTOutput(cfg MQTTConfig) (*mqttOutput, error) {
+	if cfg.BROKER == "" {
+		return nil, errors.New("OUTPUT.MQTT.BROKER not set in config")
+	}
+	if cfg.COMMAND_TOPIC == "" {
+		return nil, errors.New("OUTPUT.MQTT.COMMAND_TOPIC not set in config")
+	}
+	if cfg.QOS < 0 || cfg.QOS > 2 {
+		return nil, fmt.Errorf("OUTPUT.MQTT.QOS must be 0, 1 or 2, got %d", cfg.QOS)
+	}
+	m := newMQTTOutputWithClient(cfg, nil)
+
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.BROKER).
+		SetClientID(m.node).
+		SetUsername(cfg.USERNAME).
+		SetPassword(cfg.PASSWORD).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(30 * time.Second).
+		SetOnConnectHandler(func(paho.Client) {
+			logger.Infof("Connected to MQTT broker %s", cfg.BROKER)
+			m.onConnect()
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logger.Warnf("MQTT connection lost: %v", err)
+		})
+	if cfg.DISCOVERY {
+		opts.SetWill(m.availabilityTopic(), "offline", 1, true)
+	}
+	client := paho.NewClient(opts)
+	m.client = &pahoClient{client: client}
+	// With ConnectRetry the client keeps trying in the background, so a
+	// broker that is down at startup does not stop the app
+	client.Connect()
+
+	if cfg.DISCOVERY {
+		m.removeSyncListener = onSyncStateChange(m.syncStateChanged)
+	}
+	return m, nil
+}
+
+// newMQTTOutputWithClient sets up the backend on an existing client
+func newMQTTOutputWithClient(cfg MQTTConfig, client mqttClient) *mqttOutput {
+	if cfg.CLIENT_ID == "" {
+		cfg.CLIENT_ID = "led-screen-sync"
+	}
+	if cfg.DISCOVERY_PREFIX == "" {
+		cfg.DISCOVERY_PREFIX = "homeassistant"
+	}
+	node := mqttNodeID(cfg.CLIENT_ID)
+	return &mqttOutput{cfg: cfg, client: client, node: node, base: "led-screen-sync/" + node}
+}
+
+// mqttNodeID reduces a client id to the characters allowed in discovery topics
+func mqttNodeID(id string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(id) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+func (m *mqttOutput) Name() string {
+	return "MQTT " + m.cfg.COMMAND_TOPIC
+}
+
+func (m *mqttOutput) Capabilities() Capabilities {
+	return Capabilities{Color: true, Brightness: true}
+}
+
+// GetState returns the last state the light reported on STATE_TOPIC
+func (m *mqttOutput) GetState() (*LightState, error) {
+	if m.cfg.STATE_TOPIC == "" {
+		return nil, errors.New("OUTPUT.MQTT.STATE_TOPIC not set, cannot read the light state")
+	}
+	m.mu.Lock()
+	state := m.state
+	m.mu.Unlock()
+	if state == nil {
+		return nil, fmt.Errorf("no state received on %s yet", m.cfg.STATE_TOPIC)
+	}
+	return mqttLightState(state), nil
+}
+
+func (m *mqttOutput) SetColor(c RGB, brightness int) error {
+	cmd := map[string]interface{}{
+		"state":      "ON",
+		"color":      map[string]int{"r": int(c.R), "g": int(c.G), "b": int(c.B)},
+		"brightness": brightness,
+	}
+	if ms := m.transitionMS(); ms > 0 {
+		cmd["transition"] = float64(ms) / 1000
+	}
+	// Colors are sent every frame, so they do not wait for the broker
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	if !m.client.Connected() {
+		return errMQTTNotConnected
+	}
+	m.client.Send(m.cfg.COMMAND_TOPIC, byte(m.cfg.QOS), m.cfg.RETAIN, payload)
+	if m.cfg.DISCOVERY {
+		m.publishColor(c)
+	}
+	return nil
+}
+
+func (m *mqttOutput) SetPower(on bool) error {
+	state := "OFF"
+	if on {
+		state = "ON"
+	}
+	return m.publishCommand(map[string]interface{}{"state": state})
+}
+
+// RestoreState publishes the saved state, keeping whichever color
+// representation (color_temp, rgb, xy or hs) the light reported
+func (m *mqttOutput) RestoreState(state *LightState) error {
+	saved, ok := state.raw.(map[string]interface{})
+	if !ok {
+		if !state.On {
+			return m.SetPower(false)
+		}
+		return m.SetColor(state.Color, state.Brightness)
+	}
+	cmd := map[string]interface{}{"state": saved["state"]}
+	if saved["state"] != "ON" {
+		return m.publishCommand(cmd)
+	}
+	if v, ok := saved["brightness"]; ok {
+		cmd["brightness"] = v
+	}
+	if v, ok := saved["color_temp"]; ok && saved["color_mode"] == "color_temp" {
+		cmd["color_temp"] = v
+	} else if v, ok := saved["color"]; ok {
+		cmd["color"] = v
+	}
+	return m.publishCommand(cmd)
+}
+
+func (m *mqttOutput) Close() error {
+	if m.removeSyncListener != nil {
+		m.removeSyncListener()
+	}
+	if m.cfg.DISCOVERY {
+		m.client.Publish(m.availabilityTopic(), 1, true, []byte("offline"))
+	}
+	m.client.Close()
+	return nil
+}
+
+func (m *mqttOutput) publishCommand(cmd map[string]interface{}) error {
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	if !m.client.Connected() {
+		return errMQTTNotConnected
+	}
+	return m.client.Publish(m.cfg.COMMAND_TOPIC, byte(m.cfg.QOS), m.cfg.RETAIN, payload)
+}
+
+// onConnect (re)subscribes and announces the app after every connect
+func (m *mqttOutput) onConnect() {
+	if m.cfg.STATE_TOPIC != "" {
+		err := m.client.Subscribe(m.cfg.STATE_TOPIC, byte(m.cfg.QOS), func(payload []byte) {
+			var state map[string]interface{}
+			if err := json.Unmarshal(payload, &state); err != nil {
+				logger.Debugf("Ignoring non-JSON state on %s: %v", m.cfg.STATE_TOPIC, err)
+				return
+			}
+			m.mu.Lock()
+			m.state = state
+			m.mu.Unlock()
+		})
+		if err != nil {
+			logger.Warnf("Failed to subscribe to %s: %v", m.cfg.STATE_TOPIC, err)
+		}
+	}
+	if !m.cfg.DISCOVERY {
+		return
+	}
+	err := m.client.Subscribe(m.syncCommandTopic(), 1, func(payload []byte) {
+		// Start and stop call the light over this client, so they must not
+		// block the MQTT callback
+		switch strings.ToUpper(string(payload)) {
+		case "ON":
+			go startSync()
+		case "OFF":
+			go stopSync()
+		}
+	})
+	if err != nil {
+		logger.Warnf("Failed to subscribe to %s: %v", m.syncCommandTopic(), err)
+	}
+	for topic, config := range m.discoveryConfigs() {
+		payload, _ := json.Marshal(config)
+		if err := m.client.Publish(topic, 1, true, payload); err != nil {
+			logger.Warnf("Failed to publish discovery to %s: %v", topic, err)
+		}
+	}
+	m.client.Publish(m.availabilityTopic(), 1, true, []byte("online"))
+	m.publishCurrentSyncState()
+}
+
+func (m *mqttOutput) availabilityTopic() string { return m.base + "/availability" }
+func (m *mqttOutput) syncCommandTopic() string  { return m.base + "/sync/set" }
+func (m *mqttOutput) syncStateTopic() string    { return m.base + "/sync" }
+func (m *mqttOutput) colorTopic() string        { return m.base + "/color" }
+
+// discoveryConfigs returns the retained Home Assistant discovery messages
+// for the sync switch and the color sensor, keyed by topic
+func (m *mqttOutput) discoveryConfigs() map[string]interface{} {
+	device := map[string]interface{}{
+		"identifiers":  []string{"led_screen_sync_" + m.node},
+		"name":         "LED Screen Sync",
+		"manufacturer": "led-screen-sync",
+		"model":        "Screen color sync",
+	}
+	prefix := m.cfg.DISCOVERY_PREFIX
+	return map[string]interface{}{
+		prefix + "/switch/" + m.node + "/sync/config": map[string]interface{}{
+			"name":               "Sync",
+			"unique_id":          m.node + "_sync",
+			"command_topic":      m.syncCommandTopic(),
+			"state_topic":        m.syncStateTopic(),
+			"availability_topic": m.availabilityTopic(),
+			"icon":               "mdi:television-ambient-light",
+			"device":             device,
+		},
+		prefix + "/sensor/" + m.node + "/color/config": map[string]interface{}{
+			"name":                  "Color",
+			"unique_id":             m.node + "_color",
+			"state_topic":           m.colorTopic(),
+			"json_attributes_topic": m.colorTopic() + "/attributes",
+			"availability_topic":    m.availabilityTopic(),
+			"icon":                  "mdi:palette",
+			"device":                device,
+		},
+	}
+}
+
+// syncStateChanged is called while sync is being started or stopped. The
+// publish waits for the broker, so it runs in the background.
+func (m *mqttOutput) syncStateChanged(bool) {
+	go m.publishCurrentSyncState()
+}
+
+// publishCurrentSyncState publishes whether sync runs now. Publishes are
+// serialized, so after quick toggles the last one carries the final state.
+func (m *mqttOutput) publishCurrentSyncState() {
+	m.syncStateMu.Lock()
+	defer m.syncStateMu.Unlock()
+	m.publishSyncState(getStatus().Running)
+}
+
+// publishSyncState reports the sync switch state to Home Assistant
+func (m *mqttOutput) publishSyncState(running bool) {
+	state := "OFF"
+	if running {
+		state = "ON"
+	}
+	if err := m.client.Publish(m.syncStateTopic(), 1, true, []byte(state)); err != nil {
+		logger.Warnf("Failed to publish sync state: %v", err)
+	}
+}
+
+// publishColor reports the synced color as #rrggbb plus attributes. The
+// messages are retained, so they are only sent when the color changes.
+func (m *mqttOutput) publishColor(c RGB) {
+	m.mu.Lock()
+	unchanged := m.lastColor != nil && *m.lastColor == c
+	m.mu.Unlock()
+	if unchanged {
+		return
+	}
+	hex := fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	attrs, _ := json.Marshal(map[string]interface{}{
+		"r": c.R, "g": c.G, "b": c.B, "name": colorName(c),
+	})
+	m.client.Send(m.colorTopic(), 0, true, []byte(hex))
+	m.client.Send(m.colorTopic()+"/attributes", 0, true, attrs)
+	m.mu.Lock()
+	m.lastColor = &c
+	m.mu.Unlock()
+}
+
+// mqttLightState converts a JSON light state into a LightState
+func mqttLightState(state map[string]interface{}) *LightState {
+	ls := &LightState{On: state["state"] == "ON", raw: state}
+	if b, ok := state["brightness"].(float64); ok {
+		ls.Brightness = int(b)
+	}
+	color, _ := state["color"].(map[string]interface{})
+	r, rok := color["r"].(float64)
+	g, gok := color["g"].(float64)
+	b, bok := color["b"].(float64)
+	if rok && gok && bok {
+		ls.Color = RGB{uint8(r), uint8(g), uint8(b)}
+	} else if h, ok := color["hue"].(float64); ok {
+		s, _ := color["saturation"].(float64)
+		r, g, b := hsToRGB(h, s)
+		ls.Color = RGB{uint8(r), uint8(g), uint8(b)}
+	}
+	return ls
+}
+
+// pahoClient adapts the Eclipse Paho client to mqttClient
+type pahoClient struct {
+	client paho.Client
+}
+
+func (p *pahoClient) Connected() bool {
+	return p.client.IsConnectionOpen()
+}
+
+func (p *pahoClient) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	return waitToken(p.client.Publish(topic, qos, retain, payload))
+}
+
+func (p *pahoClient) Send(topic string, qos byte, retain bool, payload []byte) {
+	token := p.client.Publish(topic, qos, retain, payload)
+	go func() {
+		if err := waitToken(token); err != nil {
+			logger.Debugf("Failed to publish to %s: %v", topic, err)
+		}
+	}()
+}
+
+func (p *pahoClient) Subscribe(topic string, qos byte, handler func(payload []byte)) error {
+	return waitToken(p.client.Subscribe(topic, qos, func(_ paho.Client, msg paho.Message) {
+		handler(msg.Payload())
+	}))
+}
+
+func (p *pahoClient) Close() {
+	p.client.Disconnect(250)
+}
+
+func waitToken(t paho.Token) error {
+	if !t.WaitTimeout(mqttTimeout) {
+		return errors.New("timed out waiting for the MQTT broker")
+	}
+	return t.Error()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type mqttMessage struct {
+	topic   string
+	qos     byte
+	retain  bool
+	payload string
+}
+
+// fakeMQTTClient records publishes and lets tests deliver messages
+type fakeMQTTClient struct {
+	mu        sync.Mutex
+	published []mqttMessage
+	handlers  map[string]func(payload []byte)
+	closed    bool
+	offline   bool          // reported by Connected
+	block     chan struct{} // if set, publishes wait until it is closed
+}
+
+func (f *fakeMQTTClient) Connected() bool {
+	return !f.offline
+}
+
+func (f *fakeMQTTClient) Send(topic string, qos byte, retain bool, payload []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, mqttMessage{topic, qos, retain, string(payload)})
+}
+
+func (f *fakeMQTTClient) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	if f.block != nil {
+		<-f.block
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, mqttMessage{topic, qos, retain, string(payload)})
+	return nil
+}
+
+func (f *fakeMQTTClient) Subscribe(topic string, qos byte, handler func(payload []byte)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.handlers == nil {
+		f.handlers = map[string]func(payload []byte){}
+	}
+	f.handlers[topic] = handler
+	return nil
+}
+
+func (f *fakeMQTTClient) Close() {
+	f.closed = true
+}
+
+func (f *fakeMQTTClient) deliver(topic, payload string) {
+	f.handlers[topic]([]byte(payload))
+}
+
+// last returns the last message published to topic
+func (f *fakeMQTTClient) last(t *testing.T, topic string) mqttMessage {
+	t.Helper()
+	for i := len(f.published) - 1; i >= 0; i-- {
+		if f.published[i].topic == topic {
+			return f.published[i]
+		}
+	}
+	t.Fatalf("nothing published to %s, got %v", topic, f.published)
+	return mqttMessage{}
+}
+
+func TestMQTTOutput_Commands(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	client := &fakeMQTTClient{}
+	out := newMQTTOutputWithClient(MQTTConfig{COMMAND_TOPIC: "zigbee2mqtt/desk/set", QOS: 1, RETAIN: true}, client)
+
+	if err := out.SetColor(RGB{255, 128, 0}, 200); err != nil {
+		t.Fatalf("SetColor failed: %v", err)
+	}
+	msg := client.last(t, "zigbee2mqtt/desk/set")
+	if msg.qos != 1 || !msg.retain {
+		t.Errorf("expected QoS 1 retained, got %+v", msg)
+	}
+	var cmd map[string]interface{}
+	json.Unmarshal([]byte(msg.payload), &cmd)
+	color, _ := cmd["color"].(map[string]interface{})
+	if cmd["state"] != "ON" || cmd["brightness"] != float64(200) || color["r"] != float64(255) || color["g"] != float64(128) {
+		t.Errorf("unexpected color command: %s", msg.payload)
+	}
+
+	if err := out.SetPower(false); err != nil {
+		t.Fatalf("SetPower failed: %v", err)
+	}
+	if msg := client.last(t, "zigbee2mqtt/desk/set"); msg.payload != `{"state":"OFF"}` {
+		t.Errorf("unexpected power command: %s", msg.payload)
+	}
+	if len(client.published) != 2 {
+		t.Errorf("expected no discovery messages without DISCOVERY, got %v", client.published)
+	}
+}
+
+func TestMQTTOutput_StateAndRestore(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	client := &fakeMQTTClient{}
+	out := newMQTTOutputWithClient(MQTTConfig{COMMAND_TOPIC: "z2m/desk/set", STATE_TOPIC: "z2m/desk"}, client)
+	out.onConnect()
+
+	if _, err := out.GetState(); err == nil {
+		t.Error("expected error before any state was received")
+	}
+	client.deliver("z2m/desk", `{"state":"ON","brightness":120,"color_mode":"color_temp","color_temp":370,"color":{"x":0.46,"y":0.41}}`)
+	state, err := out.GetState()
+	if err != nil {
+		t.Fatalf("GetState failed: %v", err)
+	}
+	if !state.On || state.Brightness != 120 {
+		t.Errorf("unexpected state: %+v", state)
+	}
+
+	if err := out.RestoreState(state); err != nil {
+		t.Fatalf("RestoreState failed: %v", err)
+	}
+	var cmd map[string]interface{}
+	json.Unmarshal([]byte(client.last(t, "z2m/desk/set").payload), &cmd)
+	if cmd["state"] != "ON" || cmd["brightness"] != float64(120) || cmd["color_temp"] != float64(370) || cmd["color"] != nil {
+		t.Errorf("unexpected restore command: %v", cmd)
+	}
+}
+
+func TestMQTTOutput_Discovery(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	appConfig = &Config{}
+	client := &fakeMQTTClient{}
+	out := newMQTTOutputWithClient(MQTTConfig{COMMAND_TOPIC: "z2m/desk/set", CLIENT_ID: "Office PC", DISCOVERY: true}, client)
+	out.onConnect()
+
+	msg := client.last(t, "homeassistant/switch/office_pc/sync/config")
+	if !msg.retain {
+		t.Error("expected retained discovery config")
+	}
+	var cfg map[string]interface{}
+	json.Unmarshal([]byte(msg.payload), &cfg)
+	device, _ := cfg["device"].(map[string]interface{})
+	if cfg["command_topic"] != "led-screen-sync/office_pc/sync/set" || device["name"] != "LED Screen Sync" {
+		t.Errorf("unexpected switch config: %s", msg.payload)
+	}
+	client.last(t, "homeassistant/sensor/office_pc/color/config")
+	if msg := client.last(t, "led-screen-sync/office_pc/availability"); msg.payload != "online" {
+		t.Errorf("expected online availability, got %q", msg.payload)
+	}
+	if msg := client.last(t, "led-screen-sync/office_pc/sync"); msg.payload != "OFF" {
+		t.Errorf("expected sync state OFF, got %q", msg.payload)
+	}
+	if _, ok := client.handlers["led-screen-sync/office_pc/sync/set"]; !ok {
+		t.Error("expected a subscription to the sync switch")
+	}
+
+	out.SetColor(RGB{255, 0, 0}, 255)
+	if msg := client.last(t, "led-screen-sync/office_pc/color"); msg.payload != "#ff0000" {
+		t.Errorf("expected color sensor update, got %q", msg.payload)
+	}
+	// The same color again is only sent to the light
+	before := len(client.published)
+	out.SetColor(RGB{255, 0, 0}, 128)
+	if got := client.published[before:]; len(got) != 1 || got[0].topic != "z2m/desk/set" {
+		t.Errorf("expected only the light command for an unchanged color, got %v", got)
+	}
+	out.SetColor(RGB{0, 0, 255}, 128)
+	if msg := client.last(t, "led-screen-sync/office_pc/color"); msg.payload != "#0000ff" {
+		t.Errorf("expected color sensor update, got %q", msg.payload)
+	}
+
+	out.Close()
+	if msg := client.last(t, "led-screen-sync/office_pc/availability"); msg.payload != "offline" || !client.closed {
+		t.Errorf("expected offline availability on close, got %q", msg.payload)
+	}
+}
+
+func TestMQTTOutput_SyncStateDoesNotBlock(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	appConfig = &Config{}
+	client := &fakeMQTTClient{block: make(chan struct{})}
+	out := newMQTTOutputWithClient(MQTTConfig{COMMAND_TOPIC: "z2m/desk/set", DISCOVERY: true}, client)
+
+	// Listeners are called with syncMu held, like notifySyncState in startSync
+	syncMu.Lock()
+	running = true
+	start := time.Now()
+	out.syncStateChanged(true)
+	took := time.Since(start)
+	syncMu.Unlock()
+	t.Cleanup(func() {
+		syncMu.Lock()
+		running = false
+		syncMu.Unlock()
+	})
+	if took > 100*time.Millisecond {
+		t.Errorf("expected the listener to return while the broker is slow, took %s", took)
+	}
+
+	close(client.block)
+	deadline := time.Now().Add(time.Second)
+	for {
+		client.mu.Lock()
+		n := len(client.published)
+		var msg mqttMessage
+		if n > 0 {
+			msg = client.published[n-1]
+		}
+		client.mu.Unlock()
+		if n > 0 {
+			if msg.topic != "led-screen-sync/led-screen-sync/sync" || msg.payload != "ON" {
+				t.Errorf("expected sync state ON, got %+v", msg)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sync state not published")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTTOutput_Offline(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	// A blocked broker would hold every call, so failing fast must not publish
+	client := &fakeMQTTClient{offline: true, block: make(chan struct{})}
+	out := newMQTTOutputWithClient(MQTTConfig{COMMAND_TOPIC: "z2m/desk/set", DISCOVERY: true}, client)
+	if err := out.SetColor(RGB{255, 0, 0}, 255); !errors.Is(err, errMQTTNotConnected) {
+		t.Errorf("expected %v while offline, got %v", errMQTTNotConnected, err)
+	}
+	if err := out.SetPower(false); !errors.Is(err, errMQTTNotConnected) {
+		t.Errorf("expected %v while offline, got %v", errMQTTNotConnected, err)
+	}
+	if len(client.published) != 0 {
+		t.Errorf("expected nothing published while offline, got %v", client.published)
+	}
+
+	// Colors do not wait for the broker once connected
+	client.offline = false
+	done := make(chan error, 1)
+	go func() { done <- out.SetColor(RGB{0, 255, 0}, 255) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("SetColor failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("SetColor waited for the broker")
+	}
+	close(client.block)
+}
+
+func TestNewMQTTOutput_RemovesListenerOnClose(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	count := func() int {
+		syncMu.Lock()
+		defer syncMu.Unlock()
+		return len(syncStateListeners)
+	}
+	before := count()
+	// Nothing listens there; the client keeps retrying in the background
+	out, err := newMQTTOutput(MQTTConfig{BROKER: "tcp://127.0.0.1:1", COMMAND_TOPIC: "z2m/desk/set", DISCOVERY: true})
+	if err != nil {
+		t.Fatalf("newMQTTOutput failed: %v", err)
+	}
+	if got := count(); got != before+1 {
+		t.Errorf("expected the sync switch listener to be registered, got %d listeners", got)
+	}
+	out.Close()
+	if got := count(); got != before {
+		t.Errorf("expected Close to remove the listener, got %d listeners", got)
+	}
+}
+
+func TestNewMQTTOutput_Invalid(t *testing.T) {
+	cases := map[string]MQTTConfig{
+		"no broker": {COMMAND_TOPIC: "a/set"},
+		"no topic":  {BROKER: "tcp://localhost:1883"},
+		"bad QoS":   {BROKER: "tcp://localhost:1883", COMMAND_TOPIC: "a/set", QOS: 3},
+	}
+	for name, cfg := range cases {
+		if _, err := newMQTTOutput(cfg); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
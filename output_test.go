@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// recordingOutput is a LightOutput fake that records every call
+type recordingOutput struct {
+	caps     Capabilities
+	state    *LightState
+	calls    []string
+	colors   []RGB
+	restored *LightState
+	err      error
+}
+
+func (o *recordingOutput) Name() string               { return "recording" }
+func (o *recordingOutput) Capabilities() Capabilities { return o.caps }
+
+func (o *recordingOutput) GetState() (*LightState, error) {
+	o.calls = append(o.calls, "get")
+	return o.state, o.err
+}
+
+func (o *recordingOutput) SetColor(c RGB, brightness int) error {
+	o.calls = append(o.calls, fmt.Sprintf("color %d,%d,%d@%d", c.R, c.G, c.B, brightness))
+	o.colors = append(o.colors, c)
+	return o.err
+}
+
+func (o *recordingOutput) SetPower(on bool) error {
+	o.calls = append(o.calls, fmt.Sprintf("power %v", on))
+	return o.err
+}
+
+func (o *recordingOutput) RestoreState(state *LightState) error {
+	o.calls = append(o.calls, "restore")
+	o.restored = state
+	return o.err
+}
+
+func (o *recordingOutput) Close() error {
+	o.calls = append(o.calls, "close")
+	return nil
+}
+
+func TestApplyOnStop(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	saved := &LightState{On: true, Color: RGB{1, 2, 3}, Brightness: 50}
+
+	out := &recordingOutput{}
+	applyOnStop(out, OnStopRestore, saved)
+	if out.restored != saved {
+		t.Errorf("expected saved state to be restored, calls: %v", out.calls)
+	}
+
+	out = &recordingOutput{}
+	applyOnStop(out, OnStopOff, saved)
+	if len(out.calls) != 1 || out.calls[0] != "power false" {
+		t.Errorf("expected LED to be turned off, calls: %v", out.calls)
+	}
+
+	out = &recordingOutput{}
+	applyOnStop(out, OnStopKeep, saved)
+	if len(out.calls) != 0 {
+		t.Errorf("expected no calls for keep, calls: %v", out.calls)
+	}
+}
+
+func TestNewLightOutput(t *testing.T) {
+	cfg := &Config{}
+	out, err := newLightOutput(cfg)
+	if err != nil {
+		t.Fatalf("newLightOutput failed: %v", err)
+	}
+	if _, ok := out.(*homeAssistantOutput); !ok {
+		t.Errorf("expected Home Assistant output by default, got %T", out)
+	}
+	cfg.Env.OUTPUT.TYPE = "nonsense"
+	if _, err := newLightOutput(cfg); err == nil {
+		t.Error("expected error for unknown OUTPUT.TYPE")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WLED output modes (OUTPUT.WLED.MODE)
+const (
+	WLEDModeJSON  = "json"  // single color through the /json/state HTTP API
+	WLEDModeWARLS = "warls" // realtime UDP, index + RGB per LED (max 255 LEDs)
+	WLEDModeDRGB  = "drgb"  // realtime UDP, RGB per LED (max 490 LEDs)
+	WLEDModeDNRGB = "dnrgb" // realtime UDP, RGB per LED with start index (489 LEDs per packet)
+)
+
+// WLED realtime UDP protocol identifiers (first byte of every packet)
+const (
+	wledProtoWARLS = 1
+	wledProtoDRGB  = 2
+	wledProtoDNRGB = 4
+)
+
+// Maximum LEDs per realtime packet for each protocol
+const (
+	wledMaxWARLS = 255
+	wledMaxDRGB  = 490
+	wledMaxDNRGB = 489
+)
+
+const wledDefaultUDPPort = 21324
+
+// wledState is the part of WLED's /json/state we read and restore
+type wledState struct {
+	On  bool          `json:"on"`
+	Bri int           `json:"bri"`
+	Seg []wledSegment `json:"seg"`
+}
+
+type wledSegment struct {
+	ID  int     `json:"id"`
+	Col [][]int `json:"col"`
+	Fx  int     `json:"fx"`
+	Pal int     `json:"pal"`
+}
+
+// wledOutput drives a WLED controller directly, either through its JSON API
+// or by streaming per-LED data over the realtime UDP protocols
+type wledOutput struct {
+	baseURL  string
+	mode     string
+	ledCount int
+	timeout  byte
+	client   *http.Client
+	conn     net.Conn
+	// fade for the JSON mode, realtime UDP frames are always shown immediately
+	deviceTransition
+}
+
+func newWLEDOutput(cfg WLEDConfig) (*wledOutput, error) {
+	if cfg.HOST == "" {
+		return nil, errors.New("OUTPUT.WLED.HOST not set in config")
+	}
+	mode := strings.ToLower(cfg.MODE)
+	if mode == "" {
+		mode = WLEDModeJSON
+	}
+	w := &wledOutput{
+		baseURL:  "http://" + cfg.HOST,
+		mode:     mode,
+		ledCount: cfg.LED_COUNT,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+	if mode == WLEDModeJSON {
+		return w, nil
+	}
+
+	switch mode {
+	case WLEDModeWARLS, WLEDModeDRGB, WLEDModeDNRGB:
+	default:
+		return nil, fmt.Errorf("unknown OUTPUT.WLED.MODE %q", cfg.MODE)
+	}
+	if cfg.LED_COUNT <= 0 {
+		return nil, errors.New("OUTPUT.WLED.LED_COUNT must be set for realtime UDP modes")
+	}
+	if mode == WLEDModeWARLS && cfg.LED_COUNT > wledMaxWARLS {
+		return nil, fmt.Errorf("WARLS supports at most %d LEDs, use dnrgb instead", wledMaxWARLS)
+	}
+	if mode == WLEDModeDRGB && cfg.LED_COUNT > wledMaxDRGB {
+		return nil, fmt.Errorf("DRGB supports at most %d LEDs, use dnrgb instead", wledMaxDRGB)
+	}
+	// Seconds WLED waits after the last packet before returning to its own effect
+	w.timeout = 2
+	if cfg.TIMEOUT_S > 0 && cfg.TIMEOUT_S < 255 {
+		w.timeout = byte(cfg.TIMEOUT_S)
+	}
+	port := cfg.UDP_PORT
+	if port == 0 {
+		port = wledDefaultUDPPort
+	}
+	host := cfg.HOST
+	if h, _, err := net.SplitHostPort(cfg.HOST); err == nil {
+		host = h
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	w.conn = conn
+	return w, nil
+}
+
+func (w *wledOutput) Name() string {
+	return fmt.Sprintf("WLED %s (%s)", w.baseURL, w.mode)
+}
+
+func (w *wledOutput) Capabilities() Capabilities {
+	caps := Capabilities{Color: true, Brightness: true}
+	if w.conn != nil {
+		caps.Segments = w.ledCount
+	}
+	return caps
+}
+
+func (w *wledOutput) GetState() (*LightState, error) {
+	resp, err := w.client.Get(w.baseURL + "/json/state")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Failed to get WLED state: %s", resp.Status)
+	}
+	var state wledState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, err
+	}
+	ls := &LightState{On: state.On, Brightness: state.Bri, raw: &state}
+	if len(state.Seg) > 0 && len(state.Seg[0].Col) > 0 && len(state.Seg[0].Col[0]) >= 3 {
+		c := state.Seg[0].Col[0]
+		ls.Color = RGB{uint8(c[0]), uint8(c[1]), uint8(c[2])}
+	}
+	return ls, nil
+}
+
+// SetColor sets the whole strip to one color. In realtime modes every LED
+// gets the same color.
+func (w *wledOutput) SetColor(c RGB, brightness int) error {
+	if w.conn != nil {
+		colors := make([]RGB, w.ledCount)
+		for i := range colors {
+			colors[i] = c
+		}
+		return w.SetColors(colors, brightness)
+	}
+	state := map[string]interface{}{
+		"on":  true,
+		"bri": brightness,
+		"seg": []map[string]interface{}{{"col": [][]int{{int(c.R), int(c.G), int(c.B)}}, "fx": 0}},
+	}
+	if ms := w.transitionMS(); ms > 0 {
+		// WLED counts transitions in units of 100ms
+		state["tt"] = (ms + 50) / 100
+	}
+	return w.postState(state)
+}
+
+// SetColors streams one color per LED over realtime UDP
+func (w *wledOutput) SetColors(colors []RGB, brightness int) error {
+	if w.conn == nil {
+		return errors.New("per-LED colors need a realtime UDP mode")
+	}
+	if brightness < 255 {
+		colors = scaleColors(colors, brightness)
+	}
+	for _, pkt := range buildWLEDPackets(w.mode, w.timeout, colors) {
+		if _, err := w.conn.Write(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *wledOutput) SetPower(on bool) error {
+	return w.postState(map[string]interface{}{"on": on})
+}
+
+func (w *wledOutput) RestoreState(state *LightState) error {
+	saved, ok := state.raw.(*wledState)
+	if !ok {
+		if !state.On {
+			return w.SetPower(false)
+		}
+		return w.postState(map[string]interface{}{
+			"on":  true,
+			"bri": state.Brightness,
+			"seg": []map[string]interface{}{{"col": [][]int{{int(state.Color.R), int(state.Color.G), int(state.Color.B)}}}},
+		})
+	}
+	return w.postState(saved)
+}
+
+func (w *wledOutput) Close() error {
+	w.client.CloseIdleConnections()
+	if w.conn != nil {
+		return w.conn.Close()
+	}
+	return nil
+}
+
+// postState sends a partial state to WLED's /json/state endpoint
+func (w *wledOutput) postState(state interface{}) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.baseURL+"/json/state", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("WLED call failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// buildWLEDPackets encodes colors into realtime UDP packets for the given mode.
+// Only DNRGB can address more LEDs than fit into one packet.
+func buildWLEDPackets(mode string, timeout byte, colors []RGB) [][]byte {
+	switch mode {
+	case WLEDModeWARLS:
+		if len(colors) > wledMaxWARLS {
+			colors = colors[:wledMaxWARLS]
+		}
+		pkt := make([]byte, 0, 2+4*len(colors))
+		pkt = append(pkt, wledProtoWARLS, timeout)
+		for i, c := range colors {
+			pkt = append(pkt, byte(i), c.R, c.G, c.B)
+		}
+		return [][]byte{pkt}
+	case WLEDModeDRGB:
+		if len(colors) > wledMaxDRGB {
+			colors = colors[:wledMaxDRGB]
+		}
+		pkt := make([]byte, 0, 2+3*len(colors))
+		pkt = append(pkt, wledProtoDRGB, timeout)
+		for _, c := range colors {
+			pkt = append(pkt, c.R, c.G, c.B)
+		}
+		return [][]byte{pkt}
+	case WLEDModeDNRGB:
+		var pkts [][]byte
+		for start := 0; start < len(colors); start += wledMaxDNRGB {
+			end := start + wledMaxDNRGB
+			if end > len(colors) {
+				end = len(colors)
+			}
+			pkt := make([]byte, 0, 4+3*(end-start))
+			pkt = append(pkt, wledProtoDNRGB, timeout, byte(start>>8), byte(start))
+			for _, c := range colors[start:end] {
+				pkt = append(pkt, c.R, c.G, c.B)
+			}
+			pkts = append(pkts, pkt)
+		}
+		return pkts
+	}
+	return nil
+}
+
+// scaleColors applies a 0-255 brightness to a copy of colors
+func scaleColors(colors []RGB, brightness int) []RGB {
+	if brightness < 0 {
+		brightness = 0
+	}
+	scaled := make([]RGB, len(colors))
+	for i, c := range colors {
+		scaled[i] = RGB{
+			R: uint8(int(c.R) * brightness / 255),
+			G: uint8(int(c.G) * brightness / 255),
+			B: uint8(int(c.B) * brightness / 255),
+		}
+	}
+	return scaled
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildWLEDPackets(t *testing.T) {
+	colors := []RGB{{1, 2, 3}, {4, 5, 6}}
+
+	warls := buildWLEDPackets(WLEDModeWARLS, 2, colors)
+	want := []byte{1, 2, 0, 1, 2, 3, 1, 4, 5, 6}
+	if len(warls) != 1 || string(warls[0]) != string(want) {
+		t.Errorf("unexpected WARLS packet: %v", warls)
+	}
+
+	drgb := buildWLEDPackets(WLEDModeDRGB, 255, colors)
+	want = []byte{2, 255, 1, 2, 3, 4, 5, 6}
+	if len(drgb) != 1 || string(drgb[0]) != string(want) {
+		t.Errorf("unexpected DRGB packet: %v", drgb)
+	}
+
+	many := make([]RGB, 600)
+	dnrgb := buildWLEDPackets(WLEDModeDNRGB, 5, many)
+	if len(dnrgb) != 2 {
+		t.Fatalf("expected 2 DNRGB packets, got %d", len(dnrgb))
+	}
+	if len(dnrgb[0]) != 4+3*wledMaxDNRGB || len(dnrgb[1]) != 4+3*(600-wledMaxDNRGB) {
+		t.Errorf("unexpected DNRGB packet sizes: %d, %d", len(dnrgb[0]), len(dnrgb[1]))
+	}
+	if start := int(dnrgb[1][2])<<8 | int(dnrgb[1][3]); start != wledMaxDNRGB {
+		t.Errorf("unexpected DNRGB start index: %d", start)
+	}
+}
+
+func TestWLEDOutput_UDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer pc.Close()
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+
+	out, err := newWLEDOutput(WLEDConfig{HOST: "127.0.0.1", MODE: "drgb", UDP_PORT: port, LED_COUNT: 3, TIMEOUT_S: 4})
+	if err != nil {
+		t.Fatalf("newWLEDOutput failed: %v", err)
+	}
+	defer out.Close()
+	if out.Capabilities().Segments != 3 {
+		t.Errorf("expected 3 addressable LEDs, got %d", out.Capabilities().Segments)
+	}
+	if err := out.SetColor(RGB{200, 100, 50}, 255); err != nil {
+		t.Fatalf("SetColor failed: %v", err)
+	}
+
+	buf := make([]byte, 1500)
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no packet received: %v", err)
+	}
+	want := []byte{2, 4, 200, 100, 50, 200, 100, 50, 200, 100, 50}
+	if string(buf[:n]) != string(want) {
+		t.Errorf("unexpected packet: %v", buf[:n])
+	}
+}
+
+func TestWLEDOutput_JSON(t *testing.T) {
+	var posted []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/json/state" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if r.Method == "GET" {
+			w.Write([]byte(`{"on":true,"bri":90,"seg":[{"id":0,"col":[[255,160,0],[0,0,0],[0,0,0]],"fx":9,"pal":3}]}`))
+			return
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		posted = append(posted, body)
+	}))
+	defer srv.Close()
+
+	out, err := newWLEDOutput(WLEDConfig{HOST: strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		t.Fatalf("newWLEDOutput failed: %v", err)
+	}
+	state, err := out.GetState()
+	if err != nil {
+		t.Fatalf("GetState failed: %v", err)
+	}
+	if !state.On || state.Brightness != 90 || state.Color != (RGB{255, 160, 0}) {
+		t.Errorf("unexpected state: %+v", state)
+	}
+	if err := out.SetColor(RGB{1, 2, 3}, 128); err != nil {
+		t.Fatalf("SetColor failed: %v", err)
+	}
+	if err := out.RestoreState(state); err != nil {
+		t.Fatalf("RestoreState failed: %v", err)
+	}
+	if len(posted) != 2 {
+		t.Fatalf("expected 2 posts, got %d", len(posted))
+	}
+	if posted[0]["bri"] != float64(128) {
+		t.Errorf("unexpected color post: %v", posted[0])
+	}
+	seg := posted[1]["seg"].([]interface{})[0].(map[string]interface{})
+	if seg["fx"] != float64(9) || posted[1]["bri"] != float64(90) {
+		t.Errorf("unexpected restore post: %v", posted[1])
+	}
+}
+
+func TestNewWLEDOutput_Validation(t *testing.T) {
+	if _, err := newWLEDOutput(WLEDConfig{}); err == nil {
+		t.Error("expected error for missing HOST")
+	}
+	if _, err := newWLEDOutput(WLEDConfig{HOST: "127.0.0.1", MODE: "warls"}); err == nil {
+		t.Error("expected error for missing LED_COUNT")
+	}
+	if _, err := newWLEDOutput(WLEDConfig{HOST: "127.0.0.1", MODE: "warls", LED_COUNT: 300}); err == nil {
+		t.Error("expected error for too many WARLS LEDs")
+	}
+	if _, err := newWLEDOutput(WLEDConfig{HOST: "127.0.0.1", MODE: "bogus", LED_COUNT: 3}); err == nil {
+		t.Error("expected error for unknown MODE")
+	}
+	out, err := newWLEDOutput(WLEDConfig{HOST: "127.0.0.1:" + strconv.Itoa(8080), MODE: "dnrgb", LED_COUNT: 1000})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out.Close()
+}
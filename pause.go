@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// PauseColor is the PAUSE.ACTION that shows PAUSE.COLOR while capture fails.
+// The other actions are the ON_STOP values restore, off and keep.
+const PauseColor = "color"
+
+// Retry delays while capture fails, doubled after every failed attempt up to
+// PAUSE.MAX_BACKOFF_MS
+var pauseMinBackoff = time.Second
+
+// PauseConfig controls what happens while frames cannot be captured, e.g.
+// when the monitor sleeps, on the lock screen or an RDP session switch
+type PauseConfig struct {
+	ACTION         string `yaml:"ACTION"`         // keep (default), restore, off or color
+	COLOR          []int  `yaml:"COLOR"`          // [r, g, b] for the color action
+	MAX_BACKOFF_MS int    `yaml:"MAX_BACKOFF_MS"` // longest wait between capture retries (default 30000)
+}
+
+func (p PauseConfig) validate() error {
+	switch p.ACTION {
+	case OnStopKeep, OnStopRestore, OnStopOff:
+	case PauseColor:
+		if len(p.COLOR) != 3 {
+			return fmt.Errorf("PAUSE.COLOR must be [r, g, b], got %v", p.COLOR)
+		}
+		for _, v := range p.COLOR {
+			if v < 0 || v > 255 {
+				return fmt.Errorf("PAUSE.COLOR values must be between 0 and 255, got %v", p.COLOR)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown PAUSE.ACTION %q, use keep, restore, off or color", p.ACTION)
+	}
+	if p.MAX_BACKOFF_MS < 1 {
+		return fmt.Errorf("PAUSE.MAX_BACKOFF_MS must be positive, got %d", p.MAX_BACKOFF_MS)
+	}
+	return nil
+}
+
+// pauseListeners are called when the loop pauses or resumes. They run on
+// the loop goroutine and must not block.
+var pauseListeners []func(paused bool, reason string)
+
+// onPauseChange registers fn to be called whenever sync pauses because
+// capture fails, or resumes
+func onPauseChange(fn func(paused bool, reason string)) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	pauseListeners = append(pauseListeners, fn)
+}
+
+// setPaused records the pause state in the status and tells the listeners
+func setPaused(paused bool, reason error) {
+	msg := ""
+	if reason != nil {
+		msg = reason.Error()
+	}
+	statusMu.Lock()
+	syncStatus.Paused = paused
+	listeners := append([]func(bool, string){}, pauseListeners...)
+	statusMu.Unlock()
+	for _, fn := range listeners {
+		fn(paused, msg)
+	}
+}
+
+// applyPauseAction puts the LED into the state selected by PAUSE.ACTION
+func applyPauseAction(out LightOutput, cfg PauseConfig, original *LightState) {
+	if cfg.ACTION != PauseColor {
+		applyOnStop(out, cfg.ACTION, original)
+		return
+	}
+	c := RGB{uint8(cfg.COLOR[0]), uint8(cfg.COLOR[1]), uint8(cfg.COLOR[2])}
+	logger.Infof("Setting pause color %v", c)
+	if err := out.SetColor(c, appConfig.Env.BRIGHTNESS.MAX); err != nil {
+		logger.Errorf("Failed to set pause color: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// flakySource fails a number of times before it delivers frames, like a
+// monitor waking up
+type flakySource struct {
+	mu       sync.Mutex
+	failures int
+	frame    *image.RGBA
+}
+
+func (s *flakySource) Name() string { return "flaky" }
+
+func (s *flakySource) Next() ([]*image.RGBA, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("no active display found")
+	}
+	return []*image.RGBA{s.frame}, nil
+}
+
+func (s *flakySource) Close() error { return nil }
+
+func TestSync_PausesWhileCaptureFails(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	frame := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			frame.Set(x, y, color.RGBA{30, 200, 30, 255})
+		}
+	}
+	src := &flakySource{failures: 3, frame: frame}
+	openFrameSource = func(SourceConfig) (FrameSource, error) { return src, nil }
+	defer func() { openFrameSource = newFrameSource }()
+	pauseMinBackoff = time.Millisecond
+	defer func() { pauseMinBackoff = time.Second }()
+
+	cfg := defaultConfig()
+	cfg.Env.UPDATE_INTERVAL_MS = 5
+	cfg.Env.PAUSE = PauseConfig{ACTION: PauseColor, COLOR: []int{255, 120, 0}, MAX_BACKOFF_MS: 4}
+	appConfig = &cfg
+	out := &recordingOutput{state: &LightState{On: true}}
+	lightOutput = out
+
+	// Listeners stay registered, so never block or touch t in here
+	type change struct {
+		paused bool
+		reason string
+	}
+	changes := make(chan change, 4)
+	onPauseChange(func(paused bool, reason string) {
+		select {
+		case changes <- change{paused, reason}:
+		default:
+		}
+	})
+	if !startSync() {
+		t.Fatal("startSync failed")
+	}
+	defer stopSync()
+	for _, want := range []bool{true, false} {
+		select {
+		case got := <-changes:
+			if got.paused != want {
+				t.Fatalf("expected paused=%v, got %v", want, got.paused)
+			}
+			if want && got.reason != "no active display found" {
+				t.Errorf("unexpected pause reason %q", got.reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for paused=%v", want)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for getStatus().LastColor == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if getStatus().Paused {
+		t.Error("status still reports paused")
+	}
+	stopSync()
+
+	want := []RGB{{255, 120, 0}, quantizeRGB(RGB{30, 200, 30}, 16)}
+	if len(out.colors) != 2 || out.colors[0] != want[0] || out.colors[1] != want[1] {
+		t.Errorf("expected pause color then frame color %v, got %v", want, out.colors)
+	}
+}
+
+func TestPauseConfig_Validate(t *testing.T) {
+	valid := PauseConfig{ACTION: PauseColor, COLOR: []int{0, 0, 255}, MAX_BACKOFF_MS: 1000}
+	if err := valid.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for name, cfg := range map[string]PauseConfig{
+		"unknown action":     {ACTION: "blink", MAX_BACKOFF_MS: 1000},
+		"color without rgb":  {ACTION: PauseColor, MAX_BACKOFF_MS: 1000},
+		"color out of range": {ACTION: PauseColor, COLOR: []int{0, 0, 300}, MAX_BACKOFF_MS: 1000},
+		"zero backoff":       {ACTION: OnStopKeep},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+
+	"golang.org/x/image/draw"
+)
+
+// Units of REGION.INCLUDE and REGION.EXCLUDE
+const (
+	RegionPercent = "percent"
+	RegionPixels  = "px"
+)
+
+// RegionConfig limits which part of each captured display is analyzed
+type RegionConfig struct {
+	UNIT          string      `yaml:"UNIT"`          // percent (default) or px, for INCLUDE and EXCLUDE
+	INCLUDE       [][]float64 `yaml:"INCLUDE"`       // [x, y, width, height] areas to sample, default the whole display
+	EXCLUDE       [][]float64 `yaml:"EXCLUDE"`       // [x, y, width, height] areas to ignore, e.g. a HUD or the taskbar
+	MASK          string      `yaml:"MASK"`          // PNG stretched over the display: white is sampled, black or transparent ignored
+	CENTER_WEIGHT float64     `yaml:"CENTER_WEIGHT"` // 0 = all pixels count the same, 1 = corners do not count at all
+}
+
+func (r RegionConfig) validate() error {
+	switch r.UNIT {
+	case "", RegionPercent, RegionPixels:
+	default:
+		return fmt.Errorf("unknown REGION.UNIT %q, use percent or px", r.UNIT)
+	}
+	for _, rects := range []struct {
+		name  string
+		rects [][]float64
+	}{{"INCLUDE", r.INCLUDE}, {"EXCLUDE", r.EXCLUDE}} {
+		for _, rect := range rects.rects {
+			if len(rect) != 4 || rect[0] < 0 || rect[1] < 0 || rect[2] <= 0 || rect[3] <= 0 {
+				return fmt.Errorf("REGION.%s entries must be [x, y, width, height] with a positive size, got %v", rects.name, rect)
+			}
+		}
+	}
+	if r.CENTER_WEIGHT < 0 || r.CENTER_WEIGHT > 1 {
+		return fmt.Errorf("REGION.CENTER_WEIGHT must be between 0 and 1, got %v", r.CENTER_WEIGHT)
+	}
+	if r.MASK != "" {
+		if _, err := loadMaskPNG(r.MASK); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enabled reports whether any part of the screen is masked or weighted
+func (r RegionConfig) enabled() bool {
+	return len(r.INCLUDE) > 0 || len(r.EXCLUDE) > 0 || r.MASK != "" || r.CENTER_WEIGHT > 0
+}
+
+func loadMaskPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("REGION.MASK: %w", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("REGION.MASK %s: %w", path, err)
+	}
+	return img, nil
+}
+
+// regionMask turns the REGION settings into per-pixel weights. The weights
+// are cached per frame size because they only change with the display.
+type regionMask struct {
+	cfg   RegionConfig
+	mask  image.Image // decoded MASK, nil without one
+	cache map[image.Rectangle]*image.Alpha
+}
+
+func newRegionMask(cfg RegionConfig) (*regionMask, error) {
+	m := &regionMask{cfg: cfg, cache: make(map[image.Rectangle]*image.Alpha)}
+	if cfg.MASK != "" {
+		img, err := loadMaskPNG(cfg.MASK)
+		if err != nil {
+			return nil, err
+		}
+		m.mask = img
+	}
+	return m, nil
+}
+
+// Apply returns a copy of img with the weights in its alpha channel. Masked
+// pixels become transparent, so downscale averages them away and the
+// analysis stages skip them.
+func (m *regionMask) Apply(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.DrawMask(out, b, img, b.Min, m.weights(b), b.Min, draw.Src)
+	return out
+}
+
+// weights returns the mask for frames with bounds b
+func (m *regionMask) weights(b image.Rectangle) *image.Alpha {
+	if a, ok := m.cache[b]; ok {
+		return a
+	}
+	a := image.NewAlpha(b)
+	if len(m.cfg.INCLUDE) == 0 {
+		draw.Draw(a, b, image.Opaque, image.Point{}, draw.Src)
+	}
+	for _, r := range m.cfg.INCLUDE {
+		draw.Draw(a, m.rect(r, b), image.Opaque, image.Point{}, draw.Src)
+	}
+	for _, r := range m.cfg.EXCLUDE {
+		draw.Draw(a, m.rect(r, b), image.Transparent, image.Point{}, draw.Src)
+	}
+	if m.mask != nil {
+		gray := image.NewGray(b)
+		draw.BiLinear.Scale(gray, b, m.mask, m.mask.Bounds(), draw.Src, nil)
+		for i := range a.Pix {
+			a.Pix[i] = uint8(uint(a.Pix[i]) * uint(gray.Pix[i]) / 255)
+		}
+	}
+	if w := m.cfg.CENTER_WEIGHT; w > 0 {
+		// Falls off with the squared distance from the center, normalized so
+		// the corners get 1 - CENTER_WEIGHT
+		halfW, halfH := float64(b.Dx())/2, float64(b.Dy())/2
+		for y := 0; y < b.Dy(); y++ {
+			dy := (float64(y) + 0.5 - halfH) / halfH
+			for x := 0; x < b.Dx(); x++ {
+				dx := (float64(x) + 0.5 - halfW) / halfW
+				i := y*a.Stride + x
+				a.Pix[i] = roundChannel(float64(a.Pix[i]) * (1 - w*(dx*dx+dy*dy)/2))
+			}
+		}
+	}
+	m.cache[b] = a
+	return a
+}
+
+// rect converts an INCLUDE/EXCLUDE entry to pixels inside the frame bounds b
+func (m *regionMask) rect(r []float64, b image.Rectangle) image.Rectangle {
+	x, y, w, h := r[0], r[1], r[2], r[3]
+	if m.cfg.UNIT != RegionPixels {
+		x, w = x*float64(b.Dx())/100, w*float64(b.Dx())/100
+		y, h = y*float64(b.Dy())/100, h*float64(b.Dy())/100
+	}
+	return image.Rect(int(x), int(y), int(x+w+0.5), int(y+h+0.5)).Add(b.Min).Intersect(b)
+}
+
+// pixelWeight returns the color of a pixel and how much it counts, from 0 to
+// 1. The weight is the alpha channel set by regionMask, 1 for plain frames.
+func pixelWeight(img image.Image, x, y int) (RGB, float64) {
+	r, g, b, a := img.At(x, y).RGBA()
+	if a == 0 {
+		return RGB{}, 0
+	}
+	if a < 0xffff {
+		// Colors are premultiplied by alpha
+		r, g, b = r*0xffff/a, g*0xffff/a, b*0xffff/a
+	}
+	return RGB{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)}, float64(a) / 0xffff
+}
+
+// unmaskedPixels counts the pixels of img that REGION did not mask, the total
+// topColors counts against
+func unmaskedPixels(img image.Image) int {
+	total := 0
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, w := pixelWeight(img, x, y); w > 0 {
+				total++
+			}
+		}
+	}
+	return total
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// splitImage is a 100x50 frame, red on the left half and blue on the right
+func splitImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			c := color.RGBA{200, 30, 30, 255}
+			if x >= 50 {
+				c = color.RGBA{30, 30, 200, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestRegionMask_IncludeExclude(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  RegionConfig
+		want RGB
+	}{
+		{"exclude percent", RegionConfig{EXCLUDE: [][]float64{{0, 0, 50, 100}}}, RGB{30, 30, 200}},
+		{"include percent", RegionConfig{INCLUDE: [][]float64{{0, 0, 50, 100}}}, RGB{200, 30, 30}},
+		{"exclude px", RegionConfig{UNIT: RegionPixels, EXCLUDE: [][]float64{{50, 0, 50, 50}}}, RGB{200, 30, 30}},
+	}
+	for _, tc := range cases {
+		m, err := newRegionMask(tc.cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		small := downscale(m.Apply(splitImage()))
+		for _, e := range []ColorExtractor{histogramExtractor{}, meanExtractor{}, kmeansExtractor{k: 4}} {
+			got := e.Extract(small)
+			if e.Name() == ExtractorHistogram {
+				if want := quantizeRGB(tc.want, 16); got != want {
+					t.Errorf("%s/%s: expected %v, got %v", tc.name, e.Name(), want, got)
+				}
+			} else if colorDistance(got, tc.want) > 10 {
+				t.Errorf("%s/%s: expected about %v, got %v", tc.name, e.Name(), tc.want, got)
+			}
+		}
+	}
+}
+
+func TestRegionMask_CenterWeight(t *testing.T) {
+	m, _ := newRegionMask(RegionConfig{CENTER_WEIGHT: 1})
+	a := m.weights(image.Rect(0, 0, 100, 50))
+	if center := a.AlphaAt(50, 25).A; center < 250 {
+		t.Errorf("expected full weight in the center, got %d", center)
+	}
+	if corner := a.AlphaAt(0, 0).A; corner > 10 {
+		t.Errorf("expected no weight in the corner, got %d", corner)
+	}
+	if edge := a.AlphaAt(50, 0).A; edge < 120 || edge > 135 {
+		t.Errorf("expected half weight at the edge, got %d", edge)
+	}
+}
+
+func TestRegionMask_PNG(t *testing.T) {
+	// A 2x1 mask: keep the right half only
+	mask := image.NewGray(image.Rect(0, 0, 2, 1))
+	mask.SetGray(1, 0, color.Gray{255})
+	path := filepath.Join(t.TempDir(), "mask.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, mask); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cfg := RegionConfig{MASK: path}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+	m, err := newRegionMask(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := m.weights(image.Rect(0, 0, 100, 50))
+	if a.AlphaAt(5, 25).A != 0 || a.AlphaAt(95, 25).A != 255 {
+		t.Errorf("mask not stretched over the frame: left %d, right %d", a.AlphaAt(5, 25).A, a.AlphaAt(95, 25).A)
+	}
+}
+
+func TestPixelWeight(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.NRGBA{200, 100, 50, 128})
+	c, w := pixelWeight(img, 0, 0)
+	if colorDistance(c, RGB{200, 100, 50}) > 3 || w < 0.49 || w > 0.51 {
+		t.Errorf("expected unpremultiplied color at half weight, got %v %.2f", c, w)
+	}
+	if _, w := pixelWeight(img, 1, 0); w != 0 {
+		t.Errorf("expected zero weight for a transparent pixel, got %.2f", w)
+	}
+}
+
+func TestUnmaskedPixels(t *testing.T) {
+	img := splitImage()
+	if n := unmaskedPixels(img); n != 5000 {
+		t.Errorf("expected every pixel of a plain frame, got %d", n)
+	}
+	m, _ := newRegionMask(RegionConfig{EXCLUDE: [][]float64{{0, 0, 50, 100}}})
+	masked := m.Apply(img)
+	if n := unmaskedPixels(masked); n != 2500 {
+		t.Errorf("expected the right half, got %d", n)
+	}
+	// Log shares add up to 100% of what REGION left
+	top := topColors(masked, 10)
+	if e := newLogEntry(time.Now(), masked.Bounds(), top, unmaskedPixels(masked)); len(e.TopColors) != 1 || e.TopColors[0].Percent != 100 {
+		t.Errorf("expected one color at 100%%, got %+v", e.TopColors)
+	}
+
+	all, _ := newRegionMask(RegionConfig{EXCLUDE: [][]float64{{0, 0, 100, 100}}})
+	a, err := analyzeFrame(all.Apply(img), &Config{Env: defaultConfig().Env}, 5, false)
+	if err != nil {
+		t.Fatalf("analyzeFrame failed: %v", err)
+	}
+	for _, c := range a.Top {
+		if math.IsNaN(c.Percent) || math.IsInf(c.Percent, 0) {
+			t.Errorf("expected finite shares with everything masked, got %+v", a.Top)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Smoother sits between color analysis and output. It holds back new colors
+// until they persist for HOLD_MS (hysteresis), then moves towards them with
+// an exponential moving average limited to MAX_STEP per frame. It works on
+// slices so the zone mode can smooth every zone the same way.
+type Smoother struct {
+	cfg       SmoothingConfig
+	tolerance float64
+	dist      func(a, b RGB) float64
+
+	accepted       []RGB
+	candidate      []RGB
+	candidateSince time.Time
+	current        [][3]float64
+}
+
+// newSmoother creates a smoother. tolerance is the distance (in the metric of
+// dist) below which a flickering candidate still counts as the same color.
+func newSmoother(cfg SmoothingConfig, tolerance float64, dist func(a, b RGB) float64) *Smoother {
+	return &Smoother{cfg: cfg, tolerance: tolerance, dist: dist}
+}
+
+// Reset forgets all history, e.g. when the number of zones changes
+func (s *Smoother) Reset() {
+	s.accepted, s.candidate, s.current = nil, nil, nil
+}
+
+// Update feeds the colors of a new frame and returns the smoothed colors
+func (s *Smoother) Update(target []RGB, now time.Time) []RGB {
+	if len(s.current) != len(target) {
+		s.Reset()
+		s.accepted = append([]RGB(nil), target...)
+		s.candidate = s.accepted
+		s.candidateSince = now
+		s.current = make([][3]float64, len(target))
+		for i, c := range target {
+			s.current[i] = [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+		}
+		return append([]RGB(nil), target...)
+	}
+
+	// Hysteresis: only accept a new color once it has been stable for HOLD_MS
+	hold := time.Duration(s.cfg.HOLD_MS) * time.Millisecond
+	if hold <= 0 {
+		s.accepted = target
+	} else {
+		if maxColorDistance(target, s.candidate, s.dist) > s.tolerance {
+			s.candidate = target
+			s.candidateSince = now
+		}
+		if now.Sub(s.candidateSince) >= hold {
+			s.accepted = target
+		}
+	}
+
+	alpha := s.cfg.ALPHA
+	if alpha <= 0 || alpha > 1 {
+		alpha = 1
+	}
+	out := make([]RGB, len(target))
+	for i, goal := range s.accepted {
+		cur := s.current[i]
+		delta := [3]float64{
+			(float64(goal.R) - cur[0]) * alpha,
+			(float64(goal.G) - cur[1]) * alpha,
+			(float64(goal.B) - cur[2]) * alpha,
+		}
+		if s.cfg.MAX_STEP > 0 {
+			length := math.Sqrt(delta[0]*delta[0] + delta[1]*delta[1] + delta[2]*delta[2])
+			if length > s.cfg.MAX_STEP {
+				scale := s.cfg.MAX_STEP / length
+				delta[0], delta[1], delta[2] = delta[0]*scale, delta[1]*scale, delta[2]*scale
+			}
+		}
+		for ch := range cur {
+			cur[ch] += delta[ch]
+		}
+		s.current[i] = cur
+		out[i] = RGB{roundChannel(cur[0]), roundChannel(cur[1]), roundChannel(cur[2])}
+	}
+	return out
+}
+
+// roundChannel rounds and clamps a float channel value to 0-255
+func roundChannel(v float64) uint8 {
+	v = math.Round(v)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSmoother_PassThrough(t *testing.T) {
+	s := newSmoother(SmoothingConfig{}, 0, colorDistance)
+	now := time.Now()
+	s.Update([]RGB{{0, 0, 0}}, now)
+	if got := s.Update([]RGB{{200, 100, 50}}, now.Add(100*time.Millisecond)); got[0] != (RGB{200, 100, 50}) {
+		t.Errorf("expected unsmoothed color, got %v", got)
+	}
+}
+
+func TestSmoother_EMA(t *testing.T) {
+	s := newSmoother(SmoothingConfig{ALPHA: 0.5}, 0, colorDistance)
+	now := time.Now()
+	s.Update([]RGB{{0, 0, 0}}, now)
+	got := s.Update([]RGB{{200, 100, 0}}, now)
+	if got[0] != (RGB{100, 50, 0}) {
+		t.Errorf("expected half way after one frame, got %v", got)
+	}
+	got = s.Update([]RGB{{200, 100, 0}}, now)
+	if got[0] != (RGB{150, 75, 0}) {
+		t.Errorf("expected three quarters after two frames, got %v", got)
+	}
+}
+
+func TestSmoother_MaxStep(t *testing.T) {
+	s := newSmoother(SmoothingConfig{MAX_STEP: 10}, 0, colorDistance)
+	now := time.Now()
+	s.Update([]RGB{{0, 0, 0}}, now)
+	got := s.Update([]RGB{{255, 0, 0}}, now)
+	if got[0] != (RGB{10, 0, 0}) {
+		t.Errorf("expected step limited to 10, got %v", got)
+	}
+}
+
+func TestSmoother_Hold(t *testing.T) {
+	s := newSmoother(SmoothingConfig{HOLD_MS: 500}, 10, colorDistance)
+	now := time.Now()
+	red, blue := RGB{255, 0, 0}, RGB{0, 0, 255}
+	s.Update([]RGB{red}, now)
+
+	// A short flash is ignored
+	if got := s.Update([]RGB{blue}, now.Add(100*time.Millisecond)); got[0] != red {
+		t.Errorf("expected red during a short flash, got %v", got)
+	}
+	if got := s.Update([]RGB{red}, now.Add(200*time.Millisecond)); got[0] != red {
+		t.Errorf("expected red after the flash, got %v", got)
+	}
+
+	// A color that persists is taken over once HOLD_MS passed, small jitter
+	// within the tolerance does not restart the timer
+	s.Update([]RGB{blue}, now.Add(300*time.Millisecond))
+	if got := s.Update([]RGB{{0, 2, 250}}, now.Add(600*time.Millisecond)); got[0] != red {
+		t.Errorf("expected red before HOLD_MS, got %v", got)
+	}
+	if got := s.Update([]RGB{blue}, now.Add(800*time.Millisecond)); got[0] != blue {
+		t.Errorf("expected blue after HOLD_MS, got %v", got)
+	}
+}
+
+func TestSmoother_ZoneCountChange(t *testing.T) {
+	s := newSmoother(SmoothingConfig{ALPHA: 0.1}, 0, colorDistance)
+	now := time.Now()
+	s.Update([]RGB{{0, 0, 0}}, now)
+	got := s.Update([]RGB{{10, 10, 10}, {20, 20, 20}}, now)
+	if len(got) != 2 || got[0] != (RGB{10, 10, 10}) || got[1] != (RGB{20, 20, 20}) {
+		t.Errorf("expected a new zone layout to start from the raw colors, got %v", got)
+	}
+}
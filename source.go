@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // register JPEG for image and directory sources
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// Frame sources (SOURCE.TYPE)
+const (
+	SourceScreen    = "screen"    // live capture of the DISPLAY selection
+	SourceImage     = "image"     // one still image
+	SourceDirectory = "directory" // PNG/JPEG frames in name order, played at FPS
+	SourceVideo     = "video"     // video file decoded by ffmpeg
+)
+
+// DefaultSourceFPS is the playback rate of directory and video sources
+const DefaultSourceFPS = 10
+
+// errSourceEnded is returned by Next when a source without LOOP has no
+// frames left
+var errSourceEnded = errors.New("frame source ended")
+
+// SourceConfig selects where the sync loop gets its frames from
+type SourceConfig struct {
+	TYPE   string  `yaml:"TYPE"`   // screen (default), image, directory or video
+	PATH   string  `yaml:"PATH"`   // image file, frame directory or video file
+	FPS    float64 `yaml:"FPS"`    // playback rate of directory and video sources (default 10)
+	LOOP   bool    `yaml:"LOOP"`   // start over at the end instead of stopping sync
+	FFMPEG string  `yaml:"FFMPEG"` // ffmpeg binary for the video source (default ffmpeg from PATH)
+}
+
+func (s SourceConfig) validate() error {
+	switch s.TYPE {
+	case "", SourceScreen:
+		return nil
+	case SourceImage, SourceDirectory, SourceVideo:
+	default:
+		return fmt.Errorf("unknown SOURCE.TYPE %q, use screen, image, directory or video", s.TYPE)
+	}
+	if s.PATH == "" {
+		return fmt.Errorf("SOURCE.PATH is required for the %s source", s.TYPE)
+	}
+	if _, err := os.Stat(s.PATH); err != nil {
+		return fmt.Errorf("SOURCE.PATH: %w", err)
+	}
+	if s.FPS <= 0 {
+		return fmt.Errorf("SOURCE.FPS must be positive, got %v", s.FPS)
+	}
+	return nil
+}
+
+// finite reports whether the source runs out of frames and stops sync
+func (s SourceConfig) finite() bool {
+	return (s.TYPE == SourceDirectory || s.TYPE == SourceVideo) && !s.LOOP
+}
+
+// FrameSource delivers the frames the sync loop analyzes
+type FrameSource interface {
+	Name() string
+	// Next returns the current frames, one per captured display
+	Next() ([]*image.RGBA, error)
+	Close() error
+}
+
+// openFrameSource opens the source of the sync loop, tests replace it
+var openFrameSource = newFrameSource
+
+// newFrameSource opens the source selected by SOURCE.TYPE
+func newFrameSource(cfg SourceConfig) (FrameSource, error) {
+	switch cfg.TYPE {
+	case "", SourceScreen:
+		return screenSource{}, nil
+	case SourceImage:
+		return newImageSource(cfg.PATH)
+	case SourceDirectory:
+		return newDirectorySource(cfg.PATH, cfg.FPS, cfg.LOOP)
+	case SourceVideo:
+		return newVideoSource(cfg)
+	default:
+		return nil, fmt.Errorf("unknown SOURCE.TYPE %q", cfg.TYPE)
+	}
+}
+
+// screenSource captures the current display selection
+type screenSource struct{}
+
+func (screenSource) Name() string { return "screen" }
+
+func (screenSource) Next() ([]*image.RGBA, error) { return captureSelection() }
+
+func (screenSource) Close() error { return nil }
+
+// imageSource returns the same still image on every call
+type imageSource struct {
+	path  string
+	frame *image.RGBA
+}
+
+func newImageSource(path string) (*imageSource, error) {
+	frame, err := loadFrame(path)
+	if err != nil {
+		return nil, err
+	}
+	return &imageSource{path: path, frame: frame}, nil
+}
+
+func (s *imageSource) Name() string { return "image " + s.path }
+
+func (s *imageSource) Next() ([]*image.RGBA, error) { return []*image.RGBA{s.frame}, nil }
+
+func (s *imageSource) Close() error { return nil }
+
+// directorySource plays the images of a directory in name order. The frame
+// is picked by the time since the first call, so playback speed does not
+// depend on UPDATE_INTERVAL_MS.
+type directorySource struct {
+	dir   string
+	paths []string
+	fps   float64
+	loop  bool
+	now   func() time.Time
+
+	start   time.Time
+	current int
+	frame   *image.RGBA
+}
+
+func newDirectorySource(dir string, fps float64, loop bool) (*directorySource, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".png", ".jpg", ".jpeg":
+			if !e.IsDir() {
+				paths = append(paths, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no PNG or JPEG frames in %s", dir)
+	}
+	sort.Strings(paths)
+	return &directorySource{dir: dir, paths: paths, fps: fps, loop: loop, now: time.Now, current: -1}, nil
+}
+
+func (s *directorySource) Name() string {
+	return fmt.Sprintf("directory %s (%d frames at %g fps)", s.dir, len(s.paths), s.fps)
+}
+
+func (s *directorySource) Next() ([]*image.RGBA, error) {
+	if s.start.IsZero() {
+		s.start = s.now()
+	}
+	i := int(s.now().Sub(s.start).Seconds() * s.fps)
+	if i >= len(s.paths) {
+		if !s.loop {
+			return nil, errSourceEnded
+		}
+		i %= len(s.paths)
+	}
+	if i != s.current {
+		frame, err := loadFrame(s.paths[i])
+		if err != nil {
+			return nil, err
+		}
+		s.current, s.frame = i, frame
+	}
+	return []*image.RGBA{s.frame}, nil
+}
+
+func (s *directorySource) Close() error { return nil }
+
+// videoFirstFrameTimeout bounds how long Next waits for ffmpeg's first frame.
+// Until then the sync loop cannot see a stop request, so it fails and the
+// loop retries with backoff.
+var videoFirstFrameTimeout = 3 * time.Second
+
+// videoSource decodes a video with ffmpeg at FPS in real time. ffmpeg writes
+// PNG frames to a pipe, a goroutine keeps the latest one and Next returns it,
+// so slow iterations skip frames instead of slowing the video down.
+type videoSource struct {
+	path string
+	cmd  *exec.Cmd
+
+	mu     sync.Mutex
+	frame  *image.RGBA
+	err    error         // set when the stream ended or failed
+	first  chan struct{} // closed with the first frame or the end of the stream
+	stderr strings.Builder
+
+	closeOnce sync.Once
+	closed    chan struct{} // closed by Close
+	done      chan struct{} // closed once read has reaped ffmpeg
+}
+
+func newVideoSource(cfg SourceConfig) (*videoSource, error) {
+	ffmpeg := cfg.FFMPEG
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+	args := []string{"-hide_banner", "-loglevel", "error", "-re"}
+	if cfg.LOOP {
+		args = append(args, "-stream_loop", "-1")
+	}
+	args = append(args, "-i", cfg.PATH,
+		"-vf", "fps="+strconv.FormatFloat(cfg.FPS, 'f', -1, 64),
+		"-f", "image2pipe", "-vcodec", "png", "-compression_level", "0", "-")
+	v := &videoSource{path: cfg.PATH, first: make(chan struct{}), closed: make(chan struct{}), done: make(chan struct{})}
+	v.cmd = exec.Command(ffmpeg, args...)
+	v.cmd.Stderr = &v.stderr
+	out, err := v.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := v.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", ffmpeg, err)
+	}
+	go v.read(out)
+	return v, nil
+}
+
+func (v *videoSource) Name() string { return "video " + v.path }
+
+// read decodes frames until the pipe closes
+func (v *videoSource) read(out io.Reader) {
+	defer close(v.done)
+	err := readPNGStream(bufio.NewReader(out), func(frame *image.RGBA) {
+		v.mu.Lock()
+		if v.frame == nil {
+			close(v.first)
+		}
+		v.frame = frame
+		v.mu.Unlock()
+	})
+	waitErr := v.cmd.Wait()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	switch {
+	case err != nil:
+		v.err = fmt.Errorf("decoding %s: %w", v.path, err)
+	case waitErr != nil && v.frame == nil:
+		v.err = fmt.Errorf("ffmpeg failed on %s: %v %s", v.path, waitErr, strings.TrimSpace(v.stderr.String()))
+	default:
+		v.err = errSourceEnded
+	}
+	if v.frame == nil {
+		close(v.first)
+	}
+}
+
+func (v *videoSource) Next() ([]*image.RGBA, error) {
+	select {
+	case <-v.closed:
+		return nil, errSourceEnded
+	default:
+	}
+	timer := time.NewTimer(videoFirstFrameTimeout)
+	defer timer.Stop()
+	select {
+	case <-v.first:
+	case <-v.closed:
+		return nil, errSourceEnded
+	case <-timer.C:
+		return nil, fmt.Errorf("no frame from ffmpeg for %s yet", v.path)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.err != nil {
+		return nil, v.err
+	}
+	return []*image.RGBA{v.frame}, nil
+}
+
+// Close stops ffmpeg and waits until read has reaped it
+func (v *videoSource) Close() error {
+	v.closeOnce.Do(func() {
+		close(v.closed)
+		v.cmd.Process.Kill()
+		<-v.done
+	})
+	return nil
+}
+
+// readPNGStream decodes concatenated PNG images and calls fn for each one.
+// It returns nil at a clean end of the stream.
+func readPNGStream(r *bufio.Reader, fn func(*image.RGBA)) error {
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil
+		}
+		img, err := png.Decode(r)
+		if err != nil {
+			return err
+		}
+		fn(toRGBA(img))
+	}
+}
+
+// loadFrame decodes a PNG or JPEG file
+func loadFrame(path string) (*image.RGBA, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return toRGBA(img), nil
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
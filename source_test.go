@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeFrame saves a 40x20 PNG filled with c
+func writeFrame(t *testing.T, path string, c color.RGBA) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func frameColor(frames []*image.RGBA) RGB {
+	c := frames[0].RGBAAt(0, 0)
+	return RGB{c.R, c.G, c.B}
+}
+
+func TestImageSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "still.png")
+	writeFrame(t, path, color.RGBA{200, 30, 30, 255})
+	src, err := newFrameSource(SourceConfig{TYPE: SourceImage, PATH: path})
+	if err != nil {
+		t.Fatalf("newFrameSource failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		frames, err := src.Next()
+		if err != nil || len(frames) != 1 || frameColor(frames) != (RGB{200, 30, 30}) {
+			t.Fatalf("unexpected frame: %v", err)
+		}
+	}
+}
+
+func TestDirectorySource(t *testing.T) {
+	dir := t.TempDir()
+	writeFrame(t, filepath.Join(dir, "002.png"), color.RGBA{0, 0, 255, 255})
+	writeFrame(t, filepath.Join(dir, "001.png"), color.RGBA{255, 0, 0, 255})
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a frame"), 0o644)
+
+	for _, loop := range []bool{false, true} {
+		src, err := newDirectorySource(dir, 10, loop)
+		if err != nil {
+			t.Fatalf("newDirectorySource failed: %v", err)
+		}
+		now := time.Unix(0, 0)
+		src.now = func() time.Time { return now }
+		steps := []struct {
+			at   time.Duration
+			want RGB
+		}{
+			{0, RGB{255, 0, 0}},
+			{90 * time.Millisecond, RGB{255, 0, 0}},
+			{100 * time.Millisecond, RGB{0, 0, 255}},
+		}
+		for _, s := range steps {
+			now = time.Unix(0, 0).Add(s.at)
+			frames, err := src.Next()
+			if err != nil {
+				t.Fatalf("loop=%v at %s: %v", loop, s.at, err)
+			}
+			if got := frameColor(frames); got != s.want {
+				t.Errorf("loop=%v at %s: expected %v, got %v", loop, s.at, s.want, got)
+			}
+		}
+		now = time.Unix(0, 0).Add(200 * time.Millisecond)
+		frames, err := src.Next()
+		if loop {
+			if err != nil || frameColor(frames) != (RGB{255, 0, 0}) {
+				t.Errorf("expected the first frame again with LOOP, got %v", err)
+			}
+		} else if !errors.Is(err, errSourceEnded) {
+			t.Errorf("expected errSourceEnded without LOOP, got %v", err)
+		}
+	}
+
+	if _, err := newDirectorySource(t.TempDir(), 10, false); err == nil {
+		t.Error("expected error for a directory without frames")
+	}
+}
+
+func TestReadPNGStream(t *testing.T) {
+	var buf bytes.Buffer
+	for _, c := range []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}} {
+		img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		img.SetRGBA(0, 0, c)
+		png.Encode(&buf, img)
+	}
+	var got []RGB
+	err := readPNGStream(bufio.NewReader(&buf), func(frame *image.RGBA) {
+		got = append(got, frameColor([]*image.RGBA{frame}))
+	})
+	if err != nil {
+		t.Fatalf("readPNGStream failed: %v", err)
+	}
+	if len(got) != 3 || got[0] != (RGB{255, 0, 0}) || got[2] != (RGB{0, 0, 255}) {
+		t.Errorf("unexpected frames: %v", got)
+	}
+}
+
+func TestVideoSource(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not installed")
+	}
+	logger = zap.NewNop().Sugar()
+	dir := t.TempDir()
+	video := filepath.Join(dir, "clip.mp4")
+	gen := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error", "-f", "lavfi",
+		"-i", "color=c=red:s=64x36:d=0.3", "-pix_fmt", "yuv420p", video)
+	if out, err := gen.CombinedOutput(); err != nil {
+		t.Skipf("ffmpeg cannot create a test clip: %v %s", err, out)
+	}
+	src, err := newFrameSource(SourceConfig{TYPE: SourceVideo, PATH: video, FPS: 10})
+	if err != nil {
+		t.Fatalf("newFrameSource failed: %v", err)
+	}
+	defer src.Close()
+	frames, err := src.Next()
+	if err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+	if c := frameColor(frames); c.R < 200 || c.G > 40 || c.B > 40 {
+		t.Errorf("expected a red frame, got %v", c)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err = src.Next(); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !errors.Is(err, errSourceEnded) {
+		t.Errorf("expected errSourceEnded at the end of the clip, got %v", err)
+	}
+}
+
+func TestVideoSource_NoFrame(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as ffmpeg")
+	}
+	// An ffmpeg that hangs without ever writing a frame
+	fake := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(fake, []byte("#!/bin/sh\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	saved := videoFirstFrameTimeout
+	videoFirstFrameTimeout = 50 * time.Millisecond
+	defer func() { videoFirstFrameTimeout = saved }()
+
+	src, err := newVideoSource(SourceConfig{PATH: "stalled.mp4", FPS: 10, FFMPEG: fake})
+	if err != nil {
+		t.Fatalf("newVideoSource failed: %v", err)
+	}
+	if _, err := src.Next(); err == nil || errors.Is(err, errSourceEnded) {
+		t.Errorf("expected a retryable error without a first frame, got %v", err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		src.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	if src.cmd.ProcessState == nil {
+		t.Error("expected Close to reap ffmpeg")
+	}
+	if _, err := src.Next(); !errors.Is(err, errSourceEnded) {
+		t.Errorf("expected errSourceEnded after Close, got %v", err)
+	}
+}
+
+// TestSync_DirectorySource runs the whole loop on recorded frames and checks
+// what reaches the light
+func TestSync_DirectorySource(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	dir := t.TempDir()
+	writeFrame(t, filepath.Join(dir, "001.png"), color.RGBA{200, 30, 30, 255})
+	writeFrame(t, filepath.Join(dir, "002.png"), color.RGBA{30, 30, 200, 255})
+
+	cfg := defaultConfig()
+	cfg.Env.UPDATE_INTERVAL_MS = 5
+	cfg.Env.SOURCE = SourceConfig{TYPE: SourceDirectory, PATH: dir, FPS: 10}
+	appConfig = &cfg
+	out := &recordingOutput{state: &LightState{On: true, Color: RGB{1, 2, 3}, Brightness: 50}}
+	lightOutput = out
+
+	stopped := make(chan struct{}, 1)
+	onSyncStateChange(func(running bool) {
+		if !running {
+			select {
+			case stopped <- struct{}{}:
+			default:
+			}
+		}
+	})
+	if !startSync() {
+		t.Fatal("startSync failed")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		stopSync()
+		t.Fatal("sync did not stop at the end of the frames")
+	}
+
+	want := []RGB{quantizeRGB(RGB{200, 30, 30}, 16), quantizeRGB(RGB{30, 30, 200}, 16)}
+	if len(out.colors) != 2 || out.colors[0] != want[0] || out.colors[1] != want[1] {
+		t.Errorf("expected colors %v, got %v", want, out.colors)
+	}
+	if out.calls[len(out.calls)-1] != "restore" {
+		t.Errorf("expected the light to be restored at the end, calls: %v", out.calls)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Color roles of a target (TARGETS[].ROLE)
+const (
+	RoleDominant      = "dominant"      // the extracted color (default)
+	RoleSecond        = "second"        // the most frequent color clearly different from the dominant one
+	RoleComplementary = "complementary" // the dominant color with the opposite hue
+	RoleZone          = "zone"          // the average color of a screen area (ZONE)
+)
+
+// Screen areas of the zone role (TARGETS[].ZONE)
+const (
+	ZoneTop    = "top"
+	ZoneBottom = "bottom"
+	ZoneLeft   = "left"
+	ZoneRight  = "right"
+	ZoneCenter = "center"
+)
+
+// The second color must be at least this far (RGB distance) from the
+// dominant one, two quantization steps
+const secondMinDistance = 32
+
+// TargetConfig is one light of TARGETS
+type TargetConfig struct {
+	NAME             string     `yaml:"NAME"`             // shown in logs (default "target N")
+	TYPE             string     `yaml:"TYPE"`             // backend like OUTPUT.TYPE (default homeassistant)
+	ENTITY           string     `yaml:"ENTITY"`           // Home Assistant entity (default LED_ENTITY)
+	WLED             WLEDConfig `yaml:"WLED"`             // settings of the wled backend
+	MQTT             MQTTConfig `yaml:"MQTT"`             // settings of the mqtt backend
+	ROLE             string     `yaml:"ROLE"`             // dominant (default), second, complementary or zone
+	ZONE             string     `yaml:"ZONE"`             // top, bottom, left, right or center for the zone role
+	BRIGHTNESS_SCALE float64    `yaml:"BRIGHTNESS_SCALE"` // factor for the brightness, 0-1 (0 = 1)
+}
+
+func (t TargetConfig) validate(name string) error {
+	switch strings.ToLower(t.TYPE) {
+	case "", OutputHomeAssistant, OutputHomeAssistantWS, OutputWLED, OutputMQTT:
+	default:
+		return fmt.Errorf("unknown %s.TYPE %q", name, t.TYPE)
+	}
+	switch t.ROLE {
+	case "", RoleDominant, RoleSecond, RoleComplementary:
+	case RoleZone:
+		switch t.ZONE {
+		case ZoneTop, ZoneBottom, ZoneLeft, ZoneRight, ZoneCenter:
+		default:
+			return fmt.Errorf("%s.ZONE must be top, bottom, left, right or center, got %q", name, t.ZONE)
+		}
+	default:
+		return fmt.Errorf("unknown %s.ROLE %q, use dominant, second, complementary or zone", name, t.ROLE)
+	}
+	if t.BRIGHTNESS_SCALE < 0 || t.BRIGHTNESS_SCALE > 1 {
+		return fmt.Errorf("%s.BRIGHTNESS_SCALE must be between 0 and 1, got %v", name, t.BRIGHTNESS_SCALE)
+	}
+	return nil
+}
+
+// target is one light of a targetsOutput. A goroutine per target sends the
+// updates, so a slow light only drops frames of its own.
+type target struct {
+	name  string
+	role  string
+	zone  int // index into the color vector for the zone role
+	scale float64
+	out   LightOutput
+	// updates holds only the newest color the light has not picked up yet
+	updates chan targetUpdate
+
+	mu                sync.Mutex // held while calling out
+	health            outputHealth
+	applied           *RGB
+	appliedBrightness int
+	// generation is bumped under mu before each calls the light directly.
+	// Updates queued before that are stale and dropped by run.
+	generation atomic.Uint64
+}
+
+type targetUpdate struct {
+	color      RGB
+	brightness int
+	generation uint64
+}
+
+// targetsOutput drives several lights from one capture, each with its own
+// backend and color role
+type targetsOutput struct {
+	targets []*target
+	// zones lists the screen areas of zone targets. The color vector of
+	// RoleColors holds the dominant color, the second color and then one
+	// color per zone.
+	zones      []Zone
+	needSecond bool
+
+	threshold           float64
+	brightnessThreshold int
+	distance            func(a, b RGB) float64
+	running             sync.WaitGroup
+	closeOnce           sync.Once
+}
+
+func newTargetsOutput(cfg *Config) (*targetsOutput, error) {
+	return newTargetsOutputWith(cfg, newTargetOutput)
+}
+
+// newTargetsOutputWith creates the targets with open, tests pass fake lights
+func newTargetsOutputWith(cfg *Config, open func(cfg *Config, tc TargetConfig, name string) (LightOutput, error)) (*targetsOutput, error) {
+	distance, err := colorDistanceFunc(cfg.Env.COLOR_DISTANCE_METRIC)
+	if err != nil {
+		return nil, err
+	}
+	o := &targetsOutput{
+		threshold:           cfg.Env.COLOR_CHANGE_THRESHOLD,
+		brightnessThreshold: cfg.Env.BRIGHTNESS.CHANGE_THRESHOLD,
+		distance:            distance,
+	}
+	zoneIndex := make(map[string]int)
+	for i, tc := range cfg.Env.TARGETS {
+		t := &target{name: tc.NAME, role: tc.ROLE, scale: tc.BRIGHTNESS_SCALE, updates: make(chan targetUpdate, 1)}
+		if t.name == "" {
+			t.name = fmt.Sprintf("target %d", i+1)
+		}
+		if t.role == "" {
+			t.role = RoleDominant
+		}
+		if t.scale <= 0 {
+			t.scale = 1
+		}
+		switch t.role {
+		case RoleSecond:
+			o.needSecond = true
+		case RoleZone:
+			idx, ok := zoneIndex[tc.ZONE]
+			if !ok {
+				idx = 2 + len(o.zones)
+				zoneIndex[tc.ZONE] = idx
+				o.zones = append(o.zones, namedZone(tc.ZONE, cfg.Env.ZONES.DEPTH_PERCENT))
+			}
+			t.zone = idx
+		}
+		if t.out, err = open(cfg, tc, t.name); err != nil {
+			o.closeOutputs()
+			return nil, fmt.Errorf("%s: %w", t.name, err)
+		}
+		o.targets = append(o.targets, t)
+	}
+	for _, t := range o.targets {
+		o.running.Add(1)
+		go func() {
+			defer o.running.Done()
+			o.run(t)
+		}()
+	}
+	return o, nil
+}
+
+// newTargetOutput creates the backend of one target through newLightOutput
+// with the target's settings in place of OUTPUT and LED_ENTITY
+func newTargetOutput(cfg *Config, tc TargetConfig, name string) (LightOutput, error) {
+	sub := *cfg
+	sub.Env.TARGETS = nil
+	sub.Env.OUTPUT = OutputConfig{TYPE: tc.TYPE, WLED: tc.WLED, MQTT: tc.MQTT}
+	if tc.ENTITY != "" {
+		sub.Env.LED_ENTITY = tc.ENTITY
+	}
+	if strings.ToLower(tc.TYPE) == OutputMQTT && tc.MQTT.CLIENT_ID == "" {
+		// Brokers drop one of two connections with the same client id
+		sub.Env.OUTPUT.MQTT.CLIENT_ID = "led-screen-sync-" + name
+	}
+	return newLightOutput(&sub)
+}
+
+// namedZone returns the screen area of a ZONE name. The edges are as deep as
+// the zone mode strips (ZONES.DEPTH_PERCENT).
+func namedZone(name string, depthPercent float64) Zone {
+	d := depthPercent / 100
+	if d <= 0 || d > 0.5 {
+		d = 0.1
+	}
+	switch name {
+	case ZoneTop:
+		return Zone{0, 0, 1, d}
+	case ZoneBottom:
+		return Zone{0, 1 - d, 1, 1}
+	case ZoneLeft:
+		return Zone{0, 0, d, 1}
+	case ZoneRight:
+		return Zone{1 - d, 0, 1, 1}
+	default:
+		return Zone{0.25, 0.25, 0.75, 0.75}
+	}
+}
+
+func (o *targetsOutput) Name() string {
+	names := make([]string, len(o.targets))
+	for i, t := range o.targets {
+		names[i] = t.name
+	}
+	return fmt.Sprintf("%d targets (%s)", len(o.targets), strings.Join(names, ", "))
+}
+
+func (o *targetsOutput) Capabilities() Capabilities {
+	return Capabilities{Color: true, Brightness: true}
+}
+
+// RoleColors analyzes a frame for every role the targets use
+func (o *targetsOutput) RoleColors(img image.Image, extractor ColorExtractor) []RGB {
+	dominant := extractor.Extract(img)
+	second := dominant
+	if o.needSecond {
+		second = secondColor(img, dominant)
+	}
+	return append([]RGB{dominant, second}, zoneColors(img, o.zones)...)
+}
+
+// Update queues the color of each target's role. It does not wait for the
+// lights; each target skips colors within COLOR_CHANGE_THRESHOLD of the one
+// it last applied.
+func (o *targetsOutput) Update(colors []RGB, brightness int) {
+	for _, t := range o.targets {
+		u := targetUpdate{color: t.pick(colors), brightness: t.brightness(brightness), generation: t.generation.Load()}
+		select {
+		case <-t.updates: // replaced by the newer frame
+		default:
+		}
+		t.updates <- u
+	}
+}
+
+// run sends the queued updates of one target until Close
+func (o *targetsOutput) run(t *target) {
+	for u := range t.updates {
+		t.mu.Lock()
+		if u.generation != t.generation.Load() {
+			// Taken off the channel before each ran, e.g. the last frame
+			// before RestoreState on stop
+			t.mu.Unlock()
+			continue
+		}
+		if t.applied == nil || o.distance(u.color, *t.applied) >= o.threshold ||
+			absInt(u.brightness-t.appliedBrightness) >= o.brightnessThreshold {
+			err := syncMetrics.timeOutput(func() error { return t.out.SetColor(u.color, u.brightness) })
+			if t.health.report(t.name, err) {
+				t.applied, t.appliedBrightness = &u.color, u.brightness
+			}
+		} else {
+			syncMetrics.framesSkipped.Inc(t.name)
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *target) pick(colors []RGB) RGB {
+	switch t.role {
+	case RoleSecond:
+		return colors[1]
+	case RoleComplementary:
+		return complementary(colors[0])
+	case RoleZone:
+		return colors[t.zone]
+	default:
+		return colors[0]
+	}
+}
+
+// brightness scales b for the target, keeping at least 1 so a dimmed target
+// is not switched off
+func (t *target) brightness(b int) int {
+	return max(1, int(math.Round(float64(b)*t.scale)))
+}
+
+// each runs fn for every target at the same time and waits for all of them.
+// Queued updates, and one run may already hold, are dropped so they cannot
+// overwrite what fn does.
+func (o *targetsOutput) each(fn func(i int, t *target) error) error {
+	errs := make([]error, len(o.targets))
+	var wg sync.WaitGroup
+	for i, t := range o.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-t.updates:
+			default:
+			}
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.generation.Add(1)
+			if err := fn(i, t); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", t.name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// GetState reads every light. The result holds one state per target for
+// RestoreState; it fails only if no light could be read.
+func (o *targetsOutput) GetState() (*LightState, error) {
+	states := make([]*LightState, len(o.targets))
+	err := o.each(func(i int, t *target) error {
+		state, err := t.out.GetState()
+		states[i] = state
+		return err
+	})
+	// On, Color and Brightness describe the first light that could be read,
+	// for the log
+	for _, state := range states {
+		if state != nil {
+			if err != nil {
+				logger.Warnf("Failed to get the state of some targets: %v", err)
+			}
+			return &LightState{On: state.On, Color: state.Color, Brightness: state.Brightness, raw: states}, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no target reported its state")
+	}
+	return nil, err
+}
+
+// SetColor sends the same color to every light, e.g. the PAUSE color
+func (o *targetsOutput) SetColor(c RGB, brightness int) error {
+	return o.each(func(_ int, t *target) error {
+		b := t.brightness(brightness)
+		if err := t.out.SetColor(c, b); err != nil {
+			return err
+		}
+		t.applied, t.appliedBrightness = &c, b
+		return nil
+	})
+}
+
+func (o *targetsOutput) SetPower(on bool) error {
+	return o.each(func(_ int, t *target) error {
+		t.applied = nil
+		return t.out.SetPower(on)
+	})
+}
+
+func (o *targetsOutput) RestoreState(state *LightState) error {
+	states, _ := state.raw.([]*LightState)
+	return o.each(func(i int, t *target) error {
+		t.applied = nil
+		if i >= len(states) || states[i] == nil {
+			return nil // the state could not be read when sync started
+		}
+		return t.out.RestoreState(states[i])
+	})
+}
+
+func (o *targetsOutput) SetTransition(d time.Duration) {
+	for _, t := range o.targets {
+		if tr, ok := t.out.(TransitionOutput); ok {
+			tr.SetTransition(d)
+		}
+	}
+}
+
+func (o *targetsOutput) Close() error {
+	o.closeOnce.Do(func() {
+		for _, t := range o.targets {
+			close(t.updates)
+		}
+		o.running.Wait()
+	})
+	return o.closeOutputs()
+}
+
+func (o *targetsOutput) closeOutputs() error {
+	var errs []error
+	for _, t := range o.targets {
+		if err := t.out.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// secondColor returns the most frequent color that is clearly different from
+// dominant, or dominant if there is none
+func secondColor(img image.Image, dominant RGB) RGB {
+	for _, c := range topColors(img, 10) {
+		if !isBlackOrWhite(c.Color) && colorDistance(c.Color, dominant) >= secondMinDistance {
+			return c.Color
+		}
+	}
+	return dominant
+}
+
+// complementary returns c with its hue rotated by 180 degrees
+func complementary(c RGB) RGB {
+	h, s, l := rgbToHSL(c)
+	return hslToRGB(math.Mod(h+180, 360), s, l)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// targetLight is a thread safe fake light for targetsOutput
+type targetLight struct {
+	recordingOutput
+	mu      sync.Mutex
+	sent    []string
+	release chan struct{} // if set, SetColor waits for it
+}
+
+func (l *targetLight) SetColor(c RGB, brightness int) error {
+	if l.release != nil {
+		<-l.release
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sent = append(l.sent, colorCall(c, brightness))
+	return nil
+}
+
+func (l *targetLight) calls() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.sent...)
+}
+
+func colorCall(c RGB, brightness int) string {
+	return fmt.Sprintf("color %d,%d,%d@%d", c.R, c.G, c.B, brightness)
+}
+
+// waitForCalls polls until the light has n calls
+func waitForCalls(t *testing.T, l *targetLight, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(l.calls()) < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return l.calls()
+}
+
+func setupTargets(t *testing.T, targets []TargetConfig, lights []*targetLight) *targetsOutput {
+	t.Helper()
+	logger = zap.NewNop().Sugar()
+	cfg := defaultConfig()
+	cfg.Env.TARGETS = targets
+	i := 0
+	out, err := newTargetsOutputWith(&cfg, func(*Config, TargetConfig, string) (LightOutput, error) {
+		i++
+		return lights[i-1], nil
+	})
+	if err != nil {
+		t.Fatalf("newTargetsOutputWith failed: %v", err)
+	}
+	t.Cleanup(func() { out.Close() })
+	return out
+}
+
+func TestTargets_Roles(t *testing.T) {
+	// Red on the left 60%, blue on the right
+	img := image.NewRGBA(image.Rect(0, 0, 50, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 50; x++ {
+			c := color.RGBA{224, 32, 32, 255}
+			if x >= 30 {
+				c = color.RGBA{32, 32, 224, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	lights := []*targetLight{{}, {}, {}, {}}
+	out := setupTargets(t, []TargetConfig{
+		{NAME: "strip"},
+		{NAME: "lamp", ROLE: RoleSecond},
+		{NAME: "bulb", ROLE: RoleComplementary},
+		{NAME: "right", ROLE: RoleZone, ZONE: ZoneRight, BRIGHTNESS_SCALE: 0.5},
+	}, lights)
+
+	out.Update(out.RoleColors(img, histogramExtractor{}), 200)
+	want := []string{
+		colorCall(RGB{224, 32, 32}, 200),
+		colorCall(RGB{32, 32, 224}, 200),
+		colorCall(RGB{32, 224, 224}, 200),
+		colorCall(RGB{32, 32, 224}, 100),
+	}
+	for i, l := range lights {
+		if got := waitForCalls(t, l, 1); len(got) != 1 || got[0] != want[i] {
+			t.Errorf("target %d: expected %v, got %v", i, want[i], got)
+		}
+	}
+}
+
+func TestTargets_SlowLightDoesNotBlock(t *testing.T) {
+	slow := &targetLight{release: make(chan struct{})}
+	fast := &targetLight{}
+	out := setupTargets(t, []TargetConfig{{NAME: "slow"}, {NAME: "fast"}}, []*targetLight{slow, fast})
+
+	colors := []RGB{{255, 0, 0}, {0, 255, 0}, {0, 0, 255}}
+	for _, c := range colors {
+		done := make(chan struct{})
+		go func() {
+			out.Update([]RGB{c, c}, 255)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Update waited for the slow light")
+		}
+		waitForCalls(t, fast, len(fast.calls())+1)
+		if c == colors[0] {
+			// The slow light is busy with the first color from here on
+			for deadline := time.Now().Add(time.Second); len(out.targets[0].updates) > 0 && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if got := fast.calls(); len(got) != 3 {
+		t.Errorf("expected the fast light to get every color, got %v", got)
+	}
+
+	// The slow light finishes the first color and then jumps to the newest
+	close(slow.release)
+	got := waitForCalls(t, slow, 2)
+	if len(got) != 2 || got[0] != colorCall(colors[0], 255) || got[1] != colorCall(colors[2], 255) {
+		t.Errorf("expected the first and the newest color, got %v", got)
+	}
+}
+
+func TestTargets_Threshold(t *testing.T) {
+	light := &targetLight{}
+	out := setupTargets(t, []TargetConfig{{}}, []*targetLight{light})
+	out.threshold = 10
+	c := []RGB{{100, 100, 100}, {100, 100, 100}}
+	out.Update(c, 255)
+	waitForCalls(t, light, 1)
+	out.Update([]RGB{{102, 100, 100}, {0, 0, 0}}, 255)
+	out.Update([]RGB{{150, 100, 100}, {0, 0, 0}}, 255)
+	if got := waitForCalls(t, light, 2); len(got) != 2 || got[1] != colorCall(RGB{150, 100, 100}, 255) {
+		t.Errorf("expected changes below the threshold to be skipped, got %v", got)
+	}
+
+	// A skipped frame counts once for the target that skipped it
+	saved := syncMetrics
+	syncMetrics = newMetrics()
+	defer func() { syncMetrics = saved }()
+	out.Update([]RGB{{150, 100, 100}, {0, 0, 0}}, 255)
+	deadline := time.Now().Add(time.Second)
+	for syncMetrics.framesSkipped.Get("target 1") == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := syncMetrics.framesSkipped.Get("target 1"); n != 1 || syncMetrics.framesSkipped.Get("") != 0 {
+		t.Errorf("expected one skipped frame for target 1, got %d and %d unlabeled", n, syncMetrics.framesSkipped.Get(""))
+	}
+}
+
+func TestTargets_InFlightUpdateDropped(t *testing.T) {
+	light := &targetLight{}
+	out := setupTargets(t, []TargetConfig{{}}, []*targetLight{light})
+
+	// run takes the update off the channel and waits for the lock while each
+	// holds it, e.g. for RestoreState on stop
+	tg := out.targets[0]
+	tg.mu.Lock()
+	out.Update([]RGB{{200, 0, 0}, {0, 0, 0}}, 255)
+	deadline := time.Now().Add(time.Second)
+	for len(tg.updates) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	tg.generation.Add(1) // what each does before fn
+	tg.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	if got := light.calls(); len(got) != 0 {
+		t.Errorf("expected the update taken before each to be dropped, got %v", got)
+	}
+	// Later frames are sent again
+	out.Update([]RGB{{0, 200, 0}, {0, 0, 0}}, 255)
+	if got := waitForCalls(t, light, 1); len(got) != 1 || got[0] != colorCall(RGB{0, 200, 0}, 255) {
+		t.Errorf("expected the next frame to be sent, got %v", got)
+	}
+}
+
+func TestTargets_StateAndRestore(t *testing.T) {
+	a := &targetLight{recordingOutput: recordingOutput{state: &LightState{On: true, Color: RGB{1, 2, 3}}}}
+	b := &targetLight{recordingOutput: recordingOutput{err: errors.New("unreachable")}}
+	out := setupTargets(t, []TargetConfig{{NAME: "a"}, {NAME: "b"}}, []*targetLight{a, b})
+
+	state, err := out.GetState()
+	if err != nil {
+		t.Fatalf("GetState failed although one light answered: %v", err)
+	}
+	b.err = nil
+	if err := out.RestoreState(state); err != nil {
+		t.Fatalf("RestoreState failed: %v", err)
+	}
+	if a.restored != a.state || b.restored != nil {
+		t.Errorf("expected only the light with a saved state to be restored, got %v and %v", a.restored, b.restored)
+	}
+}
+
+func TestComplementary(t *testing.T) {
+	cases := map[RGB]RGB{
+		{255, 0, 0}:     {0, 255, 255},
+		{0, 0, 255}:     {255, 255, 0},
+		{128, 128, 128}: {128, 128, 128},
+	}
+	for in, want := range cases {
+		if got := complementary(in); got != want {
+			t.Errorf("complementary(%v) = %v, want %v", in, got, want)
+		}
+	}
+	for _, c := range []RGB{{12, 200, 99}, {250, 30, 180}, {40, 40, 41}} {
+		h, s, l := rgbToHSL(c)
+		if got := hslToRGB(h, s, l); colorDistance(got, c) > 1.8 {
+			t.Errorf("hslToRGB(rgbToHSL(%v)) = %v", c, got)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+//go:build !notray
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/getlantern/systray"
+	"github.com/sqweek/dialog"
+)
+
+const githubURL = "https://github.com/aldjinn/led-screen-sync"
+
+// runTray runs the system tray frontend until the user quits or a signal
+// arrives on sigChan
+func runTray(sigChan <-chan os.Signal) {
+	go func() {
+		sig := <-sigChan
+		logger.Infof("Received %s, exiting LED Sync app", sig)
+		systray.Quit()
+	}()
+	systray.Run(onReady, onExit)
+}
+
+// showAboutDialog displays an About dialog with version info and option to open GitHub
+func showAboutDialog() {
+	aboutText := fmt.Sprintf("LED Screen Sync\n\nVersion: %s\nCommit: %.8s\nBuilt: %s\n\nGitHub: %s\n\nWould you like to open the GitHub repository?",
+		version, commit, date, githubURL)
+
+	// Show the info dialog with Yes/No buttons
+	choice := dialog.Message("%s", aboutText).
+		Title("About LED Screen Sync").
+		YesNo()
+
+	// If user clicked Yes, open GitHub repository
+	if choice {
+		openGitHubRepo()
+	}
+}
+
+// openGitHubRepo opens the GitHub repository in the default browser
+func openGitHubRepo() {
+	openBrowser(githubURL)
+}
+
+// addDisplayMenu adds a submenu to choose the captured display(s)
+func addDisplayMenu() {
+	mDisplay := systray.AddMenuItem("Display", "Choose the display to capture")
+	current := getDisplaySelection()
+	type choice struct {
+		item *systray.MenuItem
+		sel  DisplaySelection
+	}
+	var choices []choice
+	for i, b := range listDisplays() {
+		sel := DisplaySelection{Mode: DisplaySingle, Index: i}
+		title := fmt.Sprintf("Display %d: %dx%d at (%d,%d)", i, b.Dx(), b.Dy(), b.Min.X, b.Min.Y)
+		checked := current.Mode == DisplaySingle && current.Index == i
+		choices = append(choices, choice{mDisplay.AddSubMenuItemCheckbox(title, "Capture only this display", checked), sel})
+	}
+	all := DisplaySelection{Mode: DisplayCombined}
+	choices = append(choices, choice{mDisplay.AddSubMenuItemCheckbox("All displays combined", "Reduce all displays to one color",
+		current.Mode == DisplayCombined), all})
+	desktop := DisplaySelection{Mode: DisplayVirtual}
+	choices = append(choices, choice{mDisplay.AddSubMenuItemCheckbox("Virtual desktop", "Capture the whole virtual desktop as one rectangle",
+		current.Mode == DisplayVirtual), desktop})
+
+	// Keep the configured rectangle/indexes when re-selecting the configured mode
+	for i := range choices {
+		if choices[i].sel.Mode == current.Mode && current.Mode != DisplaySingle {
+			choices[i].sel = current
+		}
+	}
+
+	for i := range choices {
+		c := choices[i]
+		go func() {
+			for range c.item.ClickedCh {
+				for _, other := range choices {
+					other.item.Uncheck()
+				}
+				c.item.Check()
+				setDisplaySelection(c.sel)
+			}
+		}()
+	}
+}
+
+// addProfileMenu adds a submenu to switch smoothing profiles, if any are configured
+func addProfileMenu() {
+	if len(appConfig.Env.PROFILES) == 0 {
+		return
+	}
+	names := make([]string, 0, len(appConfig.Env.PROFILES))
+	for name := range appConfig.Env.PROFILES {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	names = append([]string{""}, names...)
+
+	mProfile := systray.AddMenuItem("Profile", "Choose the smoothing profile")
+	current := getProfile()
+	items := make([]*systray.MenuItem, len(names))
+	for i, name := range names {
+		title := name
+		if name == "" {
+			title = "Default"
+		}
+		items[i] = mProfile.AddSubMenuItemCheckbox(title, "Use these smoothing settings", name == current)
+	}
+	for i := range items {
+		item, name := items[i], names[i]
+		go func() {
+			for range item.ClickedCh {
+				if err := setProfile(name); err != nil {
+					logger.Errorf("Failed to switch profile: %v", err)
+					continue
+				}
+				for _, other := range items {
+					other.Uncheck()
+				}
+				item.Check()
+			}
+		}()
+	}
+}
+
+func onReady() {
+	systray.SetIcon(ledIcon)
+	systray.SetTitle("LED Sync")
+	systray.SetTooltip("LED Screen Sync")
+	// You can set a custom icon here with systray.SetIcon([]byte{})
+	mStart := systray.AddMenuItem("Start Sync", "Start color updates")
+	mStop := systray.AddMenuItem("Stop Sync", "Stop color updates")
+	mTurnOn := systray.AddMenuItem("Turn On", "Turn on the LED strip")
+	mTurnOff := systray.AddMenuItem("Turn Off", "Turn off the LED strip")
+	systray.AddSeparator()
+	addDisplayMenu()
+	addProfileMenu()
+	systray.AddSeparator()
+	mAbout := systray.AddMenuItem("About", "About LED Screen Sync")
+	mQuit := systray.AddMenuItem("Quit", "Quit the app")
+	mStop.Disable()
+
+	// Keep Start/Stop in sync when the control API starts or stops sync
+	onSyncStateChange(func(running bool) {
+		if running {
+			mStart.Disable()
+			mStop.Enable()
+		} else {
+			mStart.Enable()
+			mStop.Disable()
+		}
+	})
+
+	// Show in the tooltip why sync is paused
+	onPauseChange(func(paused bool, reason string) {
+		if paused {
+			systray.SetTooltip("LED Screen Sync - paused: " + reason)
+		} else {
+			systray.SetTooltip("LED Screen Sync")
+		}
+	})
+
+	go func() {
+		for {
+			select {
+			case <-mStart.ClickedCh:
+				startSync()
+			case <-mStop.ClickedCh:
+				stopSync()
+			case <-mTurnOn.ClickedCh:
+				go func() {
+					err := setLEDOnOff(lightOutput, true)
+					if err != nil {
+						logger.Errorf("Failed to turn on LED: %v", err)
+					}
+				}()
+			case <-mTurnOff.ClickedCh:
+				go func() {
+					err := setLEDOnOff(lightOutput, false)
+					if err != nil {
+						logger.Errorf("Failed to turn off LED: %v", err)
+					}
+				}()
+			case <-mAbout.ClickedCh:
+				go showAboutDialog()
+			case <-mQuit.ClickedCh:
+				logger.Infof("Exiting LED Sync app")
+				systray.Quit()
+			}
+		}
+	}()
+}
+
+// onExit runs when the tray quits, including on Windows session end
+func onExit() {
+	shutdown()
+}
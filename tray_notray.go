@@ -0,0 +1,12 @@
+//go:build notray
+
+package main
+
+import "os"
+
+// runTray is used by builds without the system tray (-tags notray), which
+// always run headless
+func runTray(sigChan <-chan os.Signal) {
+	logger.Warn("Built without system tray support, running headless")
+	runHeadless(sigChan)
+}
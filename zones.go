@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// Sync modes (MODE)
+const (
+	ModeSingle = "single" // whole screen reduced to one color
+	ModeZones  = "zones"  // one color per screen edge zone (Ambilight)
+)
+
+// Zone is a rectangle of the screen, in fractions (0-1) of the frame size
+type Zone struct {
+	X0, Y0, X1, Y1 float64
+}
+
+// Rect maps the zone onto a frame with the given bounds, always covering at
+// least one pixel
+func (z Zone) Rect(bounds image.Rectangle) image.Rectangle {
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	r := image.Rect(
+		bounds.Min.X+int(z.X0*w),
+		bounds.Min.Y+int(z.Y0*h),
+		bounds.Min.X+int(z.X1*w+0.5),
+		bounds.Min.Y+int(z.Y1*h+0.5),
+	)
+	if r.Dx() < 1 {
+		r.Max.X = r.Min.X + 1
+	}
+	if r.Dy() < 1 {
+		r.Max.Y = r.Min.Y + 1
+	}
+	return r.Intersect(bounds)
+}
+
+// buildZoneLayout returns one zone per LED, in LED order. Zones are laid out
+// clockwise from the top-left corner (top left to right, right top to bottom,
+// bottom right to left, left bottom to top) and then rotated and/or reversed
+// so LED 0 sits at the configured start corner.
+func buildZoneLayout(cfg ZonesConfig) ([]Zone, error) {
+	if cfg.TOP < 0 || cfg.RIGHT < 0 || cfg.BOTTOM < 0 || cfg.LEFT < 0 {
+		return nil, fmt.Errorf("zone LED counts must not be negative")
+	}
+	total := cfg.TOP + cfg.RIGHT + cfg.BOTTOM + cfg.LEFT
+	if total == 0 {
+		return nil, fmt.Errorf("no zones configured, set ZONES.TOP/RIGHT/BOTTOM/LEFT")
+	}
+	depth := cfg.DEPTH_PERCENT / 100
+	if depth <= 0 {
+		depth = 0.1
+	}
+	if depth > 0.5 {
+		return nil, fmt.Errorf("ZONES.DEPTH_PERCENT must be at most 50")
+	}
+
+	cw := make([]Zone, 0, total)
+	for i := 0; i < cfg.TOP; i++ {
+		n := float64(cfg.TOP)
+		cw = append(cw, Zone{float64(i) / n, 0, float64(i+1) / n, depth})
+	}
+	for i := 0; i < cfg.RIGHT; i++ {
+		n := float64(cfg.RIGHT)
+		cw = append(cw, Zone{1 - depth, float64(i) / n, 1, float64(i+1) / n})
+	}
+	for i := 0; i < cfg.BOTTOM; i++ {
+		n := float64(cfg.BOTTOM)
+		cw = append(cw, Zone{1 - float64(i+1)/n, 1 - depth, 1 - float64(i)/n, 1})
+	}
+	for i := 0; i < cfg.LEFT; i++ {
+		n := float64(cfg.LEFT)
+		cw = append(cw, Zone{0, 1 - float64(i+1)/n, depth, 1 - float64(i)/n})
+	}
+
+	// Index in cw of the first LED after each corner, going clockwise
+	var start int
+	switch strings.ToLower(cfg.START) {
+	case "", "top-left":
+		start = 0
+	case "top-right":
+		start = cfg.TOP
+	case "bottom-right":
+		start = cfg.TOP + cfg.RIGHT
+	case "bottom-left":
+		start = cfg.TOP + cfg.RIGHT + cfg.BOTTOM
+	default:
+		return nil, fmt.Errorf("unknown ZONES.START %q", cfg.START)
+	}
+
+	zones := make([]Zone, total)
+	switch strings.ToLower(cfg.DIRECTION) {
+	case "", "clockwise", "cw":
+		for i := range zones {
+			zones[i] = cw[(start+i)%total]
+		}
+	case "counterclockwise", "ccw":
+		for i := range zones {
+			zones[i] = cw[((start-1-i)%total+total)%total]
+		}
+	default:
+		return nil, fmt.Errorf("unknown ZONES.DIRECTION %q", cfg.DIRECTION)
+	}
+	return zones, nil
+}
+
+// averageColor returns the mean color of the pixels inside r
+func averageColor(img image.Image, r image.Rectangle) RGB {
+	var sr, sg, sb, n float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c, w := pixelWeight(img, x, y)
+			sr += float64(c.R) * w
+			sg += float64(c.G) * w
+			sb += float64(c.B) * w
+			n += w
+		}
+	}
+	if n == 0 {
+		return RGB{}
+	}
+	return RGB{uint8(sr / n), uint8(sg / n), uint8(sb / n)}
+}
+
+// zoneColors computes one color per zone from the border strips of img
+func zoneColors(img image.Image, zones []Zone) []RGB {
+	colors := make([]RGB, len(zones))
+	for i, z := range zones {
+		colors[i] = averageColor(img, z.Rect(img.Bounds()))
+	}
+	return colors
+}
+
+// maxColorDistance returns the largest distance between matching entries of
+// a and b, used to decide whether a zone frame changed enough to send
+func maxColorDistance(a, b []RGB, dist func(a, b RGB) float64) float64 {
+	var max float64
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if d := dist(a[i], b[i]); d > max {
+			max = d
+		}
+	}
+	return max
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBuildZoneLayout_Order(t *testing.T) {
+	cfg := ZonesConfig{TOP: 2, RIGHT: 1, BOTTOM: 2, LEFT: 1}
+	zones, err := buildZoneLayout(cfg)
+	if err != nil {
+		t.Fatalf("buildZoneLayout failed: %v", err)
+	}
+	if len(zones) != 6 {
+		t.Fatalf("expected 6 zones, got %d", len(zones))
+	}
+	// Clockwise from top-left: first zone is the top-left part of the top edge
+	if zones[0] != (Zone{0, 0, 0.5, 0.1}) {
+		t.Errorf("unexpected first zone: %+v", zones[0])
+	}
+	// Right edge follows the top edge
+	if zones[2].X1 != 1 || zones[2].X0 != 0.9 {
+		t.Errorf("expected right edge zone, got %+v", zones[2])
+	}
+
+	cfg.START = "bottom-left"
+	cfg.DIRECTION = "counterclockwise"
+	ccw, err := buildZoneLayout(cfg)
+	if err != nil {
+		t.Fatalf("buildZoneLayout failed: %v", err)
+	}
+	// Counterclockwise from bottom-left runs along the bottom edge to the right
+	if ccw[0] != zones[4] || ccw[1] != zones[3] || ccw[2] != zones[2] {
+		t.Errorf("unexpected counterclockwise order: %+v", ccw)
+	}
+	// and ends going down the left edge
+	if ccw[5] != zones[5] {
+		t.Errorf("expected last zone on the left edge, got %+v", ccw[5])
+	}
+}
+
+func TestBuildZoneLayout_Invalid(t *testing.T) {
+	if _, err := buildZoneLayout(ZonesConfig{}); err == nil {
+		t.Error("expected error for empty layout")
+	}
+	if _, err := buildZoneLayout(ZonesConfig{TOP: 1, START: "middle"}); err == nil {
+		t.Error("expected error for unknown start corner")
+	}
+	if _, err := buildZoneLayout(ZonesConfig{TOP: 1, DIRECTION: "sideways"}); err == nil {
+		t.Error("expected error for unknown direction")
+	}
+}
+
+func TestZoneColors(t *testing.T) {
+	// Left half red, right half blue
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			if x < 50 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	zones, err := buildZoneLayout(ZonesConfig{TOP: 2, RIGHT: 1, LEFT: 1})
+	if err != nil {
+		t.Fatalf("buildZoneLayout failed: %v", err)
+	}
+	colors := zoneColors(img, zones)
+	want := []RGB{{255, 0, 0}, {0, 0, 255}, {0, 0, 255}, {255, 0, 0}}
+	for i := range want {
+		if colors[i] != want[i] {
+			t.Errorf("zone %d: expected %v, got %v", i, want[i], colors[i])
+		}
+	}
+}